@@ -0,0 +1,91 @@
+package client
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"strings"
+
+	storprotocol "STor/interface"
+	util "STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+// Recorded when the client picks one of its bridges as the first hop of a circuit
+type BridgeSelected struct {
+	ClientId string
+	RouterId int
+	Addr     string
+}
+
+// A bridge from the client config. The coord does not list bridges, so the
+// line carries everything needed to reach one:
+// "[transport] addr publicKeyFile [secret]", secret being the hex transport
+// secret of a bridge that takes a transport.
+type bridgeLine struct {
+	addr      string
+	publicKey []byte         // the bridge's identity key, pinned when dialing it
+	transport util.Transport // nil for plain TLS
+}
+
+func parseBridgeLine(line string) (bridgeLine, error) {
+	fields := strings.Fields(line)
+	transportName := util.TransportNone
+	var secret []byte
+	if len(fields) == 4 {
+		var err error
+		if secret, err = hex.DecodeString(fields[3]); err != nil {
+			return bridgeLine{}, fmt.Errorf("bridge line %q has a malformed secret", line)
+		}
+		fields = fields[:3]
+	}
+	if len(fields) == 3 {
+		transportName, fields = fields[0], fields[1:]
+	}
+	if len(fields) != 2 {
+		return bridgeLine{}, fmt.Errorf("bridge line %q is not \"[transport] addr publicKeyFile [secret]\"", line)
+	}
+	publicKey, err := util.ReadPublicKeyFile(fields[1])
+	if err != nil {
+		return bridgeLine{}, err
+	}
+	transport, err := util.NewTransport(transportName, secret)
+	if err != nil {
+		return bridgeLine{}, err
+	}
+	return bridgeLine{addr: fields[0], publicKey: publicKey, transport: transport}, nil
+}
+
+// Connects to one of the client's bridges, starting from a random one and
+// trying the rest in turn, and returns it as the circuit's first hop
+func (c Client) dialBridge(trace *tracing.Trace, clientId string) (storprotocol.Router, *rpc.Client, *tracing.Trace, error) {
+	var err error
+	start := rand.Intn(len(c.Bridges))
+	for i := range c.Bridges {
+		bridge := c.Bridges[(start+i)%len(c.Bridges)]
+		var routerClient *rpc.Client
+		routerClient, err = util.DialRPCOver(bridge.addr, c.TLSCert, bridge.publicKey, bridge.transport)
+		if err != nil {
+			fmt.Println("Bridge", bridge.addr, "is unreachable:", err)
+			continue
+		}
+		request := storprotocol.STorBridgeDescriptorRequest{Token: trace.GenerateToken()}
+		var response storprotocol.STorBridgeDescriptorResponse
+		if err = routerClient.Call("RouterRPCListener.BridgeDescriptor", request, &response); err != nil {
+			fmt.Println("Bridge", bridge.addr, "did not give its descriptor:", err)
+			routerClient.Close()
+			continue
+		}
+		trace = c.Tracer.ReceiveToken(response.Token)
+
+		// The identity key comes from the bridge line, not from the bridge
+		router := response.Router
+		router.PublicKey = bridge.publicKey
+		router.Addr = bridge.addr
+		trace.RecordAction(BridgeSelected{ClientId: clientId, RouterId: router.RouterId, Addr: bridge.addr})
+		return router, routerClient, trace, nil
+	}
+	return storprotocol.Router{}, nil, trace, fmt.Errorf("no bridge is reachable: %w", err)
+}
@@ -0,0 +1,278 @@
+package client
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/rpc"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storprotocol "STor/interface"
+)
+
+const (
+	defaultCircuitReuse = 10 * time.Minute
+	// Well under the routers' default idle timeout of 5 minutes, so a circuit
+	// is torn down by the client before its routers drop it
+	defaultCircuitIdle = 2 * time.Minute
+)
+
+// Routers and keys of a circuit. generation changes whenever the circuit is
+// repaired, so a stream can tell whether its copy is stale.
+type circuitPath struct {
+	routers    []storprotocol.Router
+	sharedKeys [][]byte
+	generation int
+}
+
+// Numbers the cells the client sends on a circuit, so every hop can refuse
+// one it has seen before
+type cellSequence struct {
+	last uint64 // accessed atomically
+}
+
+func (cs *cellSequence) next() uint64 {
+	return atomic.AddUint64(&cs.last, 1)
+}
+
+// A circuit that requests to the same destination share, each as its own
+// stream, until it is too old to take new ones
+type sharedCircuit struct {
+	clientId     string
+	routerClient *rpc.Client
+	builtAt      time.Time
+	seq          *cellSequence
+	jar          http.CookieJar // cookies web servers set on this circuit, never sent on another
+	repairMu     sync.Mutex     // held while a stream repairs the circuit
+
+	mu           sync.Mutex
+	path         circuitPath
+	nextStreamId int
+	streams      int       // streams currently open
+	retired      bool      // takes no new streams
+	failed       bool      // broken, destroy it instead of tearing it down
+	released     bool      // handed back to be torn down or destroyed
+	idleSince    time.Time // when the last stream closed
+	circuitCells int       // chunks delivered on the circuit since the last circuit sendme
+}
+
+func newSharedCircuit(clientId string, routerClient *rpc.Client, routers []storprotocol.Router, sharedKeys [][]byte, seq *cellSequence) *sharedCircuit {
+	return &sharedCircuit{
+		clientId:     clientId,
+		routerClient: routerClient,
+		builtAt:      time.Now(),
+		seq:          seq,
+		jar:          newCookieJar(),
+		path:         circuitPath{routers: routers, sharedKeys: sharedKeys},
+	}
+}
+
+func newCookieJar() http.CookieJar {
+	jar, _ := cookiejar.New(nil) // never fails without options
+	return jar
+}
+
+// Cookies the circuit holds for rawUrl
+func (sc *sharedCircuit) cookies(rawUrl string) []*http.Cookie {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil
+	}
+	return sc.jar.Cookies(u)
+}
+
+// Keeps the cookies a response on the circuit set
+func (sc *sharedCircuit) setCookies(rawUrl string, header http.Header) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return
+	}
+	sc.jar.SetCookies(u, (&http.Response{Header: header}).Cookies())
+}
+
+func (sc *sharedCircuit) currentPath() circuitPath {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.path
+}
+
+// Installs the routers and keys of a repaired circuit
+func (sc *sharedCircuit) setPath(routers []storprotocol.Router, sharedKeys [][]byte) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.path = circuitPath{routers: routers, sharedKeys: sharedKeys, generation: sc.path.generation + 1}
+}
+
+// Counts a chunk delivered on the circuit and returns whether the next
+// request should carry a circuit sendme
+func (sc *sharedCircuit) delivered() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.circuitCells++
+	if sc.circuitCells < storprotocol.CircuitSendmeIncrement {
+		return false
+	}
+	sc.circuitCells -= storprotocol.CircuitSendmeIncrement
+	return true
+}
+
+// Must be called with mu held
+func (sc *sharedCircuit) retireIfOld(reuse time.Duration) {
+	if time.Since(sc.builtAt) > reuse {
+		sc.retired = true
+	}
+}
+
+// Returns a new stream id, or ok == false if the circuit is retired or full.
+// release is true if the circuit has no streams left and must be freed.
+func (sc *sharedCircuit) openStream(reuse time.Duration) (streamId int, ok bool, release bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.retireIfOld(reuse)
+	if sc.streams >= storprotocol.MaxStreamsPerCircuit {
+		sc.retired = true
+	}
+	if sc.retired {
+		return 0, false, sc.takeRelease()
+	}
+	streamId = sc.nextStreamId
+	sc.nextStreamId++
+	sc.streams++
+	return streamId, true, false
+}
+
+// Ends a stream. A failed stream retires the circuit. Returns true if the
+// circuit has no streams left and must be freed.
+func (sc *sharedCircuit) closeStream(failed bool, reuse time.Duration) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.streams--
+	if failed {
+		sc.failed = true
+		sc.retired = true
+	}
+	sc.retireIfOld(reuse)
+	if sc.streams == 0 {
+		sc.idleSince = time.Now()
+	}
+	return sc.takeRelease()
+}
+
+func (sc *sharedCircuit) unused() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.streams == 0 && !sc.released
+}
+
+// Retires the circuit if no stream has used it for idle. Returns true if the
+// circuit must now be freed.
+func (sc *sharedCircuit) releaseIfIdle(idle time.Duration) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.streams > 0 || time.Since(sc.idleSince) < idle {
+		return false
+	}
+	sc.retired = true
+	return sc.takeRelease()
+}
+
+// Must be called with mu held
+func (sc *sharedCircuit) takeRelease() bool {
+	if !sc.retired || sc.streams > 0 || sc.released {
+		return false
+	}
+	sc.released = true
+	return true
+}
+
+// Marks a circuit used outside the pool as broken, so it is destroyed when released
+func (sc *sharedCircuit) fail() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.failed = true
+}
+
+func (sc *sharedCircuit) isFailed() bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.failed
+}
+
+// The circuit each destination's requests currently share
+type circuitPool struct {
+	mu      sync.Mutex
+	entries map[string]*poolEntry
+	reuse   time.Duration
+	idle    time.Duration        // how long a circuit without streams is kept
+	onIdle  func(*sharedCircuit) // frees a circuit that went unused for idle
+}
+
+type poolEntry struct {
+	mu      sync.Mutex // held while a circuit for the destination is being built
+	circuit *sharedCircuit
+}
+
+func newCircuitPool(reuse time.Duration, idle time.Duration, onIdle func(*sharedCircuit)) *circuitPool {
+	if reuse <= 0 {
+		reuse = defaultCircuitReuse
+	}
+	if idle <= 0 {
+		idle = defaultCircuitIdle
+	}
+	return &circuitPool{entries: map[string]*poolEntry{}, reuse: reuse, idle: idle, onIdle: onIdle}
+}
+
+// Opens a stream on the destination's circuit. If that circuit cannot take
+// more streams a new one is built with build, and the old one is handed to
+// release once nothing uses it.
+func (p *circuitPool) openStream(destination string,
+	build func() (*sharedCircuit, error),
+	release func(*sharedCircuit)) (*sharedCircuit, int, error) {
+	p.mu.Lock()
+	entry, ok := p.entries[destination]
+	if !ok {
+		entry = &poolEntry{}
+		p.entries[destination] = entry
+	}
+	p.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.circuit != nil {
+		streamId, ok, idle := entry.circuit.openStream(p.reuse)
+		if ok {
+			return entry.circuit, streamId, nil
+		}
+		if idle {
+			release(entry.circuit)
+		}
+		entry.circuit = nil
+	}
+	circuit, err := build()
+	if err != nil {
+		return nil, 0, err
+	}
+	entry.circuit = circuit
+	streamId, _, _ := circuit.openStream(p.reuse)
+	return circuit, streamId, nil
+}
+
+// Ends a stream, returning true if the circuit must now be freed. A circuit
+// left without streams is handed to onIdle if no new stream opens on it
+// within idle, so neither its routers nor the guard connection are kept for
+// a destination the user does not come back to.
+func (p *circuitPool) closeStream(circuit *sharedCircuit, failed bool) bool {
+	if circuit.closeStream(failed, p.reuse) {
+		return true
+	}
+	if p.onIdle != nil && circuit.unused() {
+		time.AfterFunc(p.idle, func() {
+			if circuit.releaseIfIdle(p.idle) {
+				p.onIdle(circuit)
+			}
+		})
+	}
+	return false
+}
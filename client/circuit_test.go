@@ -0,0 +1,70 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"STor/util"
+)
+
+func TestClient_CookiesStayOnTheirCircuit(t *testing.T) {
+	first := newSharedCircuit("c1", nil, nil, nil, &cellSequence{})
+	second := newSharedCircuit("c2", nil, nil, nil, &cellSequence{})
+
+	// As the exit passes back what the web server set on the first circuit
+	first.setCookies("http://example.com/login", http.Header{"Set-Cookie": {"session=abc; Path=/"}})
+
+	browser := http.Header{"Cookie": {"session=browser"}}
+	policy := util.HeaderPolicy{}
+	if got := policy.Apply(browser, first.cookies("http://example.com/account")).Get("Cookie"); got != "session=abc" {
+		t.Fatalf("first circuit sent cookie %q, expected the one set on it", got)
+	}
+	if got := policy.Apply(browser, second.cookies("http://example.com/account")).Get("Cookie"); got != "" {
+		t.Fatalf("second circuit sent cookie %q set on another circuit", got)
+	}
+	if got := policy.Apply(browser, first.cookies("http://other.example/")).Get("Cookie"); got != "" {
+		t.Fatalf("cookie for example.com was sent to another site: %q", got)
+	}
+}
+
+func TestClient_IdleCircuitsAreReleased(t *testing.T) {
+	released := make(chan *sharedCircuit, 2)
+	p := newCircuitPool(time.Hour, 50*time.Millisecond, func(circuit *sharedCircuit) { released <- circuit })
+	built := 0
+	build := func() (*sharedCircuit, error) {
+		built++
+		return newSharedCircuit(fmt.Sprint("c", built), nil, nil, nil, &cellSequence{}), nil
+	}
+	noRelease := func(*sharedCircuit) { t.Fatalf("circuit was released on open") }
+
+	first, _, _ := p.openStream("example.com", build, noRelease)
+	if p.closeStream(first, false) {
+		t.Fatalf("circuit was freed as soon as its stream closed")
+	}
+	// Used again before it went idle: the first timer must not free it
+	time.Sleep(30 * time.Millisecond)
+	if again, _, _ := p.openStream("example.com", build, noRelease); again != first {
+		t.Fatalf("circuit was not reused within the idle period")
+	}
+	time.Sleep(40 * time.Millisecond)
+	select {
+	case <-released:
+		t.Fatalf("circuit with an open stream was released")
+	default:
+	}
+
+	p.closeStream(first, false)
+	select {
+	case circuit := <-released:
+		if circuit != first {
+			t.Fatalf("released the wrong circuit")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("idle circuit was not released")
+	}
+	if next, _, _ := p.openStream("example.com", build, noRelease); next == first || built != 2 {
+		t.Fatalf("released circuit was handed out again")
+	}
+}
@@ -1,12 +1,16 @@
 package client
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/rpc"
 	"strings"
+	"sync"
 	"time"
 
 	storprotocol "STor/interface"
@@ -17,18 +21,89 @@ import (
 )
 
 type ClientConfig struct {
-	ClientId          string
-	CoordAddr         string
-	WebServerAddr     string
-	TracingServerAddr string
-	Secret            []byte
-	TracingIdentity   string
+	ClientId            string
+	CoordAddr           string
+	WebServerAddr       string
+	TracingServerAddr   string
+	Secret              []byte
+	TracingIdentity     string
+	CoordPublicKeyFile  string
+	Coords              []util.AuthorityConfig // every coord; CoordAddr and CoordPublicKeyFile if empty
+	UnreliableMinutes   int                    // how long a router that failed mid-circuit is avoided
+	CircuitReuseMinutes int                    // how long new requests to a destination share a circuit
+	CircuitIdleSeconds  int                    // how long a circuit without streams is kept, under the routers' idle timeout
+	DNSListenAddr       string                 // local UDP address answering DNS through circuits, empty to disable
+	Bridges             []string               // bridge lines, "[transport] addr publicKeyFile"; if set every circuit starts at one of them
+	HeaderPolicy        util.HeaderPolicy      // what web servers are told about the browser
 }
 
 type Client struct {
-	ClientId string
-	Tracer   *tracing.Tracer
-	Trace    *tracing.Trace
+	ClientId    string
+	TLSCert     tls.Certificate    // throwaway certificate presented to the coord and guards
+	Coords      []util.Authority   // coords, each with its own directory; routers are used only if most agree on them
+	Directories *directoryHistory  // newest directory accepted from each coord
+	Unreliable  *unreliableRouters // routers that recently failed mid-circuit
+	Circuits    *circuitPool       // circuits shared by concurrent requests, by destination
+	Services    *serviceSessions   // rendezvous with onion services, by address
+	Bridges     []bridgeLine       // unlisted first hops used instead of the coord's guards
+	Tracer      *tracing.Tracer
+	Trace       *tracing.Trace
+}
+
+// Returned when a router reports that the circuit broke
+type CircuitFailedError struct {
+	FailedHop int  // index in the onion ring of the router that could not be reached, -1 if none failed
+	Destroyed bool // the reporting router no longer has the circuit
+	ErrMsg    string
+}
+
+func (e *CircuitFailedError) Error() string {
+	return e.ErrMsg
+}
+
+// Returned when the exit could not carry out a request; the circuit itself still works
+type ExitRequestError struct {
+	ErrMsg string
+}
+
+func (e *ExitRequestError) Error() string {
+	return e.ErrMsg
+}
+
+const defaultUnreliableTimeout = 10 * time.Minute
+
+// Routers the client asks the coord to leave out of new circuits
+type unreliableRouters struct {
+	mu      sync.Mutex
+	until   map[int]time.Time
+	timeout time.Duration
+}
+
+func newUnreliableRouters(timeout time.Duration) *unreliableRouters {
+	if timeout <= 0 {
+		timeout = defaultUnreliableTimeout
+	}
+	return &unreliableRouters{until: map[int]time.Time{}, timeout: timeout}
+}
+
+func (u *unreliableRouters) mark(routerId int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.until[routerId] = time.Now().Add(u.timeout)
+}
+
+func (u *unreliableRouters) ids() []int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var ids []int
+	for routerId, until := range u.until {
+		if time.Now().After(until) {
+			delete(u.until, routerId)
+			continue
+		}
+		ids = append(ids, routerId)
+	}
+	return ids
 }
 
 // ======================== TRACING STRUCTS ========================
@@ -83,6 +158,24 @@ type ClientRequestFailed struct {
 	ErrMsg   string
 }
 
+// Recorded when a router in the circuit could not be reached and is avoided for a while
+type RouterMarkedUnreliable struct {
+	ClientId string
+	RouterId int
+}
+
+// Recorded when cutting the circuit back to Hop before replacing the hop after it
+type CircuitTruncate struct {
+	ClientId string
+	Hop      int
+}
+
+// Recorded when a failed hop has been replaced and the circuit extended again
+type CircuitRepaired struct {
+	ClientId  string
+	RouterIds []int
+}
+
 // Recorded when making a request to a Router to teardown circuits
 type CircuitTeardown struct {
 	ClientId string
@@ -104,6 +197,33 @@ var config ClientConfig
 func NewClient(clientNum string) *Client {
 	err := util.ReadJSONConfig(fmt.Sprintf("./config/client_config%s.json", clientNum), &config)
 	util.CheckErr(err, "Error reading client config: %v\n", err)
+	return newClient()
+}
+
+// Creates a client from the package config
+func newClient() *Client {
+	coords, err := util.LoadAuthorities(config.CoordAddr, config.CoordPublicKeyFile, config.Coords)
+	for _, coord := range coords {
+		// Without the key the client cannot check the coord's directory
+		if coord.PublicKey == nil {
+			err = fmt.Errorf("no key is pinned for coord %s", coord.Addr)
+		}
+	}
+	util.CheckErr(err, "Error reading coord public key: %v\n", err)
+
+	// The client certificate is not tied to anything, it only satisfies the mutual TLS handshake
+	privateKey, _, err := util.GenerateRSAKeyPair()
+	util.CheckErr(err, "Error generating client key: %v\n", err)
+	cert, err := util.NewTLSCertificate(privateKey)
+	util.CheckErr(err, "Error creating client certificate: %v\n", err)
+
+	var bridges []bridgeLine
+	for _, line := range config.Bridges {
+		bridge, err := parseBridgeLine(line)
+		util.CheckErr(err, "Error reading bridge line: %v\n", err)
+		bridges = append(bridges, bridge)
+	}
+
 	tracer := tracing.NewTracer(tracing.TracerConfig{
 		ServerAddress:  config.TracingServerAddr,
 		TracerIdentity: config.TracingIdentity,
@@ -111,9 +231,19 @@ func NewClient(clientNum string) *Client {
 	})
 
 	client := &Client{
-		Tracer: tracer,
-		Trace:  tracer.CreateTrace(),
+		TLSCert:     cert,
+		Coords:      coords,
+		Directories: newDirectoryHistory(),
+		Unreliable:  newUnreliableRouters(time.Duration(config.UnreliableMinutes) * time.Minute),
+		Services:    newServiceSessions(),
+		Bridges:     bridges,
+		Tracer:      tracer,
+		Trace:       tracer.CreateTrace(),
 	}
+	client.Circuits = newCircuitPool(time.Duration(config.CircuitReuseMinutes)*time.Minute,
+		time.Duration(config.CircuitIdleSeconds)*time.Second, func(circuit *sharedCircuit) {
+			client.releaseCircuit(client.Trace, circuit)
+		})
 
 	return client
 }
@@ -135,100 +265,397 @@ func (c Client) handler(w http.ResponseWriter, r *http.Request) {
 	// body := r.Body
 
 	trace := c.Trace
-
-	for {
-		clientId := uuid.New().String()
-		time.Sleep(1 * time.Second)
-		var coordReply storprotocol.STorCoordOnionRingResponse
-		coordClient, _ := rpc.Dial("tcp", config.CoordAddr)
-
-		trace.RecordAction(GetOnionRing{ClientId: clientId})
-		coordOnionRingRequest := storprotocol.STorCoordOnionRingRequest{
-			ClientId: clientId,
-			Token:    trace.GenerateToken(),
+	destination := webUrl
+	if _, host, port, err := util.ParseExitDestination(webUrl); err == nil {
+		if util.IsServiceAddress(host) {
+			c.handleOnionService(w, r, host, webUrl, oldUrl)
+			return
 		}
-		coordClient.Call("CoordRPCListener.GetOnionRing", coordOnionRingRequest, &coordReply)
-
-		trace = c.Tracer.ReceiveToken(coordReply.Token)
-		trace.RecordAction(NewOnionRing{ClientId: clientId, RouterIds: util.RouterIds(coordReply.OnionRing)})
-		coordClient.Close()
+		destination = fmt.Sprintf("%s:%d", host, port)
+	}
 
-		routerClient, err := rpc.Dial("tcp", coordReply.OnionRing[0].Addr)
+	// Read once, since the request may be retried on another circuit
+	requestBody, err := io.ReadAll(r.Body)
+	if err != nil {
+		fmt.Fprintf(w, "<p>Unable to read the request: %s</p>", err)
+		return
+	}
 
+	for {
+		circuit, streamId, err := c.Circuits.openStream(destination, func() (circuit *sharedCircuit, err error) {
+			circuit, trace, err = c.buildCircuit(trace, webUrl, 0)
+			return circuit, err
+		}, func(idle *sharedCircuit) {
+			c.releaseCircuit(trace, idle)
+		})
+		if errors.Is(err, errNoOnionRing) {
+			fmt.Println(err)
+			fmt.Fprintf(w, "<p>Unable to build a circuit: %s</p>", errors.Unwrap(err))
+			return
+		}
 		if err != nil {
 			fmt.Println(err)
 			continue
 		}
 
-		sharedKeys := [][]byte{util.GenerateAESKey(), util.GenerateAESKey(), util.GenerateAESKey()}
+		// Scrubbed before it goes anywhere near the circuit; only the
+		// circuit's own cookies go with it
+		routerArgs := storprotocol.STorRouterHTTPRequest{
+			Header:   config.HeaderPolicy.Apply(r.Header, circuit.cookies(webUrl)),
+			Method:   r.Method,
+			Url:      webUrl,
+			Body:     requestBody,
+			StreamId: streamId,
+		}
 
-		if err = constructCircuit(trace, c.Tracer, config, sharedKeys, routerClient, coordReply.OnionRing, clientId); err != nil {
+		var plaintext []byte
+		path := circuit.currentPath()
+		plaintext, trace, err = c.sendRequest(r.Context(), trace, circuit, path, &routerArgs)
+		var failure *CircuitFailedError
+		if errors.As(err, &failure) && failure.FailedHop > 0 && failure.FailedHop < len(path.routers) {
+			// Swap out the failed hop and retry once before building a new circuit
+			if err = c.repairCircuit(trace, circuit, path, failure.FailedHop, webUrl); err == nil {
+				plaintext, trace, err = c.sendRequest(r.Context(), trace, circuit, circuit.currentPath(), &routerArgs)
+			}
+		}
+		if r.Context().Err() != nil {
+			// The browser gave up on the request; the circuit is still fine
+			if c.Circuits.closeStream(circuit, false) {
+				c.releaseCircuit(trace, circuit)
+			}
+			return
+		}
+		// The exit turned the request down; another circuit would fare no better
+		var exitErr *ExitRequestError
+		if errors.As(err, &exitErr) {
+			fmt.Println(err)
+			fmt.Fprintf(w, "<p>Unable to fetch the page: %s</p>", exitErr.ErrMsg)
+			if c.Circuits.closeStream(circuit, false) {
+				c.releaseCircuit(trace, circuit)
+			}
+			return
+		}
+		if err != nil {
 			fmt.Println(err)
-			routerClient.Close()
+			// Free whatever is left of the circuit once its other streams are done
+			if c.Circuits.closeStream(circuit, true) {
+				c.releaseCircuit(trace, circuit)
+			}
 			continue
 		}
-		routerArgs := storprotocol.STorRouterHTTPRequest{
-			Header: r.Header,
-			Method: r.Method,
-			Url:    webUrl,
+
+		content := string(plaintext[:])
+		processedContent := hardCodedContentProcessing(oldUrl, config.WebServerAddr, content)
+		fmt.Fprintf(w, processedContent)
+
+		if c.Circuits.closeStream(circuit, false) {
+			c.releaseCircuit(trace, circuit)
 		}
+		break
+	}
 
-		onionMessage := onionizeMessage(config, &routerArgs, coordReply.OnionRing, sharedKeys, clientId)
+}
+
+// Returned by buildCircuit when the coord will not give out an onion ring
+var errNoOnionRing = errors.New("no onion ring")
+
+// Asks the coords for an onion ring towards webUrl, or ending at router
+// lastHop if it is not 0, and builds a circuit through it
+func (c Client) buildCircuit(trace *tracing.Trace, webUrl string, lastHop int) (*sharedCircuit, *tracing.Trace, error) {
+	clientId := uuid.New().String()
+	time.Sleep(1 * time.Second)
+	var coordReply storprotocol.STorCoordOnionRingResponse
+	var err error
+	coordReply.OnionRing, trace, err = c.askCoords(trace, func(coordClient *rpc.Client, agreed map[int]storprotocol.Router, trace *tracing.Trace) ([]storprotocol.Router, *tracing.Trace, error) {
+		rejectedExits, err := refusingExits(agreed, webUrl)
+		if err != nil {
+			return nil, trace, err
+		}
+		trace.RecordAction(GetOnionRing{ClientId: clientId})
+		coordOnionRingRequest := storprotocol.STorCoordOnionRingRequest{
+			ClientId:         clientId,
+			ExcludeRouterIds: c.Unreliable.ids(),
+			RejectedExitIds:  rejectedExits,
+			LastHopRouterId:  lastHop,
+			Token:            trace.GenerateToken(),
+		}
+		var reply storprotocol.STorCoordOnionRingResponse
+		if err := coordClient.Call("CoordRPCListener.GetOnionRing", coordOnionRingRequest, &reply); err != nil {
+			return nil, trace, err
+		}
+		trace = c.Tracer.ReceiveToken(reply.Token)
+		trace.RecordAction(NewOnionRing{ClientId: clientId, RouterIds: util.RouterIds(reply.OnionRing)})
+		if n := len(reply.OnionRing); lastHop == 0 && n > 0 && hasRouterId(rejectedExits, reply.OnionRing[n-1].RouterId) {
+			return nil, trace, errors.New("coord picked an exit whose policy refuses the destination")
+		}
+		return reply.OnionRing, trace, nil
+	})
+	if errors.Is(err, errCoordsUnreachable) {
+		return nil, trace, err
+	}
+	if err != nil {
+		return nil, trace, fmt.Errorf("%w: %v", errNoOnionRing, err)
+	}
+
+	var routerClient *rpc.Client
+	if len(c.Bridges) > 0 {
+		// A bridge stands in for the guard the coord picked
+		coordReply.OnionRing[0], routerClient, trace, err = c.dialBridge(trace, clientId)
+		if err != nil {
+			return nil, trace, err
+		}
+	} else {
+		routerClient, err = util.DialRPC(coordReply.OnionRing[0].Addr, c.TLSCert, coordReply.OnionRing[0].PublicKey)
+		if err != nil {
+			c.markUnreliable(trace, clientId, coordReply.OnionRing[0].RouterId)
+			return nil, trace, err
+		}
+	}
+
+	sharedKeys := [][]byte{util.GenerateAESKey(), util.GenerateAESKey(), util.GenerateAESKey()}
+	seq := &cellSequence{}
+
+	if err = constructCircuit(trace, c.Tracer, config, sharedKeys, routerClient, coordReply.OnionRing, clientId, seq); err != nil {
+		c.noteCircuitFailure(trace, clientId, coordReply.OnionRing, err)
+		destroyCircuit(routerClient, clientId, trace)
+		routerClient.Close()
+		return nil, trace, err
+	}
+	return newSharedCircuit(clientId, routerClient, coordReply.OnionRing, sharedKeys, seq), trace, nil
+}
+
+// Frees a circuit no stream uses any more: torn down if it still works,
+// destroyed along whatever is left of it if it broke
+func (c Client) releaseCircuit(trace *tracing.Trace, circuit *sharedCircuit) {
+	defer circuit.routerClient.Close()
+	clientId := circuit.clientId
+	if circuit.isFailed() {
+		destroyCircuit(circuit.routerClient, clientId, trace)
+		return
+	}
+
+	path := circuit.currentPath()
+	trace.RecordAction(CircuitTeardown{clientId})
+	teardownMessage := constructTeardownMessage(circuit.routerClient, path.sharedKeys, path.routers, nil, clientId, circuit.seq.next(), trace)
+
+	var errPayload storprotocol.STorGeneralRouterPackageResponse
+	if err := circuit.routerClient.Call("RouterRPCListener.Teardown", teardownMessage, &errPayload); err != nil {
+		trace.RecordAction(CircuitTeardownFailed{ClientId: clientId, ErrMsg: "Cannot contact the Guard Router in teardown"})
+		fmt.Println(err)
+		return
+	}
+
+	trace = c.Tracer.ReceiveToken(errPayload.Token)
+	if _, err := deonionizeTeardownMessage(errPayload.Payload, path.sharedKeys); err != nil {
+		trace.RecordAction(CircuitTeardownFailed{ClientId: clientId, ErrMsg: err.Error()})
+	}
+	trace.RecordAction(CircuitTeardownComplete{ClientId: clientId})
+}
+
+func (c Client) markUnreliable(trace *tracing.Trace, clientId string, routerId int) {
+	trace.RecordAction(RouterMarkedUnreliable{ClientId: clientId, RouterId: routerId})
+	c.Unreliable.mark(routerId)
+}
+
+// Marks the router that broke the circuit, if a router reported one
+func (c Client) noteCircuitFailure(trace *tracing.Trace, clientId string, routers []storprotocol.Router, err error) {
+	var failure *CircuitFailedError
+	if errors.As(err, &failure) && failure.FailedHop >= 0 && failure.FailedHop < len(routers) {
+		c.markUnreliable(trace, clientId, routers[failure.FailedHop].RouterId)
+	}
+}
+
+// Asks the guard to destroy the circuit and pass that on, best effort
+func destroyCircuit(routerClient *rpc.Client, clientId string, trace *tracing.Trace) {
+	request := storprotocol.STorCircuitDestroyRequest{
+		ClientId: clientId,
+		Token:    trace.GenerateToken(),
+	}
+	var response storprotocol.STorCircuitDestroyResponse
+	if err := routerClient.Call("RouterRPCListener.Destroy", request, &response); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// Error for a failed reply from hop i
+func routerReplyError(payload storprotocol.STorRouterReply, i int) error {
+	if !payload.CircuitDestroyed && !payload.NextHopFailed {
+		return errors.New(payload.ErrMsg)
+	}
+	failedHop := -1
+	if payload.NextHopFailed {
+		failedHop = i + 1
+	}
+	return &CircuitFailedError{FailedHop: failedHop, Destroyed: payload.CircuitDestroyed, ErrMsg: payload.ErrMsg}
+}
+
+// Sends the request through the circuit on its own stream and returns the
+// web server's response. The stream is ended at the exit if ctx is cancelled
+// before the whole body has arrived.
+func (c Client) sendRequest(ctx context.Context,
+	trace *tracing.Trace,
+	circuit *sharedCircuit,
+	path circuitPath,
+	routerArgs *storprotocol.STorRouterHTTPRequest) ([]byte, *tracing.Trace, error) {
+	clientId := circuit.clientId
+	streamId := routerArgs.StreamId
+	webUrl := routerArgs.Url
+	// The exit relays large bodies a chunk at a time; keep asking until it has
+	// sent all of it, acknowledging each window increment consumed so it keeps
+	// reading ahead
+	var body []byte
+	streamCells := 0
+	for {
+		onionMessage := onionizeMessage(config, routerArgs, path.routers, path.sharedKeys, clientId, circuit.seq.next())
 
 		var routerReply storprotocol.STorRouterHTTPResponse
 
 		trace.RecordAction(ClientRequest{ClientId: clientId, RequestOnion: util.TracePayload(onionMessage.Onion)})
 		onionMessage.Token = trace.GenerateToken()
-		if err = routerClient.Call("RouterRPCListener.Send", onionMessage, &routerReply); err != nil {
+		if err := circuit.routerClient.Call("RouterRPCListener.Send", onionMessage, &routerReply); err != nil {
 			trace = c.Tracer.ReceiveToken(routerReply.Token)
 			trace.RecordAction(ClientRequestFailed{ClientId: clientId, ErrMsg: "Cannot contact the Guard Router in Send"})
-
-			fmt.Println(err)
-			routerClient.Close()
-			continue
+			return nil, trace, err
 		}
 
 		trace = c.Tracer.ReceiveToken(routerReply.Token)
 		trace.RecordAction(ResponseRecvd{ClientId: clientId, ResponseOnion: util.TracePayload(routerReply.Response)})
 
-		plaintext, err := deonionizeMessage(routerReply.Response, sharedKeys)
-
+		exitReply, err := deonionizeMessage(routerReply.Response, path.sharedKeys)
 		if err != nil {
-			trace = c.Tracer.ReceiveToken(routerReply.Token)
 			errMessage := err.Error()
 			trace.RecordAction(ClientRequestFailed{ClientId: clientId, ErrMsg: errMessage})
-			routerClient.Close()
-			continue
+			c.noteCircuitFailure(trace, clientId, path.routers, err)
+			return nil, trace, err
+		}
+		if len(exitReply.SetCookies) > 0 {
+			// Only ever sent back on this circuit
+			circuit.setCookies(webUrl, http.Header{"Set-Cookie": exitReply.SetCookies})
+		}
+		body = append(body, exitReply.Payload...)
+		if !exitReply.HasMore {
+			return body, trace, nil
 		}
+		streamCells++
+		routerArgs = &storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandNextChunk, StreamId: streamId}
+		if streamCells >= storprotocol.StreamSendmeIncrement {
+			streamCells -= storprotocol.StreamSendmeIncrement
+			routerArgs.StreamSendme = true
+		}
+		routerArgs.CircuitSendme = circuit.delivered()
+		if ctx.Err() != nil {
+			routerArgs.Command = storprotocol.ExitCommandEnd
+			endStream(circuit, path, routerArgs)
+			return nil, trace, ctx.Err()
+		}
+	}
+}
 
-		content := string(plaintext[:])
-		processedContent := hardCodedContentProcessing(oldUrl, config.WebServerAddr, content)
-		fmt.Fprintf(w, processedContent)
+// Tells the exit to close a stream the client no longer wants, best effort
+func endStream(circuit *sharedCircuit, path circuitPath, routerArgs *storprotocol.STorRouterHTTPRequest) {
+	onionMessage := onionizeMessage(config, routerArgs, path.routers, path.sharedKeys, circuit.clientId, circuit.seq.next())
+	var routerReply storprotocol.STorRouterHTTPResponse
+	if err := circuit.routerClient.Call("RouterRPCListener.Send", onionMessage, &routerReply); err != nil {
+		fmt.Println(err)
+	}
+}
 
-		trace.RecordAction(CircuitTeardown{clientId})
-		teardownMessage := constructTeardownMessage(routerClient, sharedKeys, coordReply.OnionRing, nil, clientId, trace)
+// Positions of the onion ring, by hop
+var hopRoles = []string{storprotocol.RoleGuard, storprotocol.RoleMiddle, storprotocol.RoleExit}
+
+// Cuts the circuit back to the hop before failedHop and extends it again
+// through a replacement router from the coords. path is the circuit as the
+// failing stream saw it; if another stream has repaired the circuit since,
+// there is nothing left to do.
+func (c Client) repairCircuit(trace *tracing.Trace,
+	circuit *sharedCircuit,
+	path circuitPath,
+	failedHop int,
+	destination string) error {
+	circuit.repairMu.Lock()
+	defer circuit.repairMu.Unlock()
+	if circuit.currentPath().generation != path.generation {
+		return nil
+	}
+	routerClient := circuit.routerClient
+	clientId := circuit.clientId
+	routers := append([]storprotocol.Router(nil), path.routers...)
+	sharedKeys := append([][]byte(nil), path.sharedKeys...)
+
+	keep := failedHop - 1
+	trace.RecordAction(CircuitTruncate{ClientId: clientId, Hop: keep})
+	truncateMessage := constructTruncateMessage(routerClient, sharedKeys, routers, keep, clientId, circuit.seq.next(), trace)
+	var truncateReply storprotocol.STorGeneralRouterPackageResponse
+	if err := routerClient.Call("RouterRPCListener.Truncate", truncateMessage, &truncateReply); err != nil {
+		return err
+	}
+	trace = c.Tracer.ReceiveToken(truncateReply.Token)
+	if _, err := deonionizeTeardownMessage(truncateReply.Payload, sharedKeys); err != nil {
+		return err
+	}
 
-		var errPayload storprotocol.STorGeneralRouterPackageResponse
-		if err = routerClient.Call("RouterRPCListener.Teardown", teardownMessage, &errPayload); err != nil {
-			trace.RecordAction(CircuitTeardownFailed{ClientId: clientId, ErrMsg: "Cannot contact the Guard Router in teardown"})
-			fmt.Println(err)
-			routerClient.Close()
-			break
+	replacement, trace, err := c.askCoords(trace, func(coordClient *rpc.Client, agreed map[int]storprotocol.Router, trace *tracing.Trace) ([]storprotocol.Router, *tracing.Trace, error) {
+		var rejectedExits []int
+		if hopRoles[failedHop] == storprotocol.RoleExit {
+			var err error
+			if rejectedExits, err = refusingExits(agreed, destination); err != nil {
+				return nil, trace, err
+			}
 		}
-
-		trace = c.Tracer.ReceiveToken(errPayload.Token)
-		_, err = deonionizeTeardownMessage(errPayload.Payload, sharedKeys)
-		if err != nil {
-			errMessage := err.Error()
-			trace.RecordAction(CircuitTeardownFailed{ClientId: clientId, ErrMsg: errMessage})
+		request := storprotocol.STorCoordReplacementRequest{
+			ClientId:         clientId,
+			Position:         hopRoles[failedHop],
+			ExcludeRouterIds: append(util.RouterIds(routers), c.Unreliable.ids()...),
+			RejectedExitIds:  rejectedExits,
+			Token:            trace.GenerateToken(),
 		}
+		var response storprotocol.STorCoordReplacementResponse
+		if err := coordClient.Call("CoordRPCListener.GetReplacementRouter", request, &response); err != nil {
+			return nil, trace, err
+		}
+		if hasRouterId(rejectedExits, response.Router.RouterId) {
+			return nil, trace, errors.New("coord picked an exit whose policy refuses the destination")
+		}
+		return []storprotocol.Router{response.Router}, c.Tracer.ReceiveToken(response.Token), nil
+	})
+	if err != nil {
+		return err
+	}
 
-		routerClient.Close()
-		trace.RecordAction(CircuitTeardownComplete{ClientId: clientId})
-
-		break
+	// Hops past the failed one were destroyed by the truncate, so they need new keys too
+	routers[failedHop] = replacement[0]
+	for hop := failedHop; hop < len(routers); hop++ {
+		sharedKeys[hop] = util.GenerateAESKey()
+		if err = extendCircuit(trace, c.Tracer, sharedKeys, routerClient, routers, hop, clientId, circuit.seq); err != nil {
+			return err
+		}
 	}
+	circuit.setPath(routers, sharedKeys)
+	trace.RecordAction(CircuitRepaired{ClientId: clientId, RouterIds: util.RouterIds(routers)})
+	return nil
+}
 
+// Builds a Truncate request that ends at hop keep
+func constructTruncateMessage(routerClient *rpc.Client,
+	sharedKeys [][]byte,
+	routers []storprotocol.Router,
+	keep int,
+	clientId string,
+	seq uint64,
+	trace *tracing.Trace) storprotocol.STorGeneralRouterPackageRequest {
+	keys := [][]byte{}
+	addrs := []string{}
+	nextKeys := [][]byte{}
+	encryptionTypes := []string{}
+	for i := keep; i >= 0; i-- {
+		keys = append(keys, sharedKeys[i])
+		encryptionTypes = append(encryptionTypes, "AES")
+		if i > 0 {
+			addrs = append(addrs, routers[i].Addr)
+			nextKeys = append(nextKeys, routers[i].PublicKey)
+		}
+	}
+	return generateSecurePayload(routerClient, clientId, nil, 0, seq, keys, addrs, nextKeys, encryptionTypes, sharedKeys, trace)
 }
 
 func constructTeardownMessage(routerClient *rpc.Client,
@@ -236,13 +663,15 @@ func constructTeardownMessage(routerClient *rpc.Client,
 	routers []storprotocol.Router,
 	payload []byte,
 	clientId string,
+	seq uint64,
 	trace *tracing.Trace) storprotocol.STorGeneralRouterPackageRequest {
 
 	keys := [][]byte{sharedKeys[2], sharedKeys[1], sharedKeys[0]}
 	addrs := []string{routers[2].Addr, routers[1].Addr}
+	nextKeys := [][]byte{routers[2].PublicKey, routers[1].PublicKey}
 	encryptionTypes := []string{"AES", "AES", "AES"}
 
-	return generateSecurePayload(routerClient, clientId, payload, keys, addrs, encryptionTypes, sharedKeys, trace)
+	return generateSecurePayload(routerClient, clientId, payload, 0, seq, keys, addrs, nextKeys, encryptionTypes, sharedKeys, trace)
 }
 
 // ================= hard coded for test website things =================
@@ -281,30 +710,42 @@ func constructCircuit(trace *tracing.Trace,
 	sharedKeys [][]byte,
 	routerClient *rpc.Client,
 	routers []storprotocol.Router,
-	clientId string) error {
-	// Router 1's shared key payload
-	keys := [][]byte{routers[0].PublicKey}
+	clientId string,
+	seq *cellSequence) error {
+	for hop := range routers {
+		if err := extendCircuit(trace, tracer, sharedKeys, routerClient, routers, hop, clientId, seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Installs sharedKeys[hop] at routers[hop], relaying the handshake through the
+// hops before it, which must already be in the circuit
+func extendCircuit(trace *tracing.Trace,
+	tracer *tracing.Tracer,
+	sharedKeys [][]byte,
+	routerClient *rpc.Client,
+	routers []storprotocol.Router,
+	hop int,
+	clientId string,
+	seq *cellSequence) error {
+	keys := [][]byte{routers[hop].OnionKey}
 	addrs := []string{}
+	nextKeys := [][]byte{}
 	encryptionTypes := []string{"RSA"}
-	payload := generateSecurePayload(routerClient, clientId, sharedKeys[0], keys, addrs, encryptionTypes, sharedKeys, trace)
-	if err := SendSecurePayload(trace, tracer, routerClient, addrs, sharedKeys, payload, clientId); err != nil {
-		trace.RecordAction(CircuitInitFailed{ClientId: clientId, ErrMsg: err.Error()})
-		return err
+	for i := hop - 1; i >= 0; i-- {
+		keys = append(keys, sharedKeys[i])
+		addrs = append(addrs, routers[i+1].Addr)
+		nextKeys = append(nextKeys, routers[i+1].PublicKey)
+		encryptionTypes = append(encryptionTypes, "AES")
 	}
-
-	keys = [][]byte{routers[1].PublicKey, sharedKeys[0]}
-	addrs = []string{routers[1].Addr}
-	encryptionTypes = []string{"RSA", "AES"}
-	payload = generateSecurePayload(routerClient, clientId, sharedKeys[1], keys, addrs, encryptionTypes, sharedKeys, trace)
-	if err := SendSecurePayload(trace, tracer, routerClient, addrs, sharedKeys, payload, clientId); err != nil {
-		trace.RecordAction(CircuitInitFailed{ClientId: clientId, ErrMsg: err.Error()})
-		return err
+	// A loaded router only decrypts handshakes that come with a puzzle solution
+	var powNonce uint64
+	if routers[hop].PowDifficulty > 0 {
+		powNonce = util.SolvePow(routers[hop].PowSeed, clientId, routers[hop].PowDifficulty)
 	}
-
-	keys = [][]byte{routers[2].PublicKey, sharedKeys[1], sharedKeys[0]}
-	addrs = []string{routers[2].Addr, routers[1].Addr}
-	encryptionTypes = []string{"RSA", "AES", "AES"}
-	payload = generateSecurePayload(routerClient, clientId, sharedKeys[2], keys, addrs, encryptionTypes, sharedKeys, trace)
+	payload := generateSecurePayload(routerClient, clientId, sharedKeys[hop], powNonce, seq.next(), keys, addrs, nextKeys, encryptionTypes, sharedKeys, trace)
 	if err := SendSecurePayload(trace, tracer, routerClient, addrs, sharedKeys, payload, clientId); err != nil {
 		trace.RecordAction(CircuitInitFailed{ClientId: clientId, ErrMsg: err.Error()})
 		return err
@@ -315,8 +756,11 @@ func constructCircuit(trace *tracing.Trace,
 func generateSecurePayload(routerClient *rpc.Client,
 	clientId string,
 	initPayload []byte,
+	powNonce uint64,
+	seq uint64,
 	keys [][]byte,
 	addr []string,
+	nextKeys [][]byte,
 	encryptionType []string,
 	sharedKeys [][]byte,
 	trace *tracing.Trace) storprotocol.STorGeneralRouterPackageRequest {
@@ -324,10 +768,15 @@ func generateSecurePayload(routerClient *rpc.Client,
 		ClientId: clientId,
 		Payload:  initPayload,
 		NextAddr: "",
+		Seq:      seq,
 	}
 
 	for i := 0; i+1 < len(keys); i++ {
-		tmp := storprotocol.STorEncryptedRouterRequest{ClientId: clientId, NextAddr: addr[i], EncryptionType: encryptionType[i]}
+		tmp := storprotocol.STorEncryptedRouterRequest{ClientId: clientId, NextAddr: addr[i], NextPublicKey: nextKeys[i], EncryptionType: encryptionType[i], Seq: seq}
+		if i == 0 {
+			// Handed on in the clear with the innermost layer, for the router it is meant for
+			tmp.PowNonce = powNonce
+		}
 
 		if encryptionType[i] == "RSA" {
 			tmp.Payload = util.EncodeAndEncryptRSA(keys[i], payload)
@@ -343,6 +792,9 @@ func generateSecurePayload(routerClient *rpc.Client,
 		EncryptionType: encryptionType[lastInd],
 		Token:          trace.GenerateToken(),
 	}
+	if lastInd == 0 {
+		generalRequest.PowNonce = powNonce
+	}
 
 	if encryptionType[lastInd] == "RSA" {
 		generalRequest.Payload = util.EncodeAndEncryptRSA(keys[lastInd], payload)
@@ -372,12 +824,12 @@ func SendSecurePayload(trace *tracing.Trace,
 	trace = tracer.ReceiveToken(errPayload.Token)
 	trace.RecordAction(CircuitInitComplete{ClientId: clientId})
 
-	for i := 0; i < len(addr); i++ {
+	for i := 0; i <= len(addr); i++ {
 		var routerReply storprotocol.STorRouterReply
 		util.DecodeAndDecryptAES(sharedKeys[i], errPayload.Payload, &routerReply)
 
 		if !routerReply.DidSucceed {
-			return errors.New(routerReply.ErrMsg)
+			return routerReplyError(routerReply, i)
 		} else if routerReply.Payload != nil {
 			errPayload.Payload = routerReply.Payload
 		} else {
@@ -391,20 +843,26 @@ func onionizeMessage(config ClientConfig,
 	httpRequest *storprotocol.STorRouterHTTPRequest,
 	routers []storprotocol.Router,
 	sharedKeys [][]byte,
-	clientId string) storprotocol.STorOnionMessage {
+	clientId string,
+	seq uint64) storprotocol.STorOnionMessage {
 	layerZero := storprotocol.STorEncryptedRouterRequest{
 		NextAddr: "",
 		Payload:  util.Encode(*httpRequest),
+		Seq:      seq,
 	}
 
 	layerOne := storprotocol.STorEncryptedRouterRequest{
-		NextAddr: routers[2].Addr,
-		Payload:  util.EncodeAndEncryptAES(sharedKeys[2], layerZero),
+		NextAddr:      routers[2].Addr,
+		NextPublicKey: routers[2].PublicKey,
+		Payload:       util.EncodeAndEncryptAES(sharedKeys[2], layerZero),
+		Seq:           seq,
 	}
 
 	layerTwo := storprotocol.STorEncryptedRouterRequest{
-		NextAddr: routers[1].Addr,
-		Payload:  util.EncodeAndEncryptAES(sharedKeys[1], layerOne),
+		NextAddr:      routers[1].Addr,
+		NextPublicKey: routers[1].PublicKey,
+		Payload:       util.EncodeAndEncryptAES(sharedKeys[1], layerOne),
+		Seq:           seq,
 	}
 
 	message := storprotocol.STorOnionMessage{
@@ -415,21 +873,26 @@ func onionizeMessage(config ClientConfig,
 	return message
 }
 
-func deonionizeMessage(onion []byte, sharedkeys [][]byte) ([]byte, error) {
+// Returns the exit's chunk of the response and whether it has more
+// Peels every layer off the reply and returns the exit's
+func deonionizeMessage(onion []byte, sharedkeys [][]byte) (storprotocol.STorRouterReply, error) {
 
 	for i := 0; i < 3; i++ {
 		var payload storprotocol.STorRouterReply
 		util.DecodeAndDecryptAES(sharedkeys[i], onion, &payload)
 
 		if !payload.DidSucceed {
-			return nil, errors.New(payload.ErrMsg)
+			if i == len(sharedkeys)-1 && !payload.CircuitDestroyed && !payload.NextHopFailed {
+				return storprotocol.STorRouterReply{}, &ExitRequestError{ErrMsg: payload.ErrMsg}
+			}
+			return storprotocol.STorRouterReply{}, routerReplyError(payload, i)
 		} else if payload.IsWebServer {
-			return payload.Payload, nil
+			return payload, nil
 		} else {
 			onion = payload.Payload
 		}
 	}
-	return nil, errors.New("Something went horribly wrong.")
+	return storprotocol.STorRouterReply{}, errors.New("Something went horribly wrong.")
 }
 
 func deonionizeTeardownMessage(onion []byte, sharedkeys [][]byte) ([]byte, error) {
@@ -451,6 +914,7 @@ func deonionizeTeardownMessage(onion []byte, sharedkeys [][]byte) ([]byte, error
 
 func Init(clientNum string) {
 	client := NewClient(clientNum)
+	go client.listenDNS()
 	http.HandleFunc("/", client.handler)
 	log.Fatal(http.ListenAndServe(config.WebServerAddr, nil))
 }
@@ -0,0 +1,153 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"sync"
+	"time"
+
+	storprotocol "STor/interface"
+	util "STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+// Returned by askCoords when it could not reach any coord at all
+var errCoordsUnreachable = errors.New("no coord is reachable")
+
+// Recorded when a coord hands out routers that most coords do not list the same way
+type DirectoryDisagreement struct {
+	Coord     string
+	RouterIds []int
+}
+
+// Recorded when the client refuses a coord's directory
+type DirectoryRejected struct {
+	Coord  string
+	Reason string
+}
+
+// Publication time of the newest directory accepted from each coord, so a
+// replayed older directory is refused
+type directoryHistory struct {
+	mu     sync.Mutex
+	newest map[string]time.Time
+}
+
+func newDirectoryHistory() *directoryHistory {
+	return &directoryHistory{newest: map[string]time.Time{}}
+}
+
+// Records directory as coord's newest and returns true, or returns false if
+// coord has already given out a newer one
+func (h *directoryHistory) accept(coord string, directory storprotocol.STorDirectory) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if directory.PublishedAt.Before(h.newest[coord]) {
+		return false
+	}
+	h.newest[coord] = directory.PublishedAt
+	return true
+}
+
+// Asks one coord for routers, returning them and the trace its reply came
+// back on. agreed is the directory the routers will be checked against.
+type coordCall func(coordClient *rpc.Client, agreed map[int]storprotocol.Router, trace *tracing.Trace) ([]storprotocol.Router, *tracing.Trace, error)
+
+// Runs call against the coords in random order until one returns routers
+// that more than half of the coords list the same way in their signed
+// directories, and returns the directories' entries for them
+func (c Client) askCoords(trace *tracing.Trace, call coordCall) ([]storprotocol.Router, *tracing.Trace, error) {
+	agreed, trace := c.agreedDirectory(trace)
+	err := errCoordsUnreachable
+	reached := false
+	for _, coord := range c.coordsInRandomOrder() {
+		coordClient, dialErr := util.DialRPC(coord.Addr, c.TLSCert, coord.PublicKey)
+		if dialErr != nil {
+			fmt.Println("Coord", coord.Addr, "is unreachable:", dialErr)
+			continue
+		}
+		reached = true
+		var routers []storprotocol.Router
+		routers, trace, err = call(coordClient, agreed, trace)
+		coordClient.Close()
+		if err != nil {
+			continue
+		}
+		if listed, ok := util.ListedRouters(agreed, routers); ok {
+			return listed, trace, nil
+		}
+		trace.RecordAction(DirectoryDisagreement{Coord: coord.Addr, RouterIds: util.RouterIds(routers)})
+		err = fmt.Errorf("coord %s handed out routers the other coords do not list", coord.Addr)
+	}
+	if !reached {
+		return nil, trace, errCoordsUnreachable
+	}
+	return nil, trace, err
+}
+
+// Spreads clients' requests over the coords
+func (c Client) coordsInRandomOrder() []util.Authority {
+	coords := make([]util.Authority, 0, len(c.Coords))
+	for _, i := range rand.Perm(len(c.Coords)) {
+		coords = append(coords, c.Coords[i])
+	}
+	return coords
+}
+
+// Collects every coord's directory and returns the routers most of them
+// agree on. Directories that are not signed by the coord's pinned key, are
+// out of date or older than one the coord gave out before count as missing.
+func (c Client) agreedDirectory(trace *tracing.Trace) (map[int]storprotocol.Router, *tracing.Trace) {
+	var directories [][]storprotocol.Router
+	for _, coord := range c.Coords {
+		coordClient, err := util.DialRPC(coord.Addr, c.TLSCert, coord.PublicKey)
+		if err != nil {
+			continue
+		}
+		request := storprotocol.STorCoordDirectoryRequest{Token: trace.GenerateToken()}
+		var response storprotocol.STorCoordDirectoryResponse
+		err = coordClient.Call("CoordRPCListener.GetDirectory", request, &response)
+		coordClient.Close()
+		if err != nil {
+			continue
+		}
+		trace = c.Tracer.ReceiveToken(response.Token)
+		directory := response.Directory
+		if err = util.CheckDirectory(directory, coord.PublicKey, time.Now()); err == nil && !c.Directories.accept(coord.Addr, directory) {
+			err = errors.New("directory is older than one the coord gave out before")
+		}
+		if err != nil {
+			fmt.Println("Refusing directory from coord", coord.Addr, ":", err)
+			trace.RecordAction(DirectoryRejected{Coord: coord.Addr, Reason: err.Error()})
+			continue
+		}
+		directories = append(directories, directory.Routers)
+	}
+	return util.AgreedDirectory(directories, len(c.Coords)), trace
+}
+
+// Ids of the routers in agreed whose exit policy refuses webUrl, for the
+// coords to leave out as exits. Worked out here so the coords never see
+// where the client is going; empty webUrl accepts any exit.
+func refusingExits(agreed map[int]storprotocol.Router, webUrl string) ([]int, error) {
+	if webUrl == "" {
+		return nil, nil
+	}
+	routers := make([]storprotocol.Router, 0, len(agreed))
+	for _, router := range agreed {
+		routers = append(routers, router)
+	}
+	return util.RefusingExits(routers, webUrl)
+}
+
+func hasRouterId(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
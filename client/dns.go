@@ -0,0 +1,140 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	storprotocol "STor/interface"
+	util "STor/util"
+)
+
+const (
+	// Resolve requests share a circuit of their own, to whichever exit the coord picks
+	resolveDestination = ""
+	maxDNSMessageBytes = 512
+	maxResolveAttempts = 2
+)
+
+// Recorded when a local application's DNS query is sent to the exit
+type ResolveRequest struct {
+	ClientId  string
+	QueryType string
+	Name      string
+}
+
+// Serves DNS on DNSListenAddr, answering every query through a circuit so
+// applications pointed at it never leak lookups to the local resolver.
+// Nothing is served if it is not configured.
+func (c Client) listenDNS() {
+	if config.DNSListenAddr == "" {
+		return
+	}
+	conn, err := net.ListenPacket("udp", config.DNSListenAddr)
+	if err != nil {
+		fmt.Println("Error serving DNS:", err)
+		return
+	}
+	buf := make([]byte, maxDNSMessageBytes)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Println("Error serving DNS:", err)
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			if response := c.answerDNS(query); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// Builds the response to a DNS query, resolving it at the exit
+func (c Client) answerDNS(msg []byte) []byte {
+	q, err := util.ParseDNSQuery(msg)
+	if err != nil {
+		if len(msg) < 2 {
+			return nil
+		}
+		return util.BuildDNSResponse(q, util.DNSRcodeFormatError, nil, 0)
+	}
+
+	name := q.Name
+	var queryType string
+	switch q.Type {
+	case util.DNSTypeA:
+		queryType = storprotocol.ResolveA
+	case util.DNSTypeAAAA:
+		queryType = storprotocol.ResolveAAAA
+	case util.DNSTypePTR:
+		ip, err := util.ParseReverseDNSName(q.Name)
+		if err != nil {
+			return util.BuildDNSResponse(q, util.DNSRcodeNameError, nil, 0)
+		}
+		queryType, name = storprotocol.ResolvePTR, ip.String()
+	default:
+		return util.BuildDNSResponse(q, util.DNSRcodeNotImplemented, nil, 0)
+	}
+
+	resolved, err := c.resolve(name, queryType)
+	if err != nil {
+		fmt.Println(err)
+		return util.BuildDNSResponse(q, util.DNSRcodeServerFailure, nil, 0)
+	}
+	if resolved.NotFound {
+		return util.BuildDNSResponse(q, util.DNSRcodeNameError, nil, 0)
+	}
+	return util.BuildDNSResponse(q, util.DNSRcodeSuccess, resolved.Answers, resolved.TTL)
+}
+
+// Asks an exit to look up name, retrying once on a new circuit if the
+// circuit breaks
+func (c Client) resolve(name string, queryType string) (storprotocol.STorResolveResponse, error) {
+	trace := c.Trace
+	var err error
+	for attempt := 0; attempt < maxResolveAttempts; attempt++ {
+		var circuit *sharedCircuit
+		var streamId int
+		circuit, streamId, err = c.Circuits.openStream(resolveDestination, func() (circuit *sharedCircuit, err error) {
+			circuit, trace, err = c.buildCircuit(trace, "", 0)
+			return circuit, err
+		}, func(idle *sharedCircuit) {
+			c.releaseCircuit(trace, idle)
+		})
+		if errors.Is(err, errNoOnionRing) {
+			break
+		}
+		if err != nil {
+			continue
+		}
+
+		trace.RecordAction(ResolveRequest{ClientId: circuit.clientId, QueryType: queryType, Name: name})
+		routerArgs := storprotocol.STorRouterHTTPRequest{
+			Command:   storprotocol.ExitCommandResolve,
+			QueryType: queryType,
+			Url:       name,
+			StreamId:  streamId,
+		}
+		var payload []byte
+		payload, trace, err = c.sendRequest(context.Background(), trace, circuit, circuit.currentPath(), &routerArgs)
+
+		// An exit that could not resolve the name leaves the circuit working
+		var exitErr *ExitRequestError
+		failed := err != nil && !errors.As(err, &exitErr)
+		if c.Circuits.closeStream(circuit, failed) {
+			c.releaseCircuit(trace, circuit)
+		}
+		if err == nil {
+			var resolved storprotocol.STorResolveResponse
+			err = util.Decode(payload, &resolved)
+			return resolved, err
+		}
+		if !failed {
+			break
+		}
+	}
+	return storprotocol.STorResolveResponse{}, err
+}
@@ -0,0 +1,353 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	storprotocol "STor/interface"
+	util "STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+const (
+	defaultIntroPoints       = 3
+	descriptorRepublish      = 10 * time.Minute
+	introPointRetryDelay     = 5 * time.Second
+	serviceSessionIdle       = 10 * time.Minute
+	maxServiceResponseBytes  = 4 << 20
+	serviceTargetTimeout     = 30 * time.Second
+	serviceTargetHeaderLimit = 60 * time.Second
+)
+
+type OnionServiceConfig struct {
+	CoordAddr          string
+	TracingServerAddr  string
+	Secret             []byte
+	TracingIdentity    string
+	CoordPublicKeyFile string
+	Coords             []util.AuthorityConfig // every coord; CoordAddr and CoordPublicKeyFile if empty
+	UnreliableMinutes  int
+	KeyFile            string // service key, created if missing; its public half determines the address
+	TargetAddr         string // web server the service exposes, e.g. "localhost:8080"
+	IntroPoints        int    // how many introduction points to keep, default 3
+}
+
+// Recorded when the service publishes a new descriptor to the coord
+type ServiceDescriptorPublished struct {
+	Address     string
+	IntroPoints []int
+}
+
+// Recorded when the service joins a client at the rendezvous point it asked for
+type ServiceRendezvous struct {
+	ClientId        string
+	Address         string
+	RendezvousPoint int
+}
+
+// Exposes a local web server as an onion service. Clients reach it through
+// rendezvous points of their choosing, so neither side learns where the other is.
+type OnionService struct {
+	Client     *Client
+	PrivateKey *rsa.PrivateKey
+	PublicKey  []byte
+	Address    string
+	Target     string
+	HTTPClient *http.Client
+
+	mu          sync.Mutex
+	introPoints []*storprotocol.Router // current introduction point of each slot, nil while rebuilding
+	changed     chan struct{}
+}
+
+func NewOnionService(client *Client, privateKey *rsa.PrivateKey, target string, introPoints int) *OnionService {
+	if introPoints <= 0 {
+		introPoints = defaultIntroPoints
+	}
+	publicKey := util.ConvertPublicKeyToBytes(&privateKey.PublicKey)
+	return &OnionService{
+		Client:     client,
+		PrivateKey: privateKey,
+		PublicKey:  publicKey,
+		Address:    util.ServiceAddress(publicKey),
+		Target:     target,
+		HTTPClient: &http.Client{
+			Timeout: serviceTargetTimeout,
+			Transport: &http.Transport{
+				ResponseHeaderTimeout: serviceTargetHeaderLimit,
+			},
+		},
+		introPoints: make([]*storprotocol.Router, introPoints),
+		changed:     make(chan struct{}, 1),
+	}
+}
+
+// Keeps the introduction points up and the descriptor naming them published
+func (s *OnionService) Run() {
+	for slot := range s.introPoints {
+		go s.keepIntroPoint(slot)
+	}
+	republish := time.NewTicker(descriptorRepublish)
+	defer republish.Stop()
+	for {
+		select {
+		case <-s.changed:
+		case <-republish.C:
+		}
+		if err := s.publish(); err != nil {
+			fmt.Println("Error publishing descriptor:", err)
+		}
+	}
+}
+
+func (s *OnionService) setIntroPoint(slot int, router *storprotocol.Router) {
+	s.mu.Lock()
+	s.introPoints[slot] = router
+	s.mu.Unlock()
+	select {
+	case s.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Returns true if another slot already uses router as its introduction point
+func (s *OnionService) usesIntroPoint(slot int, routerId int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, router := range s.introPoints {
+		if i != slot && router != nil && router.RouterId == routerId {
+			return true
+		}
+	}
+	return false
+}
+
+// Signs and publishes a descriptor listing the current introduction points
+func (s *OnionService) publish() error {
+	s.mu.Lock()
+	var introPoints []storprotocol.Router
+	for _, router := range s.introPoints {
+		if router != nil {
+			introPoints = append(introPoints, *router)
+		}
+	}
+	s.mu.Unlock()
+	if len(introPoints) == 0 {
+		return nil
+	}
+
+	descriptor := storprotocol.STorServiceDescriptor{
+		Address:     s.Address,
+		PublicKey:   s.PublicKey,
+		IntroPoints: introPoints,
+		PublishedAt: time.Now(),
+	}
+	signature, err := util.SignRSA(s.PrivateKey, util.DescriptorDigest(descriptor))
+	if err != nil {
+		return err
+	}
+	descriptor.Signature = signature
+
+	// Every coord gets it, clients may ask any of them
+	c := s.Client
+	trace := c.Trace
+	published := false
+	for _, coord := range c.Coords {
+		coordClient, err := util.DialRPC(coord.Addr, c.TLSCert, coord.PublicKey)
+		if err != nil {
+			fmt.Println("Error publishing descriptor to coord", coord.Addr, ":", err)
+			continue
+		}
+		request := storprotocol.STorCoordPublishDescriptorRequest{Descriptor: descriptor, Token: trace.GenerateToken()}
+		var response storprotocol.STorCoordPublishDescriptorResponse
+		err = coordClient.Call("CoordRPCListener.PublishServiceDescriptor", request, &response)
+		coordClient.Close()
+		if err != nil {
+			fmt.Println("Error publishing descriptor to coord", coord.Addr, ":", err)
+			continue
+		}
+		trace = c.Tracer.ReceiveToken(response.Token)
+		published = true
+	}
+	if !published {
+		return errors.New("no coord took the descriptor")
+	}
+	trace.RecordAction(ServiceDescriptorPublished{Address: s.Address, IntroPoints: util.RouterIds(introPoints)})
+	return nil
+}
+
+// Keeps a circuit to an introduction point for slot, taking the
+// introductions that arrive on it, and replaces it whenever it breaks
+func (s *OnionService) keepIntroPoint(slot int) {
+	c := s.Client
+	trace := c.Trace
+	for {
+		var circuit *sharedCircuit
+		var err error
+		circuit, trace, err = c.buildCircuit(trace, "", 0)
+		if err != nil {
+			fmt.Println(err)
+			time.Sleep(introPointRetryDelay)
+			continue
+		}
+		introPoint := circuit.currentPath().routers[2]
+		if s.usesIntroPoint(slot, introPoint.RouterId) {
+			c.releaseCircuit(trace, circuit)
+			continue
+		}
+
+		// The signature covers the circuit id, so the router cannot reuse it elsewhere
+		cell := storprotocol.STorServiceCell{PublicKey: s.PublicKey}
+		if cell.Signature, err = util.SignRSA(s.PrivateKey, util.EstablishIntroDigest(circuit.clientId)); err == nil {
+			_, trace, err = c.serviceCommand(trace, circuit, storprotocol.ServiceCommandEstablishIntro, cell)
+		}
+		if err == nil {
+			s.setIntroPoint(slot, &introPoint)
+			trace, err = s.takeIntroductions(trace, circuit)
+			s.setIntroPoint(slot, nil)
+		}
+		fmt.Println(err)
+		circuit.fail()
+		c.releaseCircuit(trace, circuit)
+		time.Sleep(introPointRetryDelay)
+	}
+}
+
+// Waits for introductions on an introduction point circuit until it fails
+func (s *OnionService) takeIntroductions(trace *tracing.Trace, circuit *sharedCircuit) (*tracing.Trace, error) {
+	for {
+		reply, nextTrace, err := s.Client.serviceCommand(trace, circuit, storprotocol.ServiceCommandNextIntroduction, storprotocol.STorServiceCell{})
+		trace = nextTrace
+		if err != nil {
+			return trace, err
+		}
+		if len(reply.Payload) > 0 {
+			go s.rendezvous(trace, reply.Payload)
+		}
+	}
+}
+
+// Joins the client at the rendezvous point named in its introduction and
+// serves its requests until the client goes quiet
+func (s *OnionService) rendezvous(trace *tracing.Trace, payload []byte) {
+	var cell storprotocol.STorIntroduceCell
+	if err := util.Decode(payload, &cell); err != nil {
+		fmt.Println(err)
+		return
+	}
+	sessionKey := util.DecryptRSAPrivate(s.PrivateKey, cell.EncryptedKey)
+	if sessionKey == nil {
+		return
+	}
+	var introduction storprotocol.STorIntroduction
+	if err := decryptServicePayload(sessionKey, cell.Payload, &introduction); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	c := s.Client
+	circuit, trace, err := c.buildCircuit(trace, "", introduction.RendezvousPoint.RouterId)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	var serving sync.WaitGroup
+	defer func() {
+		serving.Wait()
+		c.releaseCircuit(trace, circuit)
+	}()
+	if _, trace, err = c.serviceCommand(trace, circuit, storprotocol.ServiceCommandRendezvous, storprotocol.STorServiceCell{Cookie: introduction.Cookie}); err != nil {
+		fmt.Println(err)
+		circuit.fail()
+		return
+	}
+	trace.RecordAction(ServiceRendezvous{ClientId: circuit.clientId, Address: s.Address, RendezvousPoint: introduction.RendezvousPoint.RouterId})
+
+	for lastRequest := time.Now(); time.Since(lastRequest) < serviceSessionIdle; {
+		var request storprotocol.STorServiceCell
+		request, trace, err = c.serviceCommand(trace, circuit, storprotocol.ServiceCommandNextRequest, storprotocol.STorServiceCell{})
+		if err != nil {
+			fmt.Println(err)
+			circuit.fail()
+			return
+		}
+		if len(request.Payload) == 0 {
+			continue
+		}
+		lastRequest = time.Now()
+		serving.Add(1)
+		go func(trace *tracing.Trace) {
+			defer serving.Done()
+			s.serve(trace, circuit, sessionKey, request)
+		}(trace)
+	}
+}
+
+// Answers one client request from the target web server
+func (s *OnionService) serve(trace *tracing.Trace, circuit *sharedCircuit, sessionKey []byte, cell storprotocol.STorServiceCell) {
+	var request storprotocol.STorServiceRequest
+	if err := decryptServicePayload(sessionKey, cell.Payload, &request); err != nil {
+		fmt.Println(err)
+		return
+	}
+	response := s.forward(request)
+	reply := storprotocol.STorServiceCell{RequestId: cell.RequestId, Payload: util.EncodeAndEncryptAES(sessionKey, response)}
+	if _, _, err := s.Client.serviceCommand(trace, circuit, storprotocol.ServiceCommandResponse, reply); err != nil {
+		fmt.Println(err)
+	}
+}
+
+func (s *OnionService) forward(request storprotocol.STorServiceRequest) storprotocol.STorServiceResponse {
+	// Only ever a path on the target, never another host
+	if !strings.HasPrefix(request.Path, "/") {
+		return storprotocol.STorServiceResponse{StatusCode: http.StatusBadRequest}
+	}
+	req, err := http.NewRequest(request.Method, "http://"+s.Target+request.Path, bytes.NewReader(request.Body))
+	if err != nil {
+		return storprotocol.STorServiceResponse{StatusCode: http.StatusBadRequest}
+	}
+	for key, values := range request.Header {
+		req.Header[key] = values
+	}
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return storprotocol.STorServiceResponse{StatusCode: http.StatusBadGateway}
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxServiceResponseBytes))
+	if err != nil {
+		return storprotocol.STorServiceResponse{StatusCode: http.StatusBadGateway}
+	}
+	return storprotocol.STorServiceResponse{StatusCode: resp.StatusCode, Header: resp.Header, Body: body}
+}
+
+func InitOnionService(serviceNum string) {
+	var serviceConfig OnionServiceConfig
+	err := util.ReadJSONConfig(fmt.Sprintf("./config/onionservice_config%s.json", serviceNum), &serviceConfig)
+	util.CheckErr(err, "Error reading onion service config: %v\n", err)
+	config = ClientConfig{
+		CoordAddr:          serviceConfig.CoordAddr,
+		TracingServerAddr:  serviceConfig.TracingServerAddr,
+		Secret:             serviceConfig.Secret,
+		TracingIdentity:    serviceConfig.TracingIdentity,
+		CoordPublicKeyFile: serviceConfig.CoordPublicKeyFile,
+		Coords:             serviceConfig.Coords,
+		UnreliableMinutes:  serviceConfig.UnreliableMinutes,
+	}
+	privateKey, err := util.LoadOrCreateRSAKey(serviceConfig.KeyFile)
+	util.CheckErr(err, "Error loading onion service key: %v\n", err)
+
+	service := NewOnionService(newClient(), privateKey, serviceConfig.TargetAddr, serviceConfig.IntroPoints)
+	fmt.Printf("Serving %s at %s\n", serviceConfig.TargetAddr, service.Address)
+	service.Run()
+}
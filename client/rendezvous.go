@@ -0,0 +1,306 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	storprotocol "STor/interface"
+	util "STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+const (
+	// Matches the coord's descriptor lifetime; anything older is a service that went away
+	serviceDescriptorLifetime = time.Hour
+	rendezvousCookieBytes     = 20
+	maxServiceAttempts        = 2
+	maxServiceRequestBytes    = 1 << 20
+)
+
+// Recorded when the client gets an onion service's descriptor from the coord
+type ServiceDescriptorFetched struct {
+	Address     string
+	IntroPoints []int
+}
+
+// Recorded when an introduction point accepts the client's introduction.
+// ClientId is the circuit waiting at the rendezvous point.
+type ServiceIntroduced struct {
+	ClientId   string
+	Address    string
+	IntroPoint int
+}
+
+// Recorded when the client sends a request to an onion service over its rendezvous circuit
+type ServiceRequest struct {
+	ClientId string
+	Address  string
+	Path     string
+}
+
+// A circuit to a rendezvous point the service has joined, and the key the
+// client and service encrypt their requests and replies with
+type serviceSession struct {
+	circuit    *sharedCircuit
+	sessionKey []byte
+}
+
+// The session each onion service's requests currently share
+type serviceSessions struct {
+	mu      sync.Mutex
+	entries map[string]*serviceEntry
+}
+
+type serviceEntry struct {
+	mu      sync.Mutex // held while connecting to the service
+	session *serviceSession
+}
+
+func newServiceSessions() *serviceSessions {
+	return &serviceSessions{entries: map[string]*serviceEntry{}}
+}
+
+// Returns the session with address, connecting with connect if there is none
+func (s *serviceSessions) get(address string, connect func() (*serviceSession, error)) (*serviceSession, error) {
+	s.mu.Lock()
+	entry, ok := s.entries[address]
+	if !ok {
+		entry = &serviceEntry{}
+		s.entries[address] = entry
+	}
+	s.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.session == nil {
+		session, err := connect()
+		if err != nil {
+			return nil, err
+		}
+		entry.session = session
+	}
+	return entry.session, nil
+}
+
+// Forgets a broken session. Returns true if it was still current, in which
+// case the caller must free its circuit.
+func (s *serviceSessions) drop(address string, session *serviceSession) bool {
+	s.mu.Lock()
+	entry, ok := s.entries[address]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+	if entry.session != session {
+		return false
+	}
+	entry.session = nil
+	return true
+}
+
+// Passes the browser's request to the onion service at address and writes back its reply
+func (c Client) handleOnionService(w http.ResponseWriter, r *http.Request, address string, webUrl string, oldUrl string) {
+	u, err := url.Parse(webUrl)
+	if err != nil {
+		fmt.Fprintf(w, "<p>Invalid onion service URL: %s</p>", err)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxServiceRequestBytes))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	request := storprotocol.STorServiceRequest{
+		Method: r.Method,
+		Path:   u.RequestURI(),
+		Header: r.Header,
+		Body:   body,
+	}
+
+	response, err := c.fetchFromService(address, request)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Fprintf(w, "<p>Unable to reach the onion service: %s</p>", err)
+		return
+	}
+	if contentType := response.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(response.StatusCode)
+	fmt.Fprint(w, hardCodedContentProcessing(oldUrl, config.WebServerAddr, string(response.Body)))
+}
+
+// Sends request to the onion service at address over the session with it,
+// starting a new session and retrying once if that fails
+func (c Client) fetchFromService(address string, request storprotocol.STorServiceRequest) (storprotocol.STorServiceResponse, error) {
+	trace := c.Trace
+	var err error
+	for attempt := 0; attempt < maxServiceAttempts; attempt++ {
+		var session *serviceSession
+		session, err = c.Services.get(address, func() (session *serviceSession, err error) {
+			session, trace, err = c.connectService(trace, address)
+			return session, err
+		})
+		if err != nil {
+			return storprotocol.STorServiceResponse{}, err
+		}
+
+		trace.RecordAction(ServiceRequest{ClientId: session.circuit.clientId, Address: address, Path: request.Path})
+		serviceUrl := "http://" + address + request.Path
+		sent := request
+		sent.Header = config.HeaderPolicy.Apply(request.Header, session.circuit.cookies(serviceUrl))
+		cell := storprotocol.STorServiceCell{Payload: util.EncodeAndEncryptAES(session.sessionKey, sent)}
+		var reply storprotocol.STorServiceCell
+		reply, trace, err = c.serviceCommand(trace, session.circuit, storprotocol.ServiceCommandRequest, cell)
+		if err == nil {
+			var response storprotocol.STorServiceResponse
+			if err = decryptServicePayload(session.sessionKey, reply.Payload, &response); err == nil {
+				session.circuit.setCookies(serviceUrl, response.Header)
+				return response, nil
+			}
+		}
+		if c.Services.drop(address, session) {
+			session.circuit.fail()
+			c.releaseCircuit(trace, session.circuit)
+		}
+	}
+	return storprotocol.STorServiceResponse{}, err
+}
+
+// Waits for the service at a rendezvous point of the client's choosing and
+// asks one of the service's introduction points to send it there
+func (c Client) connectService(trace *tracing.Trace, address string) (*serviceSession, *tracing.Trace, error) {
+	descriptor, trace, err := c.fetchDescriptor(trace, address)
+	if err != nil {
+		return nil, trace, err
+	}
+
+	rendezvous, trace, err := c.buildCircuit(trace, "", 0)
+	if err != nil {
+		return nil, trace, err
+	}
+	cookie := make([]byte, rendezvousCookieBytes)
+	if _, err = rand.Read(cookie); err == nil {
+		_, trace, err = c.serviceCommand(trace, rendezvous, storprotocol.ServiceCommandEstablishRendezvous, storprotocol.STorServiceCell{Cookie: cookie})
+	}
+	if err != nil {
+		rendezvous.fail()
+		c.releaseCircuit(trace, rendezvous)
+		return nil, trace, err
+	}
+
+	// Only the service can read the session key, and with it where to meet
+	sessionKey := util.GenerateAESKey()
+	introduction := storprotocol.STorIntroduction{
+		RendezvousPoint: rendezvous.currentPath().routers[2],
+		Cookie:          cookie,
+	}
+	introduce := storprotocol.STorIntroduceCell{
+		EncryptedKey: util.EncryptRSAPublic(util.ConvertBytesToPublicKey(descriptor.PublicKey), sessionKey),
+		Payload:      util.EncodeAndEncryptAES(sessionKey, introduction),
+	}
+	for _, intro := range descriptor.IntroPoints {
+		trace, err = c.introduce(trace, intro.RouterId, address, util.Encode(introduce))
+		if err == nil {
+			trace.RecordAction(ServiceIntroduced{ClientId: rendezvous.clientId, Address: address, IntroPoint: intro.RouterId})
+			return &serviceSession{circuit: rendezvous, sessionKey: sessionKey}, trace, nil
+		}
+		fmt.Println(err)
+	}
+	rendezvous.fail()
+	c.releaseCircuit(trace, rendezvous)
+	return nil, trace, fmt.Errorf("no introduction point of %s accepted the introduction: %w", address, err)
+}
+
+// Gets the descriptor for address from the first coord that has a valid one
+func (c Client) fetchDescriptor(trace *tracing.Trace, address string) (storprotocol.STorServiceDescriptor, *tracing.Trace, error) {
+	var descriptor storprotocol.STorServiceDescriptor
+	err := errCoordsUnreachable
+	for _, coord := range c.coordsInRandomOrder() {
+		descriptor, trace, err = c.fetchDescriptorFrom(trace, coord, address)
+		if err == nil {
+			return descriptor, trace, nil
+		}
+	}
+	return descriptor, trace, err
+}
+
+// The coord is not trusted with the descriptor: the address is derived from
+// the key the descriptor must be signed by.
+func (c Client) fetchDescriptorFrom(trace *tracing.Trace, coord util.Authority, address string) (storprotocol.STorServiceDescriptor, *tracing.Trace, error) {
+	coordClient, err := util.DialRPC(coord.Addr, c.TLSCert, coord.PublicKey)
+	if err != nil {
+		return storprotocol.STorServiceDescriptor{}, trace, err
+	}
+	defer coordClient.Close()
+	request := storprotocol.STorCoordDescriptorRequest{Address: address, Token: trace.GenerateToken()}
+	var response storprotocol.STorCoordDescriptorResponse
+	if err = coordClient.Call("CoordRPCListener.GetServiceDescriptor", request, &response); err != nil {
+		return storprotocol.STorServiceDescriptor{}, trace, err
+	}
+	trace = c.Tracer.ReceiveToken(response.Token)
+
+	descriptor := response.Descriptor
+	switch {
+	case !response.Found:
+		return descriptor, trace, fmt.Errorf("onion service %s is not published", address)
+	case descriptor.Address != address || !util.VerifyDescriptor(descriptor):
+		return descriptor, trace, fmt.Errorf("descriptor for %s is not signed by its key", address)
+	case time.Since(descriptor.PublishedAt) > serviceDescriptorLifetime:
+		return descriptor, trace, fmt.Errorf("descriptor for %s is out of date", address)
+	case len(descriptor.IntroPoints) == 0:
+		return descriptor, trace, fmt.Errorf("descriptor for %s lists no introduction points", address)
+	}
+	trace.RecordAction(ServiceDescriptorFetched{Address: address, IntroPoints: util.RouterIds(descriptor.IntroPoints)})
+	return descriptor, trace, nil
+}
+
+// Hands an introduction to the service over a short-lived circuit ending at
+// its introduction point
+func (c Client) introduce(trace *tracing.Trace, introPoint int, address string, payload []byte) (*tracing.Trace, error) {
+	circuit, trace, err := c.buildCircuit(trace, "", introPoint)
+	if err != nil {
+		return trace, err
+	}
+	_, trace, err = c.serviceCommand(trace, circuit, storprotocol.ServiceCommandIntroduce, storprotocol.STorServiceCell{Address: address, Payload: payload})
+	if err != nil {
+		circuit.fail()
+	}
+	c.releaseCircuit(trace, circuit)
+	return trace, err
+}
+
+// Sends an onion service command to the last hop of circuit and returns its reply
+func (c Client) serviceCommand(trace *tracing.Trace,
+	circuit *sharedCircuit,
+	command string,
+	cell storprotocol.STorServiceCell) (storprotocol.STorServiceCell, *tracing.Trace, error) {
+	routerArgs := storprotocol.STorRouterHTTPRequest{Command: command, Service: cell}
+	payload, trace, err := c.sendRequest(context.Background(), trace, circuit, circuit.currentPath(), &routerArgs)
+	if err != nil {
+		return storprotocol.STorServiceCell{}, trace, err
+	}
+	var reply storprotocol.STorServiceCell
+	err = util.Decode(payload, &reply)
+	return reply, trace, err
+}
+
+// Decrypts and decodes a payload sent end to end between client and service
+func decryptServicePayload(sessionKey []byte, payload []byte, res interface{}) error {
+	if len(payload) < aes.BlockSize {
+		return errors.New("onion service payload is truncated")
+	}
+	return util.Decode(util.DecryptAES(sessionKey, payload), res)
+}
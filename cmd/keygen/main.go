@@ -0,0 +1,26 @@
+package main
+
+import (
+	"STor/util"
+	"fmt"
+	"os"
+)
+
+// Creates a router or coord identity key ahead of time so its public half
+// can be distributed before the node first starts
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Println("Usage: keygen <key file>")
+		os.Exit(1)
+	}
+	path := os.Args[1]
+	if _, err := os.Stat(path); err == nil {
+		fmt.Println(path, "already exists, refusing to overwrite it")
+		os.Exit(1)
+	}
+	if _, err := util.LoadOrCreateRSAKey(path); err != nil {
+		fmt.Println("Error creating key:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Wrote", path, "and", path+".pub")
+}
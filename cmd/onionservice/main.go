@@ -0,0 +1,17 @@
+package main
+
+import (
+	"STor/client"
+	"fmt"
+	"os"
+)
+
+func main() {
+
+	if len(os.Args) < 2 {
+		fmt.Println("Please include onion service number")
+		os.Exit(1)
+	}
+	serviceNum := os.Args[1]
+	client.InitOnionService(serviceNum)
+}
@@ -4,6 +4,8 @@ import (
 	"STor/router"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -13,5 +15,17 @@ func main() {
 	}
 	routerId := os.Args[1]
 	r := router.NewRouter(fmt.Sprintf("config/router_config%s.json", routerId))
-	r.StartRouter()
+
+	// Drain circuits and leave the directory instead of dying mid-circuit
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sigCh
+		r.Shutdown()
+	}()
+
+	if err := r.StartRouter(); err != nil {
+		fmt.Println("Encountered an error:", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,71 @@
+package coord
+
+import (
+	"bytes"
+	"errors"
+
+	storprotocol "STor/interface"
+)
+
+// Recorded when Coord's bridge registry changes
+type BridgeRegistryUpdated struct {
+	Bridges []int
+}
+
+// Registers a bridge with the bridge authority. Bridges are kept apart from
+// the public directory and never handed out in onion rings, so their
+// addresses only reach the clients given their bridge lines.
+func (crl *CoordRPCListener) RegisterBridge(request storprotocol.STorRouterJoinRequest, response *storprotocol.STorRouterJoinResponse) error {
+	return crl.register(request, response, true)
+}
+
+// Adds a router to the directory, or to the bridges if bridge is set, and
+// returns the ids in that registry and how many routers the directory holds.
+// A router that rejoins with the same id and identity replaces its old entry,
+// whichever registry that was in.
+func (c *Coord) addRouter(newRouter RouterInfo, bridge bool) ([]int, int, error) {
+	c.RoutersMutex.Lock()
+	defer c.RoutersMutex.Unlock()
+	if existing, ok := c.findRegistered(newRouter.routerId); ok {
+		if !bytes.Equal(existing.publicKey, newRouter.publicKey) {
+			return nil, 0, errors.New("router id is taken by another identity")
+		}
+		// Same identity and id: the router restarted before its old entry failed
+		c.removeRegistered(newRouter.routerId)
+	} else if RouterAlreadyExists(c.Routers, newRouter) || RouterAlreadyExists(c.Bridges, newRouter) {
+		return nil, 0, errors.New("router already exists in directory")
+	}
+
+	if bridge {
+		c.Bridges = append(c.Bridges, newRouter)
+		return routerIds(c.Bridges), len(c.Routers), nil
+	}
+	c.Routers = append(c.Routers, newRouter)
+	return routerIds(c.Routers), len(c.Routers), nil
+}
+
+// Returns the registry listing router id, or nil. RoutersMutex must be held.
+func (c *Coord) registryOf(id int) *[]RouterInfo {
+	if _, ok := findRouterInfo(c.Routers, id); ok {
+		return &c.Routers
+	}
+	if _, ok := findRouterInfo(c.Bridges, id); ok {
+		return &c.Bridges
+	}
+	return nil
+}
+
+// Looks a router up in the directory and the bridges. RoutersMutex must be held.
+func (c *Coord) findRegistered(id int) (RouterInfo, bool) {
+	if registry := c.registryOf(id); registry != nil {
+		return findRouterInfo(*registry, id)
+	}
+	return RouterInfo{}, false
+}
+
+// RoutersMutex must be held
+func (c *Coord) removeRegistered(id int) {
+	if registry := c.registryOf(id); registry != nil {
+		*registry = removeRouterInfo(*registry, id)
+	}
+}
@@ -0,0 +1,45 @@
+package coord
+
+import (
+	"testing"
+)
+
+func TestCoord_BridgesAreKeptOutOfRings(t *testing.T) {
+	c := &Coord{}
+	for id := 1; id <= 3; id++ {
+		if _, _, err := c.addRouter(RouterInfo{routerId: id, publicKey: []byte{byte(id)}}, false); err != nil {
+			t.Fatalf("addRouter returned an error %s", err)
+		}
+	}
+	bridges, numRouters, err := c.addRouter(RouterInfo{routerId: 4, publicKey: []byte{4}}, true)
+	if err != nil || len(bridges) != 1 || bridges[0] != 4 || numRouters != 3 {
+		t.Fatalf("addRouter returned %v, %d, %v", bridges, numRouters, err)
+	}
+
+	for i := 0; i < 10; i++ {
+		c.sortRoutersByLoad()
+		for _, router := range pickOnionRing(c.Routers, nil) {
+			if router.routerId == 4 {
+				t.Fatalf("bridge was handed out in an onion ring")
+			}
+		}
+	}
+	if _, ok := pickReplacement(c.Routers, "guard", nil, []int{1, 2, 3}); ok {
+		t.Fatalf("bridge was handed out as a replacement")
+	}
+
+	// The bridge is still known for status checks, key updates and leaving
+	if _, ok := c.findRegistered(4); !ok {
+		t.Fatalf("bridge is not registered")
+	}
+	if _, _, err := c.addRouter(RouterInfo{routerId: 4, publicKey: []byte{9}}, true); err == nil {
+		t.Fatalf("another identity took the bridge's id")
+	}
+	if _, _, err := c.addRouter(RouterInfo{routerId: 5, publicKey: []byte{4}}, false); err == nil {
+		t.Fatalf("the bridge's identity joined the directory under another id")
+	}
+	c.removeRegistered(4)
+	if _, ok := c.findRegistered(4); ok || len(c.Bridges) != 0 || len(c.Routers) != 3 {
+		t.Fatalf("bridge was not removed cleanly: routers %v, bridges %v", routerIds(c.Routers), routerIds(c.Bridges))
+	}
+}
@@ -5,6 +5,8 @@ import (
 	ochecker "STor/oCheck"
 	"STor/util"
 	"bytes"
+	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"math/rand"
@@ -20,7 +22,14 @@ import (
 // ======================== PUBLIC TYPES ========================
 type Coord struct {
 	Routers      []RouterInfo // Coord's internal registry of Routers
-	RoutersMutex sync.Mutex   // mutex to update Routers registry
+	Bridges      []RouterInfo // bridges, never handed out in onion rings
+	RoutersMutex sync.Mutex   // mutex to update Routers and Bridges registries
+
+	Descriptors      map[string]storprotocol.STorServiceDescriptor // onion service descriptors, by address
+	DescriptorsMutex sync.Mutex
+
+	directory      storprotocol.STorDirectory // last directory signed, see signedDirectory
+	directoryMutex sync.Mutex
 
 	RoutersReady      bool       // flag to indicate whether 3 Routers have joined
 	RoutersReadyMutex sync.Mutex // sync variables to block client requests until all clients are ready
@@ -28,6 +37,10 @@ type Coord struct {
 
 	Config *CoordConfig // fields from config file
 
+	PrivateKey *rsa.PrivateKey  // long-term identity key of the coord
+	TLSCert    tls.Certificate  // certificate bound to PrivateKey
+	Peers      []util.Authority // other coords keeping the same directory
+
 	OCheck          *ochecker.OCheck                   // OCheck instance
 	OCheckNotifyCh  <-chan ochecker.FailureDetected    // OCheck Router failure notification channel
 	OCheckCircuitCh <-chan ochecker.RouterCircuitCount // OCheck Router ACC update channel
@@ -39,18 +52,21 @@ type Coord struct {
 }
 
 type CoordConfig struct {
-	ClientListenAddr           string // RPC (TCP) address to listen for Clients
-	RouterListenAddr           string // RPC (TCP) address to listen for Routers
-	OCheckListenAddr           string // UDP addresses for OCheck
-	AckLocalIPAckLocalPort     string //
-	HBeatLocalIPHBeatLocalPort string //
-	TracingServerAddr          string // IP:port of tracing server
-	Secret                     []byte // secret for tracing
-	TracingIdentity            string // Coord's tracing identity
+	ClientListenAddr           string                 // RPC (TCP) address to listen for Clients
+	RouterListenAddr           string                 // RPC (TCP) address to listen for Routers
+	OCheckListenAddr           string                 // UDP addresses for OCheck
+	AckLocalIPAckLocalPort     string                 //
+	HBeatLocalIPHBeatLocalPort string                 //
+	TracingServerAddr          string                 // IP:port of tracing server
+	Secret                     []byte                 // secret for tracing
+	TracingIdentity            string                 // Coord's tracing identity
+	IdentityKeyFile            string                 // PEM file holding the coord's identity key (created if missing)
+	Peers                      []util.AuthorityConfig // other coords keeping the same directory
 }
 
 type CoordRPCListener struct {
-	C *Coord
+	C             *Coord
+	PeerPublicKey []byte // public key of the TLS certificate the caller presented
 }
 
 type RouterJoinRequest struct {
@@ -68,12 +84,66 @@ type RouterJoinResponse struct {
 
 // ======================== PRIVATE TYPES ========================
 type RouterInfo struct {
-	routerId         int    // Router's ID
-	publicKey        []byte // Router's RSA public key
-	clientListenAddr string // RPC (TCP) address that router will use to listen for client
-	coordListenAddr  string // RPC (TCP) address that router will use to listen for coord
-	oCheckAddr       string // UDP address to listen for heartbeats
-	activeChainCount int    // number of chains that Router is currently part of
+	routerId         int                     // Router's ID
+	publicKey        []byte                  // Router's RSA identity key
+	onionKey         []byte                  // Router's current RSA onion key
+	clientListenAddr string                  // RPC (TCP) address that router will use to listen for client
+	coordListenAddr  string                  // RPC (TCP) address that router will use to listen for coord
+	oCheckAddr       string                  // UDP address to listen for heartbeats
+	activeChainCount int                     // number of chains that Router is currently part of
+	cryptoQueueDepth int                     // handshake and onion-layer jobs waiting at the Router, from its last heartbeat
+	exitPolicy       storprotocol.ExitPolicy // destinations the Router accepts as an exit
+	roles            []string                // circuit positions the Router accepts, empty means all
+	bandwidth        int64                   // bytes per second the Router advertised, 0 if unlimited
+	powSeed          []byte                  // seed of the puzzle the Router demands with handshakes
+	powDifficulty    int                     // leading zero bits the puzzle needs, 0 if none
+}
+
+// What clients are told about the router
+func (ri RouterInfo) descriptor() storprotocol.Router {
+	return storprotocol.Router{
+		RouterId:      ri.routerId,
+		PublicKey:     ri.publicKey,
+		OnionKey:      ri.onionKey,
+		Addr:          ri.clientListenAddr,
+		PowSeed:       ri.powSeed,
+		PowDifficulty: ri.powDifficulty,
+		ExitPolicy:    ri.exitPolicy,
+	}
+}
+
+func routerInfoFromJoin(request storprotocol.STorRouterJoinRequest) RouterInfo {
+	return RouterInfo{
+		routerId:         request.Id,
+		publicKey:        request.PublicKey,
+		onionKey:         request.OnionKey,
+		clientListenAddr: request.ClientListenAddr,
+		coordListenAddr:  request.CoordListenAddr,
+		oCheckAddr:       request.OCheckAddr,
+		activeChainCount: 0,
+		exitPolicy:       request.ExitPolicy,
+		roles:            request.Roles,
+		bandwidth:        request.Bandwidth,
+		powSeed:          request.PowSeed,
+		powDifficulty:    request.PowDifficulty,
+	}
+}
+
+// The router's entry as it would join, for handing to other coords
+func (ri RouterInfo) joinRequest() storprotocol.STorRouterJoinRequest {
+	return storprotocol.STorRouterJoinRequest{
+		Id:               ri.routerId,
+		PublicKey:        ri.publicKey,
+		OnionKey:         ri.onionKey,
+		ClientListenAddr: ri.clientListenAddr,
+		CoordListenAddr:  ri.coordListenAddr,
+		OCheckAddr:       ri.oCheckAddr,
+		ExitPolicy:       ri.exitPolicy,
+		Roles:            ri.roles,
+		Bandwidth:        ri.bandwidth,
+		PowSeed:          ri.powSeed,
+		PowDifficulty:    ri.powDifficulty,
+	}
 }
 
 // ======================== TRACING STRUCTS ========================
@@ -96,6 +166,27 @@ type RouterRegistryUpdated struct {
 	Routers []int
 }
 
+// Recorded when a Router publishes a new onion key
+type RouterOnionKeyUpdated struct {
+	RouterId int
+}
+
+// Recorded when a Router changes the puzzle it demands with handshakes
+type RouterAdmissionUpdated struct {
+	RouterId      int
+	PowDifficulty int
+}
+
+// Recorded when Coord receives a deregistration request from a Router shutting down
+type RouterLeaveRequestRecvd struct {
+	RouterId int
+}
+
+// Recorded when Coord removes a Router that left
+type RouterLeaveRequestHandled struct {
+	RouterId int
+}
+
 // Recorded when Coord receives a Router failure from OCheck
 type RouterFail struct {
 	RouterId int
@@ -111,6 +202,18 @@ type OnionRingRequestRcvd struct {
 	ClientId string
 }
 
+// Recorded when Coord receives a request to replace one hop of a circuit
+type ReplacementRequestRcvd struct {
+	ClientId string
+	Position string
+}
+
+// Recorded when Coord has picked a router to replace a failed hop
+type ReplacementRouterPicked struct {
+	ClientId string
+	RouterId int
+}
+
 // Recorded when Coord creates a new onion ring
 type OnionRingCreated struct {
 	Routers []int
@@ -134,12 +237,41 @@ type RouterActiveChainCountUpdate struct {
 	New      int
 }
 
+// Recorded when a Router's heartbeat reports a change in its crypto queue
+type RouterCryptoQueueUpdate struct {
+	RouterId int
+	Old      int
+	New      int
+}
+
 // ======================== PUBLIC METHODS ========================
 
 func NewCoord(configPath string) (*Coord, error) {
 	var config = &CoordConfig{}
 	util.ReadJSONConfig(configPath, config)
 
+	// Load identity key for TLS, a fresh one is used if no key file is configured
+	var privateKey *rsa.PrivateKey
+	var err error
+	if config.IdentityKeyFile != "" {
+		privateKey, err = util.LoadOrCreateRSAKey(config.IdentityKeyFile)
+	} else {
+		privateKey, _, err = util.GenerateRSAKeyPair()
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := util.NewTLSCertificate(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	var peers []util.Authority
+	if len(config.Peers) > 0 {
+		if peers, err = util.LoadAuthorities("", "", config.Peers); err != nil {
+			return nil, err
+		}
+	}
+
 	// Initialize OCheck
 	ocheck := ochecker.NewOCheck()
 	ocheckStartStruct := ochecker.StartStruct{
@@ -161,10 +293,15 @@ func NewCoord(configPath string) (*Coord, error) {
 	tracer.SetShouldPrint(false)
 	coord := &Coord{
 		Routers:      []RouterInfo{},
+		Descriptors:  map[string]storprotocol.STorServiceDescriptor{},
 		RoutersReady: false,
 
 		Config: config,
 
+		PrivateKey: privateKey,
+		TLSCert:    cert,
+		Peers:      peers,
+
 		OCheck:          ocheck,
 		OCheckNotifyCh:  notifyCh,
 		OCheckCircuitCh: circuitCh,
@@ -185,6 +322,8 @@ func (c *Coord) StartCoord() error {
 
 	go c.updateActiveChainCounts()
 
+	go c.replicateFromPeers()
+
 	go c.listenRouter()
 
 	go c.listenClient()
@@ -197,44 +336,133 @@ func (c *Coord) StartCoord() error {
 
 // handles router join requests
 func (crl *CoordRPCListener) RegisterRouter(request storprotocol.STorRouterJoinRequest, response *storprotocol.STorRouterJoinResponse) error {
+	return crl.register(request, response, false)
+}
+
+// Adds a router to the public directory, or to the bridge registry if bridge is set
+func (crl *CoordRPCListener) register(request storprotocol.STorRouterJoinRequest, response *storprotocol.STorRouterJoinResponse, bridge bool) error {
 	trace := crl.C.Tracer.ReceiveToken(request.Token)
 	trace.RecordAction(RouterJoinRequestRecvd{request.Id})
-	newRouter := RouterInfo{
-		routerId:         request.Id,
-		publicKey:        request.PublicKey,
-		clientListenAddr: request.ClientListenAddr,
-		coordListenAddr:  request.CoordListenAddr,
-		oCheckAddr:       request.OCheckAddr,
-		activeChainCount: 0,
+	if !bytes.Equal(crl.PeerPublicKey, request.PublicKey) {
+		fmt.Println("router", request.Id, "presented a TLS certificate for a different key")
+		return errors.New("public key does not match TLS certificate")
 	}
-	if RouterAlreadyExists(crl.C.Routers, newRouter) {
-		fmt.Println("router already exists in directory")
-		return errors.New("router already exists in directory")
+	currentRouterIds, numRouters, err := crl.C.addRouter(routerInfoFromJoin(request), bridge)
+	if err != nil {
+		fmt.Println(err)
+		return err
 	}
 
-	// Add to directory of Routers
-	crl.C.Routers = append(crl.C.Routers, newRouter)
-
 	routerInfo := ochecker.RouterInfo{
 		Addr:     request.OCheckAddr,
 		RouterId: request.Id,
 	}
 	crl.C.OCheck.MonitorNewRouter(routerInfo)
-	trace.RecordAction(RouterRegistryUpdated{routerIds(crl.C.Routers)})
+	if bridge {
+		trace.RecordAction(BridgeRegistryUpdated{currentRouterIds})
+		fmt.Println("Bridge added:", request.Id, "| Bridges:", currentRouterIds)
+	} else {
+		trace.RecordAction(RouterRegistryUpdated{currentRouterIds})
+		fmt.Println("Router added:", request.Id, "| Routers:", currentRouterIds)
+	}
 	trace.RecordAction(RouterJoinRequestHandled{request.Id})
-	fmt.Println("Router added:", request.Id, "| Routers:", routerIds(crl.C.Routers))
 	*response = storprotocol.STorRouterJoinResponse{
 		Token: trace.GenerateToken(),
 	}
 
-	// Allow Coord to serve Clients when 3 Routers have joined
-	crl.C.RoutersReadyMutex.Lock()
-	if len(crl.C.Routers) >= 3 {
-		crl.C.RoutersReady = true
-		crl.C.RoutersReadyCond.Broadcast()
+	crl.C.updateRoutersReady(numRouters)
+	return nil
+}
+
+// lets routers check that they are still in the directory
+func (crl *CoordRPCListener) RouterStatus(request storprotocol.STorRouterStatusRequest, response *storprotocol.STorRouterStatusResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	crl.C.RoutersMutex.Lock()
+	router, ok := crl.C.findRegistered(request.Id)
+	crl.C.RoutersMutex.Unlock()
+	*response = storprotocol.STorRouterStatusResponse{
+		Known: ok && bytes.Equal(router.publicKey, crl.PeerPublicKey),
+		Token: trace.GenerateToken(),
 	}
-	crl.C.RoutersReadyMutex.Unlock()
+	return nil
+}
 
+// handles routers publishing a rotated onion key
+func (crl *CoordRPCListener) UpdateOnionKey(request storprotocol.STorRouterOnionKeyUpdate, response *storprotocol.STorRouterJoinResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	crl.C.RoutersMutex.Lock()
+	defer crl.C.RoutersMutex.Unlock()
+	registry := crl.C.registryOf(request.Id)
+	if registry == nil {
+		return errors.New("router is not in directory")
+	}
+	for i, router := range *registry {
+		if router.routerId == request.Id {
+			if !bytes.Equal(router.publicKey, crl.PeerPublicKey) {
+				return errors.New("public key does not match TLS certificate")
+			}
+			(*registry)[i].onionKey = request.OnionKey
+			trace.RecordAction(RouterOnionKeyUpdated{request.Id})
+			*response = storprotocol.STorRouterJoinResponse{
+				Token: trace.GenerateToken(),
+			}
+			return nil
+		}
+	}
+	return errors.New("router is not in directory")
+}
+
+// handles routers publishing a new puzzle seed or difficulty
+func (crl *CoordRPCListener) UpdateAdmission(request storprotocol.STorRouterAdmissionUpdate, response *storprotocol.STorRouterJoinResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	crl.C.RoutersMutex.Lock()
+	defer crl.C.RoutersMutex.Unlock()
+	registry := crl.C.registryOf(request.Id)
+	if registry == nil {
+		return errors.New("router is not in directory")
+	}
+	for i, router := range *registry {
+		if router.routerId == request.Id {
+			if !bytes.Equal(router.publicKey, crl.PeerPublicKey) {
+				return errors.New("public key does not match TLS certificate")
+			}
+			(*registry)[i].powSeed = request.PowSeed
+			(*registry)[i].powDifficulty = request.PowDifficulty
+			trace.RecordAction(RouterAdmissionUpdated{request.Id, request.PowDifficulty})
+			*response = storprotocol.STorRouterJoinResponse{
+				Token: trace.GenerateToken(),
+			}
+			return nil
+		}
+	}
+	return errors.New("router is not in directory")
+}
+
+// handles routers leaving the network on shutdown
+func (crl *CoordRPCListener) DeregisterRouter(request storprotocol.STorRouterLeaveRequest, response *storprotocol.STorRouterLeaveResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	trace.RecordAction(RouterLeaveRequestRecvd{request.Id})
+	if !bytes.Equal(crl.PeerPublicKey, request.PublicKey) {
+		return errors.New("public key does not match TLS certificate")
+	}
+
+	crl.C.RoutersMutex.Lock()
+	router, found := crl.C.findRegistered(request.Id)
+	if !found || !bytes.Equal(router.publicKey, request.PublicKey) {
+		crl.C.RoutersMutex.Unlock()
+		return errors.New("router is not in directory")
+	}
+	crl.C.removeRegistered(request.Id)
+	currentRouterIds := routerIds(crl.C.Routers)
+	crl.C.RoutersMutex.Unlock()
+
+	crl.C.OCheck.StopMonitoringRouter(request.Id)
+	trace.RecordAction(RouterRegistryUpdated{currentRouterIds})
+	trace.RecordAction(RouterLeaveRequestHandled{request.Id})
+	fmt.Println("Router left:", request.Id, "| Routers:", currentRouterIds)
+	*response = storprotocol.STorRouterLeaveResponse{
+		Token: trace.GenerateToken(),
+	}
 	return nil
 }
 
@@ -249,7 +477,10 @@ func (crl *CoordRPCListener) GetOnionRing(request storprotocol.STorCoordOnionRin
 	crl.C.RoutersReadyMutex.Unlock()
 	trace := crl.C.Tracer.ReceiveToken(request.Token)
 	trace.RecordAction(OnionRingRequestRcvd{request.ClientId})
-	onionRing := crl.C.createOnionRing(trace)
+	onionRing, err := crl.C.createOnionRing(trace, request.RejectedExitIds, request.ExcludeRouterIds, request.LastHopRouterId)
+	if err != nil {
+		return err
+	}
 	*response = storprotocol.STorCoordOnionRingResponse{
 		OnionRing: onionRing,
 		Token:     trace.GenerateToken(),
@@ -257,12 +488,47 @@ func (crl *CoordRPCListener) GetOnionRing(request storprotocol.STorCoordOnionRin
 	return nil
 }
 
+// handles clients replacing a failed hop of an existing circuit
+func (crl *CoordRPCListener) GetReplacementRouter(request storprotocol.STorCoordReplacementRequest, response *storprotocol.STorCoordReplacementResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	trace.RecordAction(ReplacementRequestRcvd{ClientId: request.ClientId, Position: request.Position})
+	crl.C.RoutersMutex.Lock()
+	crl.C.sortRoutersByLoad()
+	replacement, ok := pickReplacement(crl.C.Routers, request.Position, request.RejectedExitIds, request.ExcludeRouterIds)
+	crl.C.RoutersMutex.Unlock()
+	if !ok {
+		return errors.New("no router available for " + request.Position)
+	}
+	trace.RecordAction(ReplacementRouterPicked{ClientId: request.ClientId, RouterId: replacement.routerId})
+	*response = storprotocol.STorCoordReplacementResponse{
+		Router: replacement.descriptor(),
+		Token:  trace.GenerateToken(),
+	}
+	return nil
+}
+
 // ======================== PRIVATE METHODS ========================
 
+// Allow Coord to serve Clients when 3 Routers have joined
+func (c *Coord) updateRoutersReady(numRouters int) {
+	c.RoutersReadyMutex.Lock()
+	if numRouters >= 3 {
+		c.RoutersReady = true
+		c.RoutersReadyCond.Broadcast()
+	}
+	c.RoutersReadyMutex.Unlock()
+}
+
 func (c *Coord) listenRouter() {
 	/*
 		RPC functions:
 		- RegisterRouter
+		- RegisterBridge
+		- RouterStatus
+		- UpdateOnionKey
+		- UpdateAdmission
+		- DeregisterRouter
+		- GetRegistry
 	*/
 	c.listen(c.Config.RouterListenAddr)
 }
@@ -271,6 +537,10 @@ func (c *Coord) listenClient() {
 	/*
 		RPC functions:
 		- GetOnionRing
+		- GetReplacementRouter
+		- GetDirectory
+		- PublishServiceDescriptor
+		- GetServiceDescriptor
 	*/
 	c.listen(c.Config.ClientListenAddr)
 }
@@ -283,7 +553,7 @@ func (c *Coord) listen(addr string) {
 		c.ErrCh <- err
 		return
 	}
-	conn, err := net.ListenTCP("tcp", laddr)
+	listener, err := util.ListenTLS(laddr.String(), c.TLSCert)
 	if err != nil {
 		fmt.Println("Error listening on address", laddr.String(), ":", err)
 		c.ErrCh <- err
@@ -291,8 +561,18 @@ func (c *Coord) listen(addr string) {
 	}
 
 	// start RPC listener
-	rpc.Register(&CoordRPCListener{c})
-	rpc.Accept(conn)
+	util.AcceptLoop(listener, func(conn net.Conn) { c.serveConn(conn.(*tls.Conn)) })
+}
+
+// Each connection gets its own RPC server so handlers can see who they are talking to
+func (c *Coord) serveConn(conn *tls.Conn) {
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	server := rpc.NewServer()
+	server.Register(&CoordRPCListener{C: c, PeerPublicKey: util.TLSPeerPublicKey(conn.ConnectionState())})
+	server.ServeConn(conn)
 }
 
 func (c *Coord) handleRouterFailures() {
@@ -300,10 +580,13 @@ func (c *Coord) handleRouterFailures() {
 		failure := <-c.OCheckNotifyCh
 		failedRouterId := failure.RouterId
 		c.Trace.RecordAction(RouterFail{failedRouterId})
-		c.Routers = removeRouterInfo(c.Routers, failedRouterId)
+		c.RoutersMutex.Lock()
+		c.removeRegistered(failedRouterId)
+		currentRouterIds := routerIds(c.Routers)
+		c.RoutersMutex.Unlock()
 		c.Trace.RecordAction(RouterFailHandled{failedRouterId})
-		c.Trace.RecordAction(RouterRegistryUpdated{routerIds(c.Routers)})
-		fmt.Println("Router failed:", failedRouterId, "| Routers:", routerIds(c.Routers))
+		c.Trace.RecordAction(RouterRegistryUpdated{currentRouterIds})
+		fmt.Println("Router failed:", failedRouterId, "| Routers:", currentRouterIds)
 	}
 }
 
@@ -323,6 +606,14 @@ func (c *Coord) updateActiveChainCounts() {
 					})
 					c.Routers[i].activeChainCount = status.ActiveChainCount
 				}
+				if r.cryptoQueueDepth != status.CryptoQueueDepth {
+					c.Trace.RecordAction(RouterCryptoQueueUpdate{
+						RouterId: r.routerId,
+						Old:      r.cryptoQueueDepth,
+						New:      status.CryptoQueueDepth,
+					})
+					c.Routers[i].cryptoQueueDepth = status.CryptoQueueDepth
+				}
 				break
 			}
 		}
@@ -330,17 +621,12 @@ func (c *Coord) updateActiveChainCounts() {
 	}
 }
 
-func (c *Coord) createOnionRing(trace *tracing.Trace) []storprotocol.Router {
+func (c *Coord) createOnionRing(trace *tracing.Trace, rejectedExits []int, exclude []int, lastHop int) ([]storprotocol.Router, error) {
 	c.RoutersMutex.Lock()
+	defer c.RoutersMutex.Unlock()
 	fmt.Println("Getting onion ring, we have", len(c.Routers), "routers")
 
-	// Shuffle and then sort Routers by ascending ACC count
-	rand.Shuffle(len(c.Routers), func(i, j int) {
-		c.Routers[i], c.Routers[j] = c.Routers[j], c.Routers[i]
-	})
-	sort.Slice(c.Routers, func(i, j int) bool {
-		return c.Routers[i].activeChainCount < c.Routers[j].activeChainCount
-	})
+	c.sortRoutersByLoad()
 
 	// Trace Router:ACC
 	var routerActiveChainCounts []RouterActiveChainCount
@@ -352,20 +638,65 @@ func (c *Coord) createOnionRing(trace *tracing.Trace) []storprotocol.Router {
 	for _, x := range routerActiveChainCounts {
 		fmt.Println("Router:", x.RouterId, "ACC:", x.ActiveChainCount)
 	}
+
+	// Pick the least loaded Routers that signed up for each position, trying
+	// the next candidate for an earlier position if a later one cannot be filled
+	// Routers the client reported as unreliable are only used if there is no
+	// circuit without them
+	// A ring to an onion service's introduction or rendezvous point ends at
+	// that router instead of an exit
+	pick := func(routers []RouterInfo) []RouterInfo {
+		if lastHop != 0 {
+			return pickOnionRingTo(routers, lastHop)
+		}
+		return pickOnionRing(routers, rejectedExits)
+	}
+	chosen := pick(withoutRouters(c.Routers, exclude))
+	if chosen == nil && len(exclude) > 0 {
+		chosen = pick(c.Routers)
+	}
+	if chosen == nil {
+		return nil, errors.New("not enough guard, middle and exit routers for the destination")
+	}
+
 	// Create onion ring
 	var onionRing []storprotocol.Router
 	var onionRingTrace []int
-	for _, routerInfo := range c.Routers[0:3] {
-		router := storprotocol.Router{RouterId: routerInfo.routerId, PublicKey: routerInfo.publicKey, Addr: routerInfo.clientListenAddr}
-		onionRing = append(onionRing, router)
+	for _, routerInfo := range chosen {
+		onionRing = append(onionRing, routerInfo.descriptor())
 		onionRingTrace = append(onionRingTrace, routerInfo.routerId)
 		//fmt.Println("added router", routerInfo.routerId, "to onion ring")
 	}
 	fmt.Println(time.Now(), onionRingTrace)
 	trace.RecordAction(OnionRingCreated{onionRingTrace})
-	c.RoutersMutex.Unlock()
 
-	return onionRing
+	return onionRing, nil
+}
+
+// Shuffle and then sort Routers by ascending ACC count relative to their
+// advertised bandwidth. RoutersMutex must be held.
+func (c *Coord) sortRoutersByLoad() {
+	rand.Shuffle(len(c.Routers), func(i, j int) {
+		c.Routers[i], c.Routers[j] = c.Routers[j], c.Routers[i]
+	})
+	sort.SliceStable(c.Routers, func(i, j int) bool {
+		return routerLoad(c.Routers[i]) < routerLoad(c.Routers[j])
+	})
+}
+
+// Routers that do not advertise a bandwidth are treated as having this much
+const defaultRouterBandwidth = 1 << 20
+
+// Chains per byte per second of capacity, counting the chain about to be added
+// so an idle fast router still ranks ahead of an idle slow one. Each job
+// waiting in the router's crypto queue counts as a chain, so a router that is
+// behind on handshakes is not handed more.
+func routerLoad(router RouterInfo) float64 {
+	bandwidth := router.bandwidth
+	if bandwidth <= 0 {
+		bandwidth = defaultRouterBandwidth
+	}
+	return float64(router.activeChainCount+router.cryptoQueueDepth+1) / float64(bandwidth)
 }
 
 // ======================== PRIVATE HELPERS ========================
@@ -379,6 +710,76 @@ func RouterAlreadyExists(routers []RouterInfo, newRouter RouterInfo) bool {
 	return false
 }
 
+// Returns guard, middle and exit from routers (already in preference order),
+// or nil. Routers in rejectedExits are never the exit: the coord is not told
+// the client's destination, the client checks the exit policies in the
+// directory itself and names the exits that refuse it.
+func pickOnionRing(routers []RouterInfo, rejectedExits []int) []RouterInfo {
+	for e, exit := range routers {
+		if !util.HasRole(exit.roles, storprotocol.RoleExit) || hasRouterId(rejectedExits, exit.routerId) {
+			continue
+		}
+		for g, guard := range routers {
+			if g == e || !util.HasRole(guard.roles, storprotocol.RoleGuard) {
+				continue
+			}
+			for m, middle := range routers {
+				if m == e || m == g || !util.HasRole(middle.roles, storprotocol.RoleMiddle) {
+					continue
+				}
+				return []RouterInfo{guard, middle, exit}
+			}
+		}
+	}
+	return nil
+}
+
+// Returns the first router in routers (already in preference order) that can
+// take position and is not excluded
+func pickReplacement(routers []RouterInfo, position string, rejectedExits []int, exclude []int) (RouterInfo, bool) {
+	for _, router := range withoutRouters(routers, exclude) {
+		if !util.HasRole(router.roles, position) {
+			continue
+		}
+		if position == storprotocol.RoleExit && hasRouterId(rejectedExits, router.routerId) {
+			continue
+		}
+		return router, true
+	}
+	return RouterInfo{}, false
+}
+
+func hasRouterId(ids []int, id int) bool {
+	for _, other := range ids {
+		if other == id {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutRouters(routers []RouterInfo, exclude []int) []RouterInfo {
+	if len(exclude) == 0 {
+		return routers
+	}
+	var kept []RouterInfo
+	for _, router := range routers {
+		if !hasRouterId(exclude, router.routerId) {
+			kept = append(kept, router)
+		}
+	}
+	return kept
+}
+
+func findRouterInfo(routers []RouterInfo, id int) (RouterInfo, bool) {
+	for _, router := range routers {
+		if router.routerId == id {
+			return router, true
+		}
+	}
+	return RouterInfo{}, false
+}
+
 func removeRouterInfo(routers []RouterInfo, id int) []RouterInfo {
 	for i, v := range routers {
 		if v.routerId == id {
@@ -0,0 +1,101 @@
+package coord
+
+import (
+	storprotocol "STor/interface"
+	"testing"
+)
+
+func TestCoord_PickOnionRingRespectsRoles(t *testing.T) {
+	routers := []RouterInfo{
+		{routerId: 1, roles: []string{storprotocol.RoleExit}},
+		{routerId: 2, roles: []string{storprotocol.RoleGuard, storprotocol.RoleMiddle}},
+		{routerId: 3, roles: []string{storprotocol.RoleMiddle}},
+		{routerId: 4},
+	}
+	ring := pickOnionRing(routers, nil)
+	if ring == nil {
+		t.Fatalf("expected a ring")
+	}
+	if ring[0].routerId != 2 || ring[1].routerId != 3 || ring[2].routerId != 1 {
+		t.Fatalf("expected ring [2 3 1], got [%d %d %d]", ring[0].routerId, ring[1].routerId, ring[2].routerId)
+	}
+
+	// Router 4 is the only remaining exit once router 1 is gone, so router 2 must guard
+	ring = pickOnionRing(routers[1:], nil)
+	if ring == nil || ring[0].routerId != 2 || ring[1].routerId != 3 || ring[2].routerId != 4 {
+		t.Fatalf("expected ring [2 3 4], got %v", ring)
+	}
+
+	middleOnly := []RouterInfo{
+		{routerId: 1, roles: []string{storprotocol.RoleMiddle}},
+		{routerId: 2, roles: []string{storprotocol.RoleMiddle}},
+		{routerId: 3, roles: []string{storprotocol.RoleGuard}},
+	}
+	if ring = pickOnionRing(middleOnly, nil); ring != nil {
+		t.Fatalf("built a ring without any exit: %v", ring)
+	}
+}
+
+func TestCoord_PickOnionRingSkipsRejectedExits(t *testing.T) {
+	routers := []RouterInfo{{routerId: 1}, {routerId: 2}, {routerId: 3}}
+	ring := pickOnionRing(routers, []int{1, 2})
+	if ring == nil || ring[2].routerId != 3 {
+		t.Fatalf("expected router 3 as exit, got %v", ring)
+	}
+	if ring = pickOnionRing(routers, []int{1, 2, 3}); ring != nil {
+		t.Fatalf("built a ring although every exit was rejected: %v", ring)
+	}
+}
+
+func TestCoord_ExcludedRoutersAreSkipped(t *testing.T) {
+	routers := []RouterInfo{{routerId: 1}, {routerId: 2}, {routerId: 3}, {routerId: 4}}
+	ring := pickOnionRing(withoutRouters(routers, []int{1, 3}), nil)
+	if ring != nil {
+		t.Fatalf("built a ring from two routers: %v", ring)
+	}
+	ring = pickOnionRing(withoutRouters(routers, []int{2}), nil)
+	if ring == nil {
+		t.Fatalf("expected a ring")
+	}
+	for _, router := range ring {
+		if router.routerId == 2 {
+			t.Fatalf("excluded router 2 is in the ring")
+		}
+	}
+}
+
+func TestCoord_PickReplacement(t *testing.T) {
+	routers := []RouterInfo{
+		{routerId: 1, roles: []string{storprotocol.RoleGuard}},
+		{routerId: 2, roles: []string{storprotocol.RoleExit}},
+		{routerId: 3, roles: []string{storprotocol.RoleExit}},
+		{routerId: 4, roles: []string{storprotocol.RoleExit}},
+	}
+	replacement, ok := pickReplacement(routers, storprotocol.RoleExit, []int{2}, []int{3})
+	if !ok || replacement.routerId != 4 {
+		t.Fatalf("expected router 4 as the replacement exit, got %v %v", replacement.routerId, ok)
+	}
+	if _, ok = pickReplacement(routers, storprotocol.RoleMiddle, nil, nil); ok {
+		t.Fatalf("picked a middle from routers that do not take that role")
+	}
+}
+
+func TestCoord_RouterLoadAccountsForBandwidth(t *testing.T) {
+	slowIdle := RouterInfo{routerId: 1, bandwidth: 100 << 10}
+	fastBusy := RouterInfo{routerId: 2, bandwidth: 10 << 20, activeChainCount: 5}
+	unadvertised := RouterInfo{routerId: 3}
+	if routerLoad(fastBusy) >= routerLoad(slowIdle) {
+		t.Fatalf("busy fast router ranked behind an idle slow one")
+	}
+	if routerLoad(unadvertised) >= routerLoad(slowIdle) {
+		t.Fatalf("router without an advertised bandwidth ranked behind a slow one")
+	}
+}
+
+func TestCoord_RouterLoadAccountsForCryptoQueue(t *testing.T) {
+	idle := RouterInfo{routerId: 1, activeChainCount: 2}
+	backlogged := RouterInfo{routerId: 2, activeChainCount: 2, cryptoQueueDepth: 10}
+	if routerLoad(backlogged) <= routerLoad(idle) {
+		t.Fatalf("router behind on handshakes ranked ahead of one with an empty queue")
+	}
+}
@@ -0,0 +1,98 @@
+package coord
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+const (
+	// How long clients may use a signed directory
+	directoryLifetime = 10 * time.Minute
+	// A directory older than this is signed again even if nothing changed,
+	// so clients never get one about to expire
+	directoryRefresh = directoryLifetime / 2
+)
+
+// Recorded when Coord signs a new version of its directory
+type DirectorySigned struct {
+	Version uint64
+	Routers []int
+}
+
+// Hands out the directory signed with the coord's identity key. Clients only
+// use routers as a directory they have checked lists them, so whoever
+// answers for the coord without its key cannot slip in routers of their own.
+func (crl *CoordRPCListener) GetDirectory(request storprotocol.STorCoordDirectoryRequest, response *storprotocol.STorCoordDirectoryResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	directory, signed, err := crl.C.signedDirectory(time.Now())
+	if err != nil {
+		return err
+	}
+	if signed {
+		trace.RecordAction(DirectorySigned{Version: directory.Version, Routers: util.RouterIds(directory.Routers)})
+	}
+	*response = storprotocol.STorCoordDirectoryResponse{
+		Directory: directory,
+		Token:     trace.GenerateToken(),
+	}
+	return nil
+}
+
+// Returns the current directory, signing a new one if the routers listed
+// have changed or the last one is due for refreshing. signed reports
+// whether a new one was signed.
+func (c *Coord) signedDirectory(now time.Time) (directory storprotocol.STorDirectory, signed bool, err error) {
+	c.RoutersMutex.Lock()
+	routers := make([]storprotocol.Router, 0, len(c.Routers))
+	for _, router := range c.Routers {
+		routers = append(routers, router.descriptor())
+	}
+	c.RoutersMutex.Unlock()
+	sort.Slice(routers, func(i, j int) bool { return routers[i].RouterId < routers[j].RouterId })
+
+	c.directoryMutex.Lock()
+	defer c.directoryMutex.Unlock()
+	current := c.directory
+	changed := current.Version == 0 || !sameRouters(current.Routers, routers)
+	if !changed && now.Sub(current.PublishedAt) < directoryRefresh {
+		return current, false, nil
+	}
+	next := storprotocol.STorDirectory{
+		Version:     current.Version,
+		PublishedAt: now,
+		ValidUntil:  now.Add(directoryLifetime),
+		Routers:     routers,
+	}
+	if changed {
+		next.Version++
+	}
+	if next.Signature, err = util.SignRSA(c.PrivateKey, util.DirectoryDigest(next)); err != nil {
+		return current, false, err
+	}
+	c.directory = next
+	return next, true, nil
+}
+
+// Compares two sorted router lists field by field, puzzles included
+func sameRouters(a []storprotocol.Router, b []storprotocol.Router) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].RouterId != b[i].RouterId ||
+			!bytes.Equal(a[i].PublicKey, b[i].PublicKey) ||
+			!bytes.Equal(a[i].OnionKey, b[i].OnionKey) ||
+			a[i].Addr != b[i].Addr ||
+			!bytes.Equal(a[i].PowSeed, b[i].PowSeed) ||
+			a[i].PowDifficulty != b[i].PowDifficulty ||
+			!reflect.DeepEqual(a[i].ExitPolicy, b[i].ExitPolicy) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package coord
+
+import (
+	"testing"
+	"time"
+
+	"STor/util"
+)
+
+func TestCoord_SignedDirectory(t *testing.T) {
+	privateKey, _, _ := util.GenerateRSAKeyPair()
+	publicKey := util.ConvertPublicKeyToBytes(&privateKey.PublicKey)
+	c := &Coord{PrivateKey: privateKey}
+	c.addRouter(RouterInfo{routerId: 2, publicKey: []byte{2}, clientListenAddr: "a2"}, false)
+	c.addRouter(RouterInfo{routerId: 1, publicKey: []byte{1}, clientListenAddr: "a1"}, false)
+	c.addRouter(RouterInfo{routerId: 3, publicKey: []byte{3}}, true)
+
+	now := time.Now()
+	first, signed, err := c.signedDirectory(now)
+	if err != nil || !signed {
+		t.Fatalf("first directory was not signed: %v", err)
+	}
+	if err = util.CheckDirectory(first, publicKey, now); err != nil {
+		t.Fatalf("directory does not check against the coord's key: %s", err)
+	}
+	if first.Version != 1 || len(first.Routers) != 2 || first.Routers[0].RouterId != 1 || first.Routers[1].RouterId != 2 {
+		t.Fatalf("expected version 1 listing routers [1 2] without the bridge, got %d %v", first.Version, util.RouterIds(first.Routers))
+	}
+
+	// Unchanged and recent: the same signed directory is handed out again
+	again, signed, _ := c.signedDirectory(now.Add(time.Minute))
+	if signed || again.Version != 1 || !again.PublishedAt.Equal(first.PublishedAt) {
+		t.Fatalf("unchanged directory was signed again")
+	}
+
+	// Refreshed before it expires, under the same version
+	refreshed, signed, _ := c.signedDirectory(now.Add(directoryRefresh))
+	if !signed || refreshed.Version != 1 || !refreshed.ValidUntil.After(first.ValidUntil) {
+		t.Fatalf("old directory was not refreshed: version %d, valid until %v", refreshed.Version, refreshed.ValidUntil)
+	}
+
+	// Any change to a listed router is a new version
+	c.Routers[0].powDifficulty = 12
+	changed, signed, _ := c.signedDirectory(now.Add(directoryRefresh + time.Second))
+	if !signed || changed.Version != 2 {
+		t.Fatalf("changed directory got version %d", changed.Version)
+	}
+	if err = util.CheckDirectory(changed, publicKey, now.Add(directoryRefresh)); err != nil {
+		t.Fatalf("new version does not check: %s", err)
+	}
+}
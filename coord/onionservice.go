@@ -0,0 +1,115 @@
+package coord
+
+import (
+	"errors"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+const (
+	// Services republish well within this, so an older descriptor means the service is gone
+	descriptorLifetime = time.Hour
+	// Tolerated difference between the service's clock and the coord's
+	descriptorClockSkew = 5 * time.Minute
+)
+
+// Recorded when Coord stores an onion service descriptor
+type DescriptorPublished struct {
+	Address     string
+	IntroPoints []int
+}
+
+// Recorded when Coord is asked for an onion service descriptor
+type DescriptorRequested struct {
+	Address string
+	Found   bool
+}
+
+// Stores a descriptor signed by the service key its address derives from.
+// An older descriptor never replaces a newer one.
+func (crl *CoordRPCListener) PublishServiceDescriptor(request storprotocol.STorCoordPublishDescriptorRequest, response *storprotocol.STorCoordPublishDescriptorResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	if err := crl.C.storeDescriptor(request.Descriptor, time.Now()); err != nil {
+		return err
+	}
+	trace.RecordAction(DescriptorPublished{Address: request.Descriptor.Address, IntroPoints: util.RouterIds(request.Descriptor.IntroPoints)})
+	*response = storprotocol.STorCoordPublishDescriptorResponse{Token: trace.GenerateToken()}
+	return nil
+}
+
+func (crl *CoordRPCListener) GetServiceDescriptor(request storprotocol.STorCoordDescriptorRequest, response *storprotocol.STorCoordDescriptorResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	descriptor, found := crl.C.lookupDescriptor(request.Address, time.Now())
+	trace.RecordAction(DescriptorRequested{Address: request.Address, Found: found})
+	*response = storprotocol.STorCoordDescriptorResponse{
+		Descriptor: descriptor,
+		Found:      found,
+		Token:      trace.GenerateToken(),
+	}
+	return nil
+}
+
+func (c *Coord) storeDescriptor(descriptor storprotocol.STorServiceDescriptor, now time.Time) error {
+	if !util.VerifyDescriptor(descriptor) {
+		return errors.New("descriptor is not signed by the service key")
+	}
+	if descriptor.PublishedAt.After(now.Add(descriptorClockSkew)) || now.Sub(descriptor.PublishedAt) > descriptorLifetime {
+		return errors.New("descriptor is not current")
+	}
+	if len(descriptor.IntroPoints) == 0 {
+		return errors.New("descriptor lists no introduction points")
+	}
+	c.DescriptorsMutex.Lock()
+	defer c.DescriptorsMutex.Unlock()
+	if c.Descriptors == nil {
+		c.Descriptors = map[string]storprotocol.STorServiceDescriptor{}
+	}
+	if old, ok := c.Descriptors[descriptor.Address]; ok && !descriptor.PublishedAt.After(old.PublishedAt) {
+		return errors.New("a newer descriptor is already published")
+	}
+	c.Descriptors[descriptor.Address] = descriptor
+	return nil
+}
+
+func (c *Coord) lookupDescriptor(address string, now time.Time) (storprotocol.STorServiceDescriptor, bool) {
+	c.DescriptorsMutex.Lock()
+	defer c.DescriptorsMutex.Unlock()
+	descriptor, ok := c.Descriptors[address]
+	if !ok {
+		return storprotocol.STorServiceDescriptor{}, false
+	}
+	if now.Sub(descriptor.PublishedAt) > descriptorLifetime {
+		delete(c.Descriptors, address)
+		return storprotocol.STorServiceDescriptor{}, false
+	}
+	return descriptor, true
+}
+
+// Returns guard and middle from routers (already in preference order) followed
+// by the router lastHop, which may have any role, or nil
+func pickOnionRingTo(routers []RouterInfo, lastHop int) []RouterInfo {
+	var last RouterInfo
+	found := false
+	for _, router := range routers {
+		if router.routerId == lastHop {
+			last, found = router, true
+		}
+	}
+	if !found {
+		return nil
+	}
+	for g, guard := range routers {
+		if guard.routerId == lastHop || !util.HasRole(guard.roles, storprotocol.RoleGuard) {
+			continue
+		}
+		for m, middle := range routers {
+			if m == g || middle.routerId == lastHop || !util.HasRole(middle.roles, storprotocol.RoleMiddle) {
+				continue
+			}
+			return []RouterInfo{guard, middle, last}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package coord
+
+import (
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+func TestCoord_PickOnionRingTo(t *testing.T) {
+	routers := []RouterInfo{
+		{routerId: 1},
+		{routerId: 2, roles: []string{storprotocol.RoleGuard}},
+		{routerId: 3, roles: []string{storprotocol.RoleMiddle}},
+	}
+	// The last hop need not be an exit, and router 1 is the only other middle
+	ring := pickOnionRingTo(routers, 3)
+	if ring == nil || ring[0].routerId != 2 || ring[1].routerId != 1 || ring[2].routerId != 3 {
+		t.Fatalf("expected ring [2 1 3], got %v", ring)
+	}
+	if ring = pickOnionRingTo(routers, 1); ring == nil || ring[0].routerId != 2 || ring[1].routerId != 3 {
+		t.Fatalf("expected ring [2 3 1], got %v", ring)
+	}
+	if ring = pickOnionRingTo(routers[1:], 3); ring != nil {
+		t.Fatalf("built a ring to router 3 without a middle: %v", ring)
+	}
+	if ring = pickOnionRingTo(routers, 9); ring != nil {
+		t.Fatalf("built a ring to an unknown router: %v", ring)
+	}
+}
+
+func TestCoord_ServiceDescriptors(t *testing.T) {
+	privateKey, publicKey, _ := util.GenerateRSAKeyPair()
+	now := time.Now()
+	sign := func(publishedAt time.Time) storprotocol.STorServiceDescriptor {
+		descriptor := storprotocol.STorServiceDescriptor{
+			PublicKey:   util.ConvertPublicKeyToBytes(publicKey),
+			IntroPoints: []storprotocol.Router{{RouterId: 1, Addr: "10.0.0.1:1"}},
+			PublishedAt: publishedAt,
+		}
+		descriptor.Address = util.ServiceAddress(descriptor.PublicKey)
+		descriptor.Signature, _ = util.SignRSA(privateKey, util.DescriptorDigest(descriptor))
+		return descriptor
+	}
+
+	c := &Coord{}
+	descriptor := sign(now.Add(-time.Minute))
+	if err := c.storeDescriptor(descriptor, now); err != nil {
+		t.Fatalf("storeDescriptor returned an error %s", err)
+	}
+	if found, ok := c.lookupDescriptor(descriptor.Address, now); !ok || !found.PublishedAt.Equal(descriptor.PublishedAt) {
+		t.Fatalf("published descriptor was not found")
+	}
+
+	// A replayed or older descriptor does not replace the current one
+	if err := c.storeDescriptor(sign(now.Add(-2*time.Minute)), now); err == nil {
+		t.Fatalf("older descriptor was accepted")
+	}
+
+	tampered := sign(now)
+	tampered.IntroPoints = []storprotocol.Router{{RouterId: 2, Addr: "10.0.0.2:1"}}
+	if err := c.storeDescriptor(tampered, now); err == nil {
+		t.Fatalf("descriptor with altered introduction points was accepted")
+	}
+	otherKey, _, _ := util.GenerateRSAKeyPair()
+	forged := sign(now)
+	forged.Signature, _ = util.SignRSA(otherKey, util.DescriptorDigest(forged))
+	if err := c.storeDescriptor(forged, now); err == nil {
+		t.Fatalf("descriptor signed by another key was accepted")
+	}
+	if err := c.storeDescriptor(sign(now.Add(-2*descriptorLifetime)), now); err == nil {
+		t.Fatalf("stale descriptor was accepted")
+	}
+
+	if _, ok := c.lookupDescriptor(descriptor.Address, now.Add(2*descriptorLifetime)); ok {
+		t.Fatalf("expired descriptor was still handed out")
+	}
+}
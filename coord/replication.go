@@ -0,0 +1,170 @@
+package coord
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	storprotocol "STor/interface"
+	ochecker "STor/oCheck"
+	"STor/util"
+)
+
+// Recorded when Coord copies routers it did not know of from the other coords
+type RegistryReplicated struct {
+	PeersAnswered int
+	Routers       []int
+	Bridges       []int
+}
+
+// Hands the registry, bridges included, to another coord. Only the coords
+// in Peers are answered, since bridge addresses are not public.
+func (crl *CoordRPCListener) GetRegistry(request storprotocol.STorCoordRegistryRequest, response *storprotocol.STorCoordRegistryResponse) error {
+	trace := crl.C.Tracer.ReceiveToken(request.Token)
+	if !crl.C.isPeer(crl.PeerPublicKey) {
+		return errors.New("caller is not a peer coord")
+	}
+	crl.C.RoutersMutex.Lock()
+	defer crl.C.RoutersMutex.Unlock()
+	*response = storprotocol.STorCoordRegistryResponse{
+		Routers: joinRequests(crl.C.Routers),
+		Bridges: joinRequests(crl.C.Bridges),
+		Token:   trace.GenerateToken(),
+	}
+	return nil
+}
+
+// Peers are recognised by their pinned keys; a peer configured without one
+// is never answered
+func (c *Coord) isPeer(publicKey []byte) bool {
+	for _, peer := range c.Peers {
+		if peer.PublicKey != nil && bytes.Equal(peer.PublicKey, publicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// How often a coord compares its registry with its peers'
+const registrySyncInterval = time.Minute
+
+// Copies in the routers most coords agree on. At startup this lets the coord
+// serve clients without waiting for every router to notice and register
+// again. Afterwards it runs every registrySyncInterval, so a router whose
+// join never reached this coord is still picked up once the others list it.
+func (c *Coord) replicateFromPeers() {
+	if len(c.Peers) == 0 {
+		return
+	}
+	for {
+		c.syncWithPeers()
+		time.Sleep(registrySyncInterval)
+	}
+}
+
+func (c *Coord) syncWithPeers() {
+	var routers, bridges [][]storprotocol.STorRouterJoinRequest
+	for _, peer := range c.Peers {
+		registry, err := c.fetchRegistry(peer)
+		if err != nil {
+			fmt.Println("Error fetching registry from coord", peer.Addr, ":", err)
+			continue
+		}
+		routers = append(routers, registry.Routers)
+		bridges = append(bridges, registry.Bridges)
+	}
+	if len(routers) == 0 {
+		return
+	}
+	replicated := c.adoptAgreed(routers, bridges)
+	if len(replicated.Routers) == 0 && len(replicated.Bridges) == 0 {
+		return
+	}
+	c.Trace.RecordAction(replicated)
+	fmt.Println("Copied from peer coords | Routers:", replicated.Routers, "| Bridges:", replicated.Bridges)
+}
+
+// Adds the routers and bridges that more than half of all coords, this one
+// included, list the same way. routers and bridges hold the registries of
+// the peers that answered. Routers this coord already has are kept as they
+// are, since their own updates reach it directly.
+func (c *Coord) adoptAgreed(routers, bridges [][]storprotocol.STorRouterJoinRequest) RegistryReplicated {
+	c.RoutersMutex.Lock()
+	routers = append(routers, joinRequests(c.Routers))
+	bridges = append(bridges, joinRequests(c.Bridges))
+	c.RoutersMutex.Unlock()
+	coords := len(c.Peers) + 1
+
+	adopt := func(entries []storprotocol.STorRouterJoinRequest, bridge bool) []int {
+		var adopted []int
+		for _, entry := range entries {
+			c.RoutersMutex.Lock()
+			_, known := c.findRegistered(entry.Id)
+			c.RoutersMutex.Unlock()
+			if known {
+				continue
+			}
+			_, numRouters, err := c.addRouter(routerInfoFromJoin(entry), bridge)
+			if err != nil {
+				continue
+			}
+			c.OCheck.MonitorNewRouter(ochecker.RouterInfo{Addr: entry.OCheckAddr, RouterId: entry.Id})
+			c.updateRoutersReady(numRouters)
+			adopted = append(adopted, entry.Id)
+		}
+		return adopted
+	}
+	return RegistryReplicated{
+		PeersAnswered: len(routers) - 1,
+		Routers:       adopt(agreedRegistry(routers, coords), false),
+		Bridges:       adopt(agreedRegistry(bridges, coords), true),
+	}
+}
+
+func (c *Coord) fetchRegistry(peer util.Authority) (storprotocol.STorCoordRegistryResponse, error) {
+	var response storprotocol.STorCoordRegistryResponse
+	peerClient, err := util.DialRPC(peer.Addr, c.TLSCert, peer.PublicKey)
+	if err != nil {
+		return response, err
+	}
+	defer peerClient.Close()
+	request := storprotocol.STorCoordRegistryRequest{Token: c.Trace.GenerateToken()}
+	if err = peerClient.Call("CoordRPCListener.GetRegistry", request, &response); err != nil {
+		return response, err
+	}
+	c.Tracer.ReceiveToken(response.Token)
+	return response, nil
+}
+
+// Returns the routers that more than half of coords list with the same
+// identity and addresses. registries holds the registry of each coord that
+// answered. Onion keys and puzzles may differ while a router's update is on
+// its way to every coord, so those are taken from one of the agreeing coords.
+func agreedRegistry(registries [][]storprotocol.STorRouterJoinRequest, coords int) []storprotocol.STorRouterJoinRequest {
+	votes := map[string]int{}
+	var agreed []storprotocol.STorRouterJoinRequest
+	for _, registry := range registries {
+		voted := map[int]bool{}
+		for _, entry := range registry {
+			if voted[entry.Id] {
+				continue
+			}
+			voted[entry.Id] = true
+			key := fmt.Sprintf("%d|%x|%s|%s|%s", entry.Id, entry.PublicKey, entry.ClientListenAddr, entry.CoordListenAddr, entry.OCheckAddr)
+			votes[key]++
+			if votes[key] == util.Majority(coords) {
+				agreed = append(agreed, entry)
+			}
+		}
+	}
+	return agreed
+}
+
+func joinRequests(routers []RouterInfo) []storprotocol.STorRouterJoinRequest {
+	requests := make([]storprotocol.STorRouterJoinRequest, 0, len(routers))
+	for _, router := range routers {
+		requests = append(requests, router.joinRequest())
+	}
+	return requests
+}
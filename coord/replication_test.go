@@ -0,0 +1,73 @@
+package coord
+
+import (
+	"sync"
+	"testing"
+
+	storprotocol "STor/interface"
+	ochecker "STor/oCheck"
+	"STor/util"
+)
+
+func TestCoord_AgreedRegistry(t *testing.T) {
+	r1 := storprotocol.STorRouterJoinRequest{Id: 1, PublicKey: []byte{1}, ClientListenAddr: "a1", OCheckAddr: "o1"}
+	r2 := storprotocol.STorRouterJoinRequest{Id: 2, PublicKey: []byte{2}, ClientListenAddr: "a2", OCheckAddr: "o2"}
+	moved := r2
+	moved.ClientListenAddr = "elsewhere"
+	rotated := r1
+	rotated.OnionKey = []byte("new onion key")
+
+	// Three coords, one unreachable: both that answered must agree
+	agreed := agreedRegistry([][]storprotocol.STorRouterJoinRequest{{r1, r2}, {rotated, moved}}, 3)
+	if len(agreed) != 1 || agreed[0].Id != 1 {
+		t.Fatalf("expected only router 1 to be agreed, got %v", agreed)
+	}
+
+	// A coord listing a router twice still has one vote
+	agreed = agreedRegistry([][]storprotocol.STorRouterJoinRequest{{r2, r2}, {}, {}}, 3)
+	if len(agreed) != 0 {
+		t.Fatalf("one coord's listing was taken as a majority: %v", agreed)
+	}
+	if agreed = agreedRegistry([][]storprotocol.STorRouterJoinRequest{{r2}}, 1); len(agreed) != 1 {
+		t.Fatalf("the only coord's registry was not taken: %v", agreed)
+	}
+}
+
+func TestCoord_OnlyPinnedPeersAreAnswered(t *testing.T) {
+	_, peerKey, _ := util.GenerateRSAKeyPair()
+	_, strangerKey, _ := util.GenerateRSAKeyPair()
+	c := &Coord{Peers: []util.Authority{
+		{Addr: "127.0.0.1:1", PublicKey: util.ConvertPublicKeyToBytes(peerKey)},
+		{Addr: "127.0.0.1:2"},
+	}}
+	if !c.isPeer(util.ConvertPublicKeyToBytes(peerKey)) {
+		t.Fatalf("pinned peer was not recognised")
+	}
+	if c.isPeer(util.ConvertPublicKeyToBytes(strangerKey)) || c.isPeer(nil) {
+		t.Fatalf("caller without a pinned key was taken for a peer")
+	}
+}
+
+func TestCoord_RouterJoiningPeersLaterIsAdopted(t *testing.T) {
+	c := &Coord{Peers: make([]util.Authority, 2), OCheck: ochecker.NewOCheck()}
+	c.RoutersReadyCond = sync.NewCond(&c.RoutersReadyMutex)
+	known := storprotocol.STorRouterJoinRequest{Id: 1, PublicKey: []byte{1}, ClientListenAddr: "a1", OCheckAddr: "o1"}
+	c.addRouter(routerInfoFromJoin(known), false)
+	c.Routers[0].activeChainCount = 4
+	late := storprotocol.STorRouterJoinRequest{Id: 2, PublicKey: []byte{2}, ClientListenAddr: "a2", OCheckAddr: "o2"}
+
+	// Only one of three coords lists the router so far
+	replicated := c.adoptAgreed([][]storprotocol.STorRouterJoinRequest{{known, late}, {known}}, nil)
+	if len(replicated.Routers) != 0 || len(c.Routers) != 1 {
+		t.Fatalf("router listed by one coord of three was adopted: %v", replicated.Routers)
+	}
+
+	// It joined the other peer after startup; the next sync picks it up
+	replicated = c.adoptAgreed([][]storprotocol.STorRouterJoinRequest{{known, late}, {known, late}}, nil)
+	if len(replicated.Routers) != 1 || replicated.Routers[0] != 2 || len(c.Routers) != 2 {
+		t.Fatalf("expected router 2 to be adopted, got %v", replicated.Routers)
+	}
+	if c.Routers[0].activeChainCount != 4 {
+		t.Fatalf("router the coord already had was replaced by the peers' copy")
+	}
+}
@@ -4,5 +4,5 @@ go 1.16
 
 require (
 	github.com/DistributedClocks/tracing v0.0.0-20220202233639-0154e31ea72b
-	github.com/google/uuid v1.3.0 // indirect
+	github.com/google/uuid v1.3.0
 )
@@ -2,6 +2,7 @@ package storprotocol
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/DistributedClocks/tracing"
 )
@@ -10,25 +11,34 @@ type STorGeneralRouterPackageRequest struct {
 	ClientId       string
 	Payload        []byte
 	EncryptionType string
+	PowNonce       uint64 // solution to the router's puzzle, for an RSA handshake while it demands one
 	Token          tracing.TracingToken
 }
 
 type STorGeneralRouterPackageResponse struct {
-	Payload []byte
-	Token   tracing.TracingToken
+	Payload          []byte
+	Destroyed        bool // the circuit is gone at the replying hop, every hop before it frees its state too
+	AwaitingTruncate bool // a hop could not reach the next one; every hop frees the circuit unless the client truncates it soon
+	Token            tracing.TracingToken
 }
 
 type STorEncryptedRouterRequest struct {
 	ClientId       string
 	NextAddr       string
+	NextPublicKey  []byte // identity key the next router must present over TLS
 	Payload        []byte
 	EncryptionType string
+	PowNonce       uint64 // puzzle solution the next router's Init carries
+	Seq            uint64 // numbers the client's cells on the circuit from 1, so hops can refuse replays
 }
 
 // Circuit Init for Client-Coord
 type STorCoordOnionRingRequest struct {
-	ClientId string
-	Token    tracing.TracingToken // tracing token
+	ClientId         string
+	ExcludeRouterIds []int                // routers the client found unreliable, avoided if possible
+	RejectedExitIds  []int                // routers whose exit policy refuses the client's destination, never the exit
+	LastHopRouterId  int                  // ends the ring at this router instead of an exit, 0 for none
+	Token            tracing.TracingToken // tracing token
 }
 
 type STorCoordOnionRingResponse struct {
@@ -36,20 +46,184 @@ type STorCoordOnionRingResponse struct {
 	Token     tracing.TracingToken // tracing token
 }
 
+// Circuit repair for Client-Coord: a router to take one position of an existing circuit
+type STorCoordReplacementRequest struct {
+	ClientId         string
+	Position         string               // role the replacement takes, one of the Role constants
+	ExcludeRouterIds []int                // routers already in the circuit or found unreliable
+	RejectedExitIds  []int                // routers whose exit policy refuses the client's destination, never the exit
+	Token            tracing.TracingToken // tracing token
+}
+
+type STorCoordReplacementResponse struct {
+	Router Router
+	Token  tracing.TracingToken // tracing token
+}
+
+// Every router a coord lists. Clients use a router only as a directory they
+// have verified lists it.
+type STorDirectory struct {
+	Version     uint64    // goes up whenever the list changes, starting from 1 when the coord starts
+	PublishedAt time.Time // when the coord signed it
+	ValidUntil  time.Time // clients refuse the directory after this
+	Routers     []Router  // by ascending id
+	Signature   []byte    // by the coord's identity key, over util.DirectoryDigest
+}
+
+type STorCoordDirectoryRequest struct {
+	Token tracing.TracingToken // tracing token
+}
+
+type STorCoordDirectoryResponse struct {
+	Directory STorDirectory
+	Token     tracing.TracingToken // tracing token
+}
+
+// Positions a router can take in a circuit
+const (
+	RoleGuard  = "guard"
+	RoleMiddle = "middle"
+	RoleExit   = "exit"
+)
+
 type Router struct {
-	RouterId  int
-	PublicKey []byte
-	Addr      string // RPC (TCP) address that router will use to listen for client
+	RouterId      int
+	PublicKey     []byte     // long-term identity key, presented as the router's TLS certificate
+	OnionKey      []byte     // medium-term key used to encrypt circuit handshakes
+	Addr          string     // RPC (TCP) address that router will use to listen for client
+	PowSeed       []byte     // seed of the router's handshake puzzle
+	PowDifficulty int        // leading zero bits the router demands of puzzle solutions, 0 if none
+	ExitPolicy    ExitPolicy // destinations the router fetches as an exit, for clients to pick exits by
 }
 
 // Sending HTTP Request
 type STorRouterHTTPRequest struct {
-	Header http.Header
+	Header        http.Header
+	Method        string
+	Url           string
+	Body          []byte
+	Command       string          // ExitCommandFetch, ExitCommandNextChunk, ExitCommandEnd or ExitCommandResolve
+	StreamId      int             // stream within the circuit the command is for
+	QueryType     string          // for ExitCommandResolve: ResolveA, ResolveAAAA or ResolvePTR
+	Service       STorServiceCell // for the onion service commands
+	StreamSendme  bool            // client consumed StreamSendmeIncrement more chunks of this stream
+	CircuitSendme bool            // client consumed CircuitSendmeIncrement more chunks on this circuit
+}
+
+// What the exit does with a STorRouterHTTPRequest
+const (
+	ExitCommandFetch     = ""        // fetch Url and return the first chunk of the body
+	ExitCommandNextChunk = "next"    // return the next chunk of the body being fetched
+	ExitCommandEnd       = "end"     // close the stream without reading the rest of the body
+	ExitCommandResolve   = "resolve" // look up Url, a hostname or for PTR an address, and return a STorResolveResponse
+)
+
+// Onion service commands, handled by the last hop of the circuit whatever its role
+const (
+	ServiceCommandEstablishIntro      = "establish-intro"         // service: make this router an introduction point for Service.Address
+	ServiceCommandIntroduce           = "introduce"               // client: pass Service.Payload to the service at Service.Address
+	ServiceCommandNextIntroduction    = "next-introduction"       // service: wait for the next introduction
+	ServiceCommandEstablishRendezvous = "establish-rendezvous"    // client: wait here for the service that presents Service.Cookie
+	ServiceCommandRendezvous          = "rendezvous"              // service: join the client circuit waiting with Service.Cookie
+	ServiceCommandRequest             = "rendezvous-request"      // client: pass Service.Payload to the joined service and return its reply
+	ServiceCommandNextRequest         = "next-rendezvous-request" // service: wait for the next client request
+	ServiceCommandResponse            = "rendezvous-response"     // service: reply Service.Payload to request Service.RequestId
+)
+
+// Onion service addresses end with this
+const ServiceAddressSuffix = ".stor"
+
+// Arguments of an onion service command. Reply payloads for the "next"
+// commands are STorServiceCells too; an empty one means nothing arrived in time.
+type STorServiceCell struct {
+	Address   string // onion service address
+	PublicKey []byte // service key, for ServiceCommandEstablishIntro
+	Signature []byte // service key's signature over the circuit id, for ServiceCommandEstablishIntro
+	Cookie    []byte // rendezvous cookie
+	RequestId uint64
+	Payload   []byte // end-to-end encrypted, opaque to the router
+}
+
+// What a client tells a service through an introduction point. Only
+// EncryptedKey is encrypted to the service key; it unlocks Payload.
+type STorIntroduceCell struct {
+	EncryptedKey []byte // session key, RSA encrypted to the service key
+	Payload      []byte // STorIntroduction, AES encrypted with the session key
+}
+
+type STorIntroduction struct {
+	RendezvousPoint Router
+	Cookie          []byte
+}
+
+// Request and reply between a client and an onion service, AES encrypted with
+// the session key the client chose
+type STorServiceRequest struct {
 	Method string
-	Url    string
+	Path   string
+	Header http.Header
 	Body   []byte
 }
 
+type STorServiceResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Published by an onion service so clients can find its introduction points
+type STorServiceDescriptor struct {
+	Address     string
+	PublicKey   []byte
+	IntroPoints []Router
+	PublishedAt time.Time
+	Signature   []byte // by the service key, over util.DescriptorDigest
+}
+
+type STorCoordPublishDescriptorRequest struct {
+	Descriptor STorServiceDescriptor
+	Token      tracing.TracingToken
+}
+
+type STorCoordPublishDescriptorResponse struct {
+	Token tracing.TracingToken
+}
+
+type STorCoordDescriptorRequest struct {
+	Address string
+	Token   tracing.TracingToken
+}
+
+type STorCoordDescriptorResponse struct {
+	Descriptor STorServiceDescriptor
+	Found      bool
+	Token      tracing.TracingToken
+}
+
+// DNS lookups an exit performs for ExitCommandResolve
+const (
+	ResolveA    = "A"
+	ResolveAAAA = "AAAA"
+	ResolvePTR  = "PTR"
+)
+
+// Payload of the exit's reply to ExitCommandResolve
+type STorResolveResponse struct {
+	Answers  []string // addresses for A and AAAA, names for PTR
+	NotFound bool     // the name does not exist
+	TTL      uint32   // seconds the answers may be cached
+}
+
+// Streams a circuit can have open at the exit at once
+const MaxStreamsPerCircuit = 64
+
+// Flow control: the exit sends a window of chunks, then waits for the client to
+// acknowledge consuming them. Each acknowledgement reopens this many chunks.
+const (
+	StreamSendmeIncrement  = 4
+	CircuitSendmeIncrement = 8
+)
+
 type STorOnionMessage struct {
 	ClientId string // For identification by the Router (associate shared key with clientId)
 	Onion    []byte // The onionized message (via shared keys) as a byte array
@@ -57,16 +231,35 @@ type STorOnionMessage struct {
 }
 
 type STorRouterHTTPResponse struct {
-	Response []byte
+	Response         []byte
+	Destroyed        bool // the circuit is gone at the replying hop, every hop before it frees its state too
+	AwaitingTruncate bool // a hop could not reach the next one; every hop frees the circuit unless the client truncates it soon
+	Token            tracing.TracingToken
+}
+
+// Link-level destroy, sent by a neighbour on the circuit rather than the
+// client so it is not onion encrypted
+type STorCircuitDestroyRequest struct {
+	ClientId string
 	Token    tracing.TracingToken
 }
 
+type STorCircuitDestroyResponse struct {
+	Token tracing.TracingToken
+}
+
 type STorRouterJoinRequest struct {
 	Id               int
-	PublicKey        []byte               // public asymmetric key
+	PublicKey        []byte               // public identity key
+	OnionKey         []byte               // public onion key for circuit handshakes
 	ClientListenAddr string               // RPC (TCP) address to listen for Client
 	CoordListenAddr  string               // RPC (TCP) address to listen for Coord
 	OCheckAddr       string               // UDP address to listen for heartbeats
+	ExitPolicy       ExitPolicy           // destinations the router is willing to fetch as an exit
+	Roles            []string             // circuit positions the router accepts, empty means all
+	Bandwidth        int64                // bytes per second the router is willing to relay, 0 if unlimited
+	PowSeed          []byte               // seed of the router's handshake puzzle
+	PowDifficulty    int                  // puzzle difficulty the router demands, 0 if none
 	Token            tracing.TracingToken // tracing token
 }
 
@@ -74,6 +267,82 @@ type STorRouterJoinResponse struct {
 	Token tracing.TracingToken // tracing token
 }
 
+// Asks the coord whether it still lists the router
+type STorRouterStatusRequest struct {
+	Id    int
+	Token tracing.TracingToken // tracing token
+}
+
+type STorRouterStatusResponse struct {
+	Known bool                 // false if the coord has dropped the router and it must join again
+	Token tracing.TracingToken // tracing token
+}
+
+// Asks a bridge for what a client needs to build a circuit through it
+type STorBridgeDescriptorRequest struct {
+	Token tracing.TracingToken
+}
+
+type STorBridgeDescriptorResponse struct {
+	Router Router // the bridge's id and current onion key; its identity key is already pinned by the bridge line
+	Token  tracing.TracingToken
+}
+
+// Sent by a router after rotating its onion key
+type STorRouterOnionKeyUpdate struct {
+	Id       int
+	OnionKey []byte
+	Token    tracing.TracingToken // tracing token
+}
+
+// Sent by a router whose handshake puzzle changed
+type STorRouterAdmissionUpdate struct {
+	Id            int
+	PowSeed       []byte
+	PowDifficulty int
+	Token         tracing.TracingToken // tracing token
+}
+
+// Sent by a router that is shutting down so the coord stops handing it out
+type STorRouterLeaveRequest struct {
+	Id        int
+	PublicKey []byte               // must match the key the router joined with
+	Token     tracing.TracingToken // tracing token
+}
+
+type STorRouterLeaveResponse struct {
+	Token tracing.TracingToken // tracing token
+}
+
+// Asks another coord for its registry, as the join requests of the routers in it
+type STorCoordRegistryRequest struct {
+	Token tracing.TracingToken // tracing token
+}
+
+type STorCoordRegistryResponse struct {
+	Routers []STorRouterJoinRequest
+	Bridges []STorRouterJoinRequest
+	Token   tracing.TracingToken // tracing token
+}
+
+// Exit policy rule. Empty fields match anything.
+type ExitRule struct {
+	Action string // "accept" or "reject"
+	Host   string // host name, "*.example.com" matches any subdomain
+	CIDR   string // address range the host must resolve into, e.g. "10.0.0.0/8"
+	Ports  string // single port "80" or range "8000-8999"
+	Scheme string // "http" or "https"
+}
+
+// Rules are evaluated in order and the first match decides. Loopback,
+// link-local and RFC1918 destinations are rejected before any rule unless
+// AllowPrivate is set.
+type ExitPolicy struct {
+	Rules         []ExitRule
+	DefaultAction string // applied when no rule matches: "accept" (default) or "reject"
+	AllowPrivate  bool
+}
+
 // type STorRouterErrorMessage struct {
 // 	FailedAddr string
 // 	DidFail    bool
@@ -81,8 +350,12 @@ type STorRouterJoinResponse struct {
 // }
 
 type STorRouterReply struct {
-	Payload     []byte
-	DidSucceed  bool
-	IsWebServer bool
-	ErrMsg      string
+	Payload          []byte
+	DidSucceed       bool
+	IsWebServer      bool
+	ErrMsg           string
+	CircuitDestroyed bool     // the router no longer has the circuit, the client must build a new one
+	NextHopFailed    bool     // the router could not reach the next hop, which is why the circuit was destroyed
+	HasMore          bool     // the exit has more of the body, ask for it with ExitCommandNextChunk
+	SetCookies       []string // Set-Cookie headers of the web server's response, on the first chunk of a stream
 }
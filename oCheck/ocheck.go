@@ -19,6 +19,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -38,6 +39,7 @@ type AckMessage struct {
 	HBEatEpochNonce  uint64 // Copy of what was received in the heartbeat.
 	HBEatSeqNum      uint64 // Copy of what was received in the heartbeat.
 	HBEatNumCircuits uint64
+	HBEatCryptoQueue uint64 // public-key and onion-layer jobs waiting at the router
 }
 
 // Notification of a failure, signal back to the client using this
@@ -50,6 +52,7 @@ type FailureDetected struct {
 type RouterCircuitCount struct {
 	RouterId         int
 	ActiveChainCount int
+	CryptoQueueDepth int
 }
 
 ////////////////////////////////////////////////////// API
@@ -66,17 +69,22 @@ type StartStruct struct {
 }
 
 type OCheck struct {
+	NumOfActiveCircuits uint64 // accessed atomically, kept first for 64-bit alignment
+	cryptoQueueDepth    uint64 // accessed atomically
+	lastHeartbeat       int64  // unix nanoseconds of the last heartbeat answered, accessed atomically
 	LibraryStopped      chan bool
 	StoppedPreviously   bool
 	Mu                  sync.Mutex
 	Wg                  sync.WaitGroup
 	FailureChannel      chan FailureDetected
-	NumOfActiveCircuits uint64
+	monitorsMu          sync.Mutex
+	monitors            map[int]chan bool // routerId -> channel closed to stop heartbeating it
 }
 
 func NewOCheck() *OCheck {
 	return &OCheck{
 		StoppedPreviously: true,
+		monitors:          map[int]chan bool{},
 	}
 }
 
@@ -85,10 +93,30 @@ var maxRouterCount = 5000
 var failureChannel chan FailureDetected
 var circuitChannel chan RouterCircuitCount
 
+// Not guarded by Mu: the ack goroutine reads it while Stop holds Mu
 func (oCheck *OCheck) SetNumOfActiveCircuits(n uint64) {
-	oCheck.Mu.Lock()
-	oCheck.NumOfActiveCircuits = n
-	oCheck.Mu.Unlock()
+	atomic.StoreUint64(&oCheck.NumOfActiveCircuits, n)
+}
+
+func (oCheck *OCheck) GetNumOfActiveCircuits() uint64 {
+	return atomic.LoadUint64(&oCheck.NumOfActiveCircuits)
+}
+
+func (oCheck *OCheck) SetCryptoQueueDepth(n uint64) {
+	atomic.StoreUint64(&oCheck.cryptoQueueDepth, n)
+}
+
+func (oCheck *OCheck) GetCryptoQueueDepth() uint64 {
+	return atomic.LoadUint64(&oCheck.cryptoQueueDepth)
+}
+
+// Time the last heartbeat was answered, zero if none has arrived yet
+func (oCheck *OCheck) LastHeartbeat() time.Time {
+	nanos := atomic.LoadInt64(&oCheck.lastHeartbeat)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
 }
 
 //  TRUST KEKW
@@ -102,10 +130,27 @@ func (oCheck *OCheck) MonitorNewRouter(routerInfo RouterInfo) (notifyCh <-chan F
 	if err != nil {
 		return nil, errors.New("failed to dial udp")
 	}
-	go oCheck.handleSendingHBeats(hbConn, routerInfo.RouterId, 3, failureChannel)
+	stopCh := make(chan bool)
+	oCheck.monitorsMu.Lock()
+	if oldCh, ok := oCheck.monitors[routerInfo.RouterId]; ok {
+		close(oldCh)
+	}
+	oCheck.monitors[routerInfo.RouterId] = stopCh
+	oCheck.monitorsMu.Unlock()
+	go oCheck.handleSendingHBeats(hbConn, routerInfo.RouterId, 3, failureChannel, stopCh)
 	return failureChannel, nil
 }
 
+// Stops heartbeating a router that left on its own, without reporting a failure
+func (oCheck *OCheck) StopMonitoringRouter(routerId int) {
+	oCheck.monitorsMu.Lock()
+	defer oCheck.monitorsMu.Unlock()
+	if stopCh, ok := oCheck.monitors[routerId]; ok {
+		close(stopCh)
+		delete(oCheck.monitors, routerId)
+	}
+}
+
 // Starts the fcheck library.
 func (oCheck *OCheck) Start(arg StartStruct) (<-chan FailureDetected, <-chan RouterCircuitCount, string, error) {
 	oCheck.Mu.Lock()
@@ -193,18 +238,20 @@ outer:
 			// Maybe start a goroutine each time?
 			var hb HBeatMessage
 			decode(data, len, &hb)
+			atomic.StoreInt64(&oCheck.lastHeartbeat, time.Now().UnixNano())
 
 			ack := AckMessage{
 				HBEatSeqNum:      hb.SeqNum,
 				HBEatEpochNonce:  hb.EpochNonce,
-				HBEatNumCircuits: oCheck.NumOfActiveCircuits,
+				HBEatNumCircuits: oCheck.GetNumOfActiveCircuits(),
+				HBEatCryptoQueue: oCheck.GetCryptoQueueDepth(),
 			}
 			conn.WriteToUDP(encode(&ack), retAddr)
 		}
 	}
 }
 
-func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgThresh int, sendNotify chan<- FailureDetected) {
+func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgThresh int, sendNotify chan<- FailureDetected, stopCh <-chan bool) {
 	var seqNum uint64 = 0
 	var failedHB int = 0
 	var rtt time.Duration = 1 * time.Second
@@ -224,6 +271,8 @@ func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgTh
 		select {
 		case <-oCheck.LibraryStopped:
 			return
+		case <-stopCh:
+			return
 		case <-time.After(nextHeartBeatWaitTime):
 			hbmsg := HBeatMessage{
 				EpochNonce: epochNonce,
@@ -242,6 +291,8 @@ func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgTh
 				select {
 				case <-oCheck.LibraryStopped:
 					return
+				case <-stopCh:
+					return
 				default:
 					// What happens if we received a delayed packet??? The RTT might be wrong
 					// Handled!
@@ -255,6 +306,11 @@ func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgTh
 						}
 						failedHB++
 						if failedHB == lostMsgThresh {
+							oCheck.monitorsMu.Lock()
+							if oCheck.monitors[routerId] == stopCh {
+								delete(oCheck.monitors, routerId)
+							}
+							oCheck.monitorsMu.Unlock()
 							sendNotify <- FailureDetected{routerId, time.Now()}
 							return
 						}
@@ -263,6 +319,7 @@ func (oCheck *OCheck) handleSendingHBeats(conn *net.UDPConn, routerId, lostMsgTh
 					circuitChannel <- RouterCircuitCount{
 						RouterId:         routerId,
 						ActiveChainCount: int(ack.HBEatNumCircuits),
+						CryptoQueueDepth: int(ack.HBEatCryptoQueue),
 					}
 
 					// Is Ack we are looking for
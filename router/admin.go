@@ -0,0 +1,46 @@
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Snapshot served on the admin endpoint's /status
+type RouterStatus struct {
+	RouterId       int
+	Join           []JoinStatus // one per coord
+	ActiveCircuits int64
+	Draining       bool
+	CryptoQueue    int // jobs waiting for a crypto worker
+	HandshakeQueue int // handshakes waiting for or being worked on
+	PowDifficulty  int
+}
+
+func (r *Router) Status() RouterStatus {
+	_, difficulty := r.Admission.params()
+	return RouterStatus{
+		RouterId:       r.RouterId,
+		Join:           r.JoinStatus(),
+		ActiveCircuits: r.Circuits.Active(),
+		Draining:       r.IsDraining(),
+		CryptoQueue:    r.Crypto.queueDepth(),
+		HandshakeQueue: r.Crypto.handshakeDepth(),
+		PowDifficulty:  difficulty,
+	}
+}
+
+// Serves operator endpoints on AdminListenAddr. Nothing is served if it is not configured.
+func (r *Router) listenAdmin() {
+	if r.AdminListenAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(r.Status())
+	})
+	if err := http.ListenAndServe(r.AdminListenAddr, mux); err != nil {
+		fmt.Println("Error serving admin endpoint:", err)
+	}
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/bits"
+	"net/rpc"
+	"sync"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+const (
+	// Handshakes in progress before the router starts demanding puzzles
+	defaultPowThreshold = 8
+	// Bits demanded at the threshold, one more each time the queue doubles
+	powBaseDifficulty = 12
+	maxPowDifficulty  = 24
+	powSeedLifetime   = 10 * time.Minute
+	// Clients that got the ring before a raise still get through this long
+	powRaiseGrace         = 30 * time.Second
+	admissionCheckPeriod  = time.Second
+	powSeedBytes          = 16
+	errInsufficientPowMsg = "insufficient proof of work"
+)
+
+// Recorded when Router changes the puzzle difficulty it demands for handshakes
+type PowDifficultyChanged struct {
+	RouterId      int
+	QueueDepth    int
+	PowDifficulty int
+}
+
+// Recorded when Router turns a handshake away before decrypting it
+type HandshakeRejected struct {
+	RouterId int
+	ClientId string
+	Reason   string
+}
+
+// Handshake admission: past a threshold of handshakes queued for RSA work,
+// demands a puzzle solution with each new one
+type admissionControl struct {
+	mu               sync.Mutex
+	threshold        int
+	queueDepth       func() int // handshakes waiting for or doing RSA work
+	difficulty       int        // advertised difficulty
+	prevDifficulty   int        // advertised before the last raise
+	raisedAt         time.Time
+	seed, prevSeed   []byte
+	seedAt           time.Time
+	spent, prevSpent map[string]bool // solved circuit ids, per seed
+}
+
+func newAdmissionControl(threshold int, queueDepth func() int) *admissionControl {
+	if threshold <= 0 {
+		threshold = defaultPowThreshold
+	}
+	ac := &admissionControl{threshold: threshold, queueDepth: queueDepth, spent: map[string]bool{}}
+	ac.rotateSeed(time.Now())
+	return ac
+}
+
+// Must be called with mu held, or before ac is shared
+func (ac *admissionControl) rotateSeed(now time.Time) {
+	seed := make([]byte, powSeedBytes)
+	if _, err := rand.Read(seed); err != nil {
+		fmt.Println("Error generating puzzle seed:", err)
+		return
+	}
+	ac.prevSeed, ac.prevSpent = ac.seed, ac.spent
+	ac.seed, ac.spent = seed, map[string]bool{}
+	ac.seedAt = now
+}
+
+// Difficulty for queueDepth handshakes in progress
+func (ac *admissionControl) difficultyFor(queueDepth int) int {
+	if queueDepth < ac.threshold {
+		return 0
+	}
+	difficulty := powBaseDifficulty + bits.Len(uint(queueDepth/ac.threshold)) - 1
+	if difficulty > maxPowDifficulty {
+		difficulty = maxPowDifficulty
+	}
+	return difficulty
+}
+
+// What the directory should list for the router
+func (ac *admissionControl) params() ([]byte, int) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	return ac.seed, ac.difficulty
+}
+
+// Recomputes the advertised difficulty from the queue and rotates the seed
+// when due. Returns true if the directory needs updating.
+func (ac *admissionControl) update(now time.Time) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	changed := false
+	if now.Sub(ac.seedAt) > powSeedLifetime {
+		ac.rotateSeed(now)
+		changed = true
+	}
+	if difficulty := ac.difficultyFor(ac.queueDepth()); difficulty != ac.difficulty {
+		if difficulty > ac.difficulty {
+			ac.prevDifficulty, ac.raisedAt = ac.difficulty, now
+		}
+		ac.difficulty = difficulty
+		changed = true
+	}
+	return changed
+}
+
+// Checks a handshake's puzzle solution, returning why it is turned away or
+// "" if it is admitted. Nothing here touches RSA.
+func (ac *admissionControl) admit(clientId string, nonce uint64, now time.Time) string {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	required := ac.difficulty
+	if now.Sub(ac.raisedAt) < powRaiseGrace && ac.prevDifficulty < required {
+		required = ac.prevDifficulty
+	}
+	if required > 0 {
+		switch {
+		case util.CheckPow(ac.seed, clientId, nonce, required):
+			if ac.spent[clientId] {
+				return "puzzle solution already used"
+			}
+			ac.spent[clientId] = true
+		case ac.prevSeed != nil && util.CheckPow(ac.prevSeed, clientId, nonce, required):
+			if ac.prevSpent[clientId] {
+				return "puzzle solution already used"
+			}
+			ac.prevSpent[clientId] = true
+		default:
+			return errInsufficientPowMsg
+		}
+	}
+	return ""
+}
+
+// Keeps the advertised puzzle in line with the handshake queue and publishes
+// it to the coords whenever it changes
+func (r *Router) adjustAdmission() {
+	for !r.IsDraining() {
+		time.Sleep(admissionCheckPeriod)
+		if !r.Admission.update(time.Now()) {
+			continue
+		}
+		seed, difficulty := r.Admission.params()
+		trace := r.Tracer.CreateTrace()
+		trace.RecordAction(PowDifficultyChanged{RouterId: r.RouterId, QueueDepth: r.Crypto.handshakeDepth(), PowDifficulty: difficulty})
+		if err := r.publishAdmission(seed, difficulty); err != nil {
+			fmt.Println("Error publishing puzzle difficulty:", err)
+		}
+	}
+}
+
+func (r *Router) publishAdmission(seed []byte, difficulty int) error {
+	return r.callCoords(func(coordClient *rpc.Client) error {
+		trace := r.Tracer.CreateTrace()
+		request := storprotocol.STorRouterAdmissionUpdate{
+			Id:            r.RouterId,
+			PowSeed:       seed,
+			PowDifficulty: difficulty,
+			Token:         trace.GenerateToken(),
+		}
+		var response storprotocol.STorRouterJoinResponse
+		if err := coordClient.Call("CoordRPCListener.UpdateAdmission", request, &response); err != nil {
+			return err
+		}
+		r.Tracer.ReceiveToken(response.Token)
+		return nil
+	})
+}
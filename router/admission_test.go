@@ -0,0 +1,113 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+func TestRouter_PowDifficultyScalesWithQueue(t *testing.T) {
+	queued := 3
+	ac := newAdmissionControl(4, func() int { return queued })
+	now := time.Now()
+	if reason := ac.admit("c", 0, now); reason != "" {
+		t.Fatalf("handshake below the threshold needed a puzzle: %s", reason)
+	}
+	if ac.update(now) {
+		t.Fatalf("difficulty changed below the threshold")
+	}
+	if _, difficulty := ac.params(); difficulty != 0 {
+		t.Fatalf("difficulty is %d below the threshold, want 0", difficulty)
+	}
+
+	for want, depth := range map[int]int{powBaseDifficulty: 4, powBaseDifficulty + 1: 8, powBaseDifficulty + 2: 16} {
+		if got := ac.difficultyFor(depth); got != want {
+			t.Fatalf("difficulty for %d queued handshakes is %d, want %d", depth, got, want)
+		}
+	}
+	if got := ac.difficultyFor(1 << 30); got != maxPowDifficulty {
+		t.Fatalf("difficulty is %d for a huge queue, want the cap %d", got, maxPowDifficulty)
+	}
+
+	queued = 4
+	if !ac.update(now) {
+		t.Fatalf("difficulty did not change at the threshold")
+	}
+	queued = 0
+	if !ac.update(now) {
+		t.Fatalf("difficulty was not lowered once the queue drained")
+	}
+}
+
+func TestRouter_PowRejectsBadAndReusedSolutions(t *testing.T) {
+	ac := newAdmissionControl(1, func() int { return 1 })
+	now := time.Now()
+	ac.update(now.Add(-powRaiseGrace))
+	seed, difficulty := ac.params()
+	if difficulty != powBaseDifficulty {
+		t.Fatalf("difficulty is %d, want %d", difficulty, powBaseDifficulty)
+	}
+
+	nonce := util.SolvePow(seed, "c1", difficulty)
+	bad := nonce + 1
+	for util.CheckPow(seed, "c1", bad, difficulty) {
+		bad++
+	}
+	if ac.admit("c1", bad, now) == "" {
+		t.Fatalf("handshake without a valid solution was admitted")
+	}
+	if reason := ac.admit("c1", nonce, now); reason != "" {
+		t.Fatalf("handshake with a valid solution was rejected: %s", reason)
+	}
+	if ac.admit("c1", nonce, now) == "" {
+		t.Fatalf("puzzle solution was accepted twice")
+	}
+
+	// Solutions for the seed just rotated out still count
+	ac.mu.Lock()
+	ac.rotateSeed(now)
+	ac.mu.Unlock()
+	nonce = util.SolvePow(seed, "c2", difficulty)
+	if reason := ac.admit("c2", nonce, now); reason != "" {
+		t.Fatalf("solution for the previous seed was rejected: %s", reason)
+	}
+}
+
+func TestRouter_PowRaiseGrace(t *testing.T) {
+	ac := newAdmissionControl(1, func() int { return 1 })
+	now := time.Now()
+	ac.update(now)
+	if reason := ac.admit("c1", 0, now); reason != "" {
+		t.Fatalf("handshake was rejected right after the puzzle was first demanded: %s", reason)
+	}
+	if ac.admit("c2", 0, now.Add(powRaiseGrace)) == "" {
+		t.Fatalf("handshake without a solution was admitted after the grace period")
+	}
+}
+
+func TestRouter_InitDemandsPowUnderLoad(t *testing.T) {
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	r.Admission.queueDepth = func() int { return r.Admission.threshold }
+	r.Admission.update(time.Now().Add(-powRaiseGrace))
+
+	var response storprotocol.STorGeneralRouterPackageResponse
+	request := initRequest(r, "c1", util.GenerateAESKey())
+	if err := rrl.Init(request, &response); err == nil || err.Error() != errInsufficientPowMsg {
+		t.Fatalf("handshake without a puzzle solution was not turned away: %v", err)
+	}
+	if _, ok := r.Circuits.Get("c1"); ok {
+		t.Fatalf("circuit was created for a rejected handshake")
+	}
+
+	seed, difficulty := r.Admission.params()
+	request.PowNonce = util.SolvePow(seed, "c1", difficulty)
+	if err := rrl.Init(request, &response); err != nil {
+		t.Fatalf("handshake with a puzzle solution was rejected: %s", err)
+	}
+	if r.Crypto.handshakeDepth() != 0 {
+		t.Fatalf("handshake was still queued after Init returned")
+	}
+}
@@ -0,0 +1,84 @@
+package router
+
+import (
+	"io"
+	"math"
+	"sync"
+	"time"
+)
+
+// Token bucket limit in bytes. Zero values mean unlimited.
+type BandwidthLimit struct {
+	RateBytes  int64 // sustained bytes per second
+	BurstBytes int64 // bytes that may be sent at once after an idle period, defaults to RateBytes
+}
+
+// Token bucket shared by everything relayed under one limit. A nil bucket
+// never blocks.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64 // negative while callers are waiting off a debt
+	last   time.Time
+	now    func() time.Time
+	sleep  func(time.Duration)
+}
+
+func newTokenBucket(limit BandwidthLimit) *tokenBucket {
+	if limit.RateBytes <= 0 {
+		return nil
+	}
+	burst := limit.BurstBytes
+	if burst <= 0 {
+		burst = limit.RateBytes
+	}
+	return &tokenBucket{
+		rate:   float64(limit.RateBytes),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+		now:    time.Now,
+		sleep:  time.Sleep,
+	}
+}
+
+// Takes n bytes from the bucket, sleeping until they have been paid for.
+// Messages larger than the burst are let through after a proportionally long wait.
+func (b *tokenBucket) Wait(n int) {
+	if b == nil || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	now := b.now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	var wait time.Duration
+	if b.tokens < 0 {
+		wait = time.Duration(-b.tokens / b.rate * float64(time.Second))
+	}
+	b.mu.Unlock()
+	if wait > 0 {
+		b.sleep(wait)
+	}
+}
+
+// Reader that throttles as it is read, so a large exit response is paced
+// while it is downloaded rather than after
+type throttledReader struct {
+	r        io.Reader
+	throttle func(int)
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	n, err := tr.r.Read(p)
+	tr.throttle(n)
+	return n, err
+}
+
+// Blocks until the circuit and the router as a whole may relay n more bytes
+func (r *Router) throttle(clientId string, n int) {
+	r.Circuits.Limiter(clientId).Wait(n)
+	r.Bandwidth.Wait(n)
+}
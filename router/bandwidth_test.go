@@ -0,0 +1,56 @@
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// Bucket on a fake clock that advances by however long the caller sleeps
+func newFakeBucket(limit BandwidthLimit) (*tokenBucket, *[]time.Duration) {
+	b := newTokenBucket(limit)
+	now := time.Unix(0, 0)
+	var slept []time.Duration
+	b.last = now
+	b.now = func() time.Time { return now }
+	b.sleep = func(d time.Duration) {
+		slept = append(slept, d)
+		now = now.Add(d)
+	}
+	return b, &slept
+}
+
+func TestRouter_TokenBucketPacesToRate(t *testing.T) {
+	b, slept := newFakeBucket(BandwidthLimit{RateBytes: 1000, BurstBytes: 500})
+
+	// The burst goes through immediately, the rest waits for the rate
+	b.Wait(500)
+	if len(*slept) != 0 {
+		t.Fatalf("burst was throttled: %v", *slept)
+	}
+	b.Wait(250)
+	b.Wait(2000)
+	if len(*slept) != 2 || (*slept)[0] != 250*time.Millisecond || (*slept)[1] != 2*time.Second {
+		t.Fatalf("expected waits of 250ms and 2s, got %v", *slept)
+	}
+}
+
+func TestRouter_UnlimitedBucketNeverWaits(t *testing.T) {
+	var b *tokenBucket = newTokenBucket(BandwidthLimit{})
+	if b != nil {
+		t.Fatalf("zero limit should give no bucket")
+	}
+	b.Wait(1 << 30)
+}
+
+func TestRouter_ThrottledReaderCountsBytes(t *testing.T) {
+	total := 0
+	reader := &throttledReader{r: bytes.NewReader(make([]byte, 10000)), throttle: func(n int) { total += n }}
+	if _, err := ioutil.ReadAll(reader); err != nil {
+		t.Fatalf("ReadAll returned an error %s", err)
+	}
+	if total != 10000 {
+		t.Fatalf("throttled %d bytes, expected 10000", total)
+	}
+}
@@ -0,0 +1,36 @@
+package router
+
+import (
+	"errors"
+
+	storprotocol "STor/interface"
+)
+
+// Recorded when a client asks Router, as a bridge, for its descriptor
+type BridgeDescriptorRequested struct {
+	RouterId int
+}
+
+// Gives a client holding the bridge's line its id, current onion key and puzzle. The
+// coord never lists bridges, so clients learn these from the bridge itself.
+func (rrl *RouterRPCListener) BridgeDescriptor(request storprotocol.STorBridgeDescriptorRequest, response *storprotocol.STorBridgeDescriptorResponse) error {
+	r := rrl.R
+	if !r.Bridge {
+		return errors.New("router is not a bridge")
+	}
+	trace := r.Tracer.ReceiveToken(request.Token)
+	trace.RecordAction(BridgeDescriptorRequested{RouterId: r.RouterId})
+	powSeed, powDifficulty := r.Admission.params()
+	*response = storprotocol.STorBridgeDescriptorResponse{
+		Router: storprotocol.Router{
+			RouterId:      r.RouterId,
+			PublicKey:     r.PublicKey,
+			OnionKey:      r.OnionPublicKey(),
+			Addr:          r.convertToPublicAddress(r.ClientListenAddr),
+			PowSeed:       powSeed,
+			PowDifficulty: powDifficulty,
+		},
+		Token: trace.GenerateToken(),
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package router
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+func TestRouter_BridgeRegistersWithBridgeAuthority(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	coordAddr := l.Addr().String()
+	l.Close()
+	fc := &fakeCoord{}
+	startFakeCoord(t, coordAddr, fc)
+
+	r := newTestRouter(t, 1)
+	r.Coords = newCoordLinks([]util.Authority{{Addr: coordAddr}})
+	r.PublicAddr = "127.0.0.1"
+	r.ClientListenAddr = "127.0.0.1:4000"
+	r.CoordListenAddr = "127.0.0.1:4001"
+	r.OCheckAddr = "127.0.0.1:4002"
+	r.Bridge = true
+	if err := r.register(r.Coords[0]); err != nil {
+		t.Fatalf("register returned an error %s", err)
+	}
+	fc.mu.Lock()
+	joins, bridgeJoins := fc.joins, fc.bridgeJoins
+	fc.mu.Unlock()
+	if joins != 0 || bridgeJoins != 1 {
+		t.Fatalf("bridge joined the directory %d times and the bridge authority %d times", joins, bridgeJoins)
+	}
+
+	var response storprotocol.STorBridgeDescriptorResponse
+	if err := (&RouterRPCListener{R: r}).BridgeDescriptor(storprotocol.STorBridgeDescriptorRequest{}, &response); err != nil {
+		t.Fatalf("BridgeDescriptor returned an error %s", err)
+	}
+	if response.Router.RouterId != 1 || !bytes.Equal(response.Router.OnionKey, r.OnionPublicKey()) || response.Router.Addr != "127.0.0.1:4000" {
+		t.Fatalf("unexpected descriptor %+v", response.Router)
+	}
+
+	// Routers in the directory do not answer as bridges
+	listed := newTestRouter(t, 2)
+	if err := (&RouterRPCListener{R: listed}).BridgeDescriptor(storprotocol.STorBridgeDescriptorRequest{}, &response); err == nil {
+		t.Fatalf("a listed router answered as a bridge")
+	}
+}
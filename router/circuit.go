@@ -0,0 +1,415 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storprotocol "STor/interface"
+)
+
+// Lifecycle of a circuit as seen by a single router
+type CircuitState int
+
+const (
+	CircuitBuilding CircuitState = iota // shared key installed, not yet used by the client
+	CircuitOpen                         // client has relayed through this hop at least once
+	CircuitClosing                      // teardown in progress, key kept only to encrypt the reply
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitBuilding:
+		return "building"
+	case CircuitOpen:
+		return "open"
+	case CircuitClosing:
+		return "closing"
+	}
+	return "unknown"
+}
+
+type Circuit struct {
+	ClientId   string
+	State      CircuitState
+	CreatedAt  time.Time
+	LastActive time.Time // refreshed whenever the client relays through the circuit
+	sk         []byte
+	prevKey    []byte // TLS key of the previous hop (the client at the guard)
+	nextAddr   string // next hop, empty until the client extends the circuit past this router
+	nextKey    []byte
+	limiter    *tokenBucket        // per-circuit bandwidth limit, nil for unlimited
+	streams    map[int]*exitStream // responses the exit is relaying, by stream id
+	flow       *circuitFlow        // circuit-level flow control window at the exit
+	replay     *replayWindow       // sequence numbers the client has used on the circuit
+	truncateBy time.Time           // freed at this time unless the client truncates it, zero if no hop has failed
+}
+
+const (
+	defaultCircuitIdleTimeout  = 5 * time.Minute
+	defaultCircuitMaxLifetime  = time.Hour
+	defaultCircuitTruncateWait = 30 * time.Second
+)
+
+type CircuitConfig struct {
+	Idle         time.Duration  // a circuit unused for this long expires, 0 for the default
+	MaxLifetime  time.Duration  // a circuit older than this expires even if busy, 0 for the default
+	TruncateWait time.Duration  // a circuit whose next hop failed expires unless truncated within this, 0 for the default
+	Notify       bool           // remember expired circuits so the client can be told on its next request
+	Bandwidth    BandwidthLimit // applied to each circuit separately
+	WindowCells  int            // cells the exit may send on a circuit before the client acknowledges them
+}
+
+// An expired circuit kept around only to tell the client it is gone
+type tombstone struct {
+	sk        []byte
+	expiredAt time.Time
+}
+
+// CircuitTable is the router's clientId -> circuit map. It is safe for
+// concurrent use by the RPC handlers and the TTL reaper.
+type CircuitTable struct {
+	active        int64 // number of circuits in the table, accessed atomically
+	mu            sync.RWMutex
+	circuits      map[string]*Circuit
+	tombstones    map[string]tombstone
+	config        CircuitConfig
+	onCountChange func(uint64) // called with the new count while the table is locked
+}
+
+func NewCircuitTable(config CircuitConfig, onCountChange func(uint64)) *CircuitTable {
+	if onCountChange == nil {
+		onCountChange = func(uint64) {}
+	}
+	if config.Idle <= 0 {
+		config.Idle = defaultCircuitIdleTimeout
+	}
+	if config.MaxLifetime <= 0 {
+		config.MaxLifetime = defaultCircuitMaxLifetime
+	}
+	if config.TruncateWait <= 0 {
+		config.TruncateWait = defaultCircuitTruncateWait
+	}
+	if config.WindowCells < storprotocol.CircuitSendmeIncrement {
+		config.WindowCells = defaultCircuitWindowCells
+	}
+	return &CircuitTable{
+		circuits:      map[string]*Circuit{},
+		tombstones:    map[string]tombstone{},
+		config:        config,
+		onCountChange: onCountChange,
+	}
+}
+
+const errNotPreviousHopMsg = "request did not come from the previous hop on the circuit"
+
+// Installs a new circuit in the building state, created over a link to the
+// peer with prevKey. An existing circuit with the same id is replaced without
+// changing the active count, but only by the peer that created it.
+func (ct *CircuitTable) Create(clientId string, sk []byte, prevKey []byte) error {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	old, exists := ct.circuits[clientId]
+	if exists {
+		if !bytes.Equal(old.prevKey, prevKey) {
+			return errors.New(errNotPreviousHopMsg)
+		}
+		old.closeStreams()
+	}
+	now := time.Now()
+	ct.circuits[clientId] = &Circuit{ClientId: clientId, State: CircuitBuilding, CreatedAt: now, LastActive: now, sk: sk, prevKey: prevKey, limiter: newTokenBucket(ct.config.Bandwidth), streams: map[int]*exitStream{}, flow: newCircuitFlow(ct.config.WindowCells), replay: newReplayWindow()}
+	delete(ct.tombstones, clientId)
+	if !exists {
+		ct.onCountChange(uint64(atomic.AddInt64(&ct.active, 1)))
+	}
+	return nil
+}
+
+// Returns an error if the circuit exists and was created over a link to a
+// peer other than the one with peerKey. Only the previous hop, or the client
+// at the guard, may use a circuit.
+func (ct *CircuitTable) CheckPreviousHop(clientId string, peerKey []byte) error {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	if circuit, ok := ct.circuits[clientId]; ok && !bytes.Equal(circuit.prevKey, peerKey) {
+		return errors.New(errNotPreviousHopMsg)
+	}
+	return nil
+}
+
+// Returns the shared key of a building or open circuit
+func (ct *CircuitTable) Key(clientId string) ([]byte, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok || circuit.State == CircuitClosing {
+		return nil, false
+	}
+	return circuit.sk, true
+}
+
+// Records a relay cell's sequence number on the circuit. Returns false if the
+// circuit is unknown or the number was used before, i.e. the cell is a replay.
+func (ct *CircuitTable) AcceptSeq(clientId string, seq uint64) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	return ok && circuit.replay.accept(seq)
+}
+
+// Returns the circuit's bandwidth limiter, nil if it is unlimited or unknown
+func (ct *CircuitTable) Limiter(clientId string) *tokenBucket {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		return circuit.limiter
+	}
+	return nil
+}
+
+// Opens stream streamId on the circuit, closing any stream with the same id.
+// Returns false if the circuit is unknown or already has the most streams.
+func (ct *CircuitTable) SetStream(clientId string, streamId int, stream *exitStream) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok {
+		stream.Close()
+		return false
+	}
+	old, exists := circuit.streams[streamId]
+	if !exists && len(circuit.streams) >= storprotocol.MaxStreamsPerCircuit {
+		stream.Close()
+		return false
+	}
+	old.Close()
+	circuit.streams[streamId] = stream
+	return true
+}
+
+// Closes stream and releases its id if it is still open on the circuit
+func (ct *CircuitTable) EndStream(clientId string, streamId int, stream *exitStream) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if circuit, ok := ct.circuits[clientId]; ok && circuit.streams[streamId] == stream {
+		delete(circuit.streams, streamId)
+	}
+	stream.Close()
+}
+
+// Returns the circuit's flow control window, nil if the circuit is unknown
+func (ct *CircuitTable) Flow(clientId string) *circuitFlow {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		return circuit.flow
+	}
+	return nil
+}
+
+// Returns the exit response being relayed on the stream, nil if there is none
+func (ct *CircuitTable) Stream(clientId string, streamId int) *exitStream {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		return circuit.streams[streamId]
+	}
+	return nil
+}
+
+// Number of streams open on the circuit
+func (ct *CircuitTable) StreamCount(clientId string) int {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		return len(circuit.streams)
+	}
+	return 0
+}
+
+func (circuit *Circuit) closeStreams() {
+	for _, stream := range circuit.streams {
+		stream.Close()
+	}
+}
+
+// Returns a copy of the circuit
+func (ct *CircuitTable) Get(clientId string) (Circuit, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok {
+		return Circuit{}, false
+	}
+	return *circuit, true
+}
+
+// Moves a building circuit to open and refreshes its idle timer. Returns
+// false if the circuit is unknown or closing.
+func (ct *CircuitTable) MarkOpen(clientId string) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok || circuit.State == CircuitClosing {
+		return false
+	}
+	circuit.State = CircuitOpen
+	circuit.LastActive = time.Now()
+	return true
+}
+
+// Records the router the circuit continues to, so a destroy can be passed on
+func (ct *CircuitTable) SetNextHop(clientId string, addr string, publicKey []byte) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		circuit.nextAddr = addr
+		circuit.nextKey = publicKey
+	}
+}
+
+// Gives the client until TruncateWait after now to truncate the circuit, after
+// a hop past this router failed. A client that has gone away leaves nothing
+// behind for longer than that.
+func (ct *CircuitTable) AwaitTruncate(clientId string, now time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		circuit.truncateBy = now.Add(ct.config.TruncateWait)
+	}
+}
+
+// Called when the client truncates the circuit, which it is keeping after all
+func (ct *CircuitTable) CancelTruncateWait(clientId string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if circuit, ok := ct.circuits[clientId]; ok {
+		circuit.truncateBy = time.Time{}
+	}
+}
+
+// Moves a circuit to closing and returns its key so the teardown reply can
+// still be encrypted. Only the first caller gets ok == true.
+func (ct *CircuitTable) BeginClose(clientId string) ([]byte, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok || circuit.State == CircuitClosing {
+		return nil, false
+	}
+	circuit.State = CircuitClosing
+	return circuit.sk, true
+}
+
+// Deletes the circuit and returns what it was. ok is false if it was not in the table.
+func (ct *CircuitTable) Take(clientId string) (Circuit, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok {
+		return Circuit{}, false
+	}
+	delete(ct.circuits, clientId)
+	circuit.closeStreams()
+	ct.onCountChange(uint64(atomic.AddInt64(&ct.active, -1)))
+	return *circuit, true
+}
+
+// Deletes the circuit. Returns false if it was not in the table.
+func (ct *CircuitTable) Remove(clientId string) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok {
+		return false
+	}
+	delete(ct.circuits, clientId)
+	circuit.closeStreams()
+	ct.onCountChange(uint64(atomic.AddInt64(&ct.active, -1)))
+	return true
+}
+
+func (ct *CircuitTable) isExpired(circuit *Circuit, now time.Time) bool {
+	return now.Sub(circuit.LastActive) > ct.config.Idle ||
+		now.Sub(circuit.CreatedAt) > ct.config.MaxLifetime ||
+		(!circuit.truncateBy.IsZero() && now.After(circuit.truncateBy))
+}
+
+// Returns the ids of circuits that have been idle or alive for too long at now
+func (ct *CircuitTable) Expired(now time.Time) []string {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	var expired []string
+	for clientId, circuit := range ct.circuits {
+		if ct.isExpired(circuit, now) {
+			expired = append(expired, clientId)
+		}
+	}
+	return expired
+}
+
+// Removes the circuit if it is still expired at now, keeping a tombstone when
+// notifications are enabled. Returns false if the circuit was refreshed or
+// removed in the meantime.
+func (ct *CircuitTable) Expire(clientId string, now time.Time) bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	circuit, ok := ct.circuits[clientId]
+	if !ok || !ct.isExpired(circuit, now) {
+		return false
+	}
+	if ct.config.Notify {
+		ct.tombstones[clientId] = tombstone{sk: circuit.sk, expiredAt: now}
+	}
+	delete(ct.circuits, clientId)
+	circuit.closeStreams()
+	ct.onCountChange(uint64(atomic.AddInt64(&ct.active, -1)))
+	return true
+}
+
+// Returns the key of an expired circuit the client has not been told about
+// yet, and forgets the circuit
+func (ct *CircuitTable) TakeTombstone(clientId string) ([]byte, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	t, ok := ct.tombstones[clientId]
+	if !ok {
+		return nil, false
+	}
+	delete(ct.tombstones, clientId)
+	return t.sk, true
+}
+
+// Drops tombstones older than the idle timeout; a client that silent has
+// certainly given up on the circuit
+func (ct *CircuitTable) PruneTombstones(now time.Time) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for clientId, t := range ct.tombstones {
+		if now.Sub(t.expiredAt) > ct.config.Idle {
+			delete(ct.tombstones, clientId)
+		}
+	}
+}
+
+// How often the reaper should look for expired circuits
+func (ct *CircuitTable) ReapInterval() time.Duration {
+	interval := ct.config.Idle / 4
+	if ct.config.TruncateWait/4 < interval {
+		interval = ct.config.TruncateWait / 4
+	}
+	if interval > time.Minute {
+		interval = time.Minute
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	return interval
+}
+
+// Number of circuits currently in the table
+func (ct *CircuitTable) Active() int64 {
+	return atomic.LoadInt64(&ct.active)
+}
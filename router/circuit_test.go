@@ -0,0 +1,241 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	ochecker "STor/oCheck"
+	"STor/util"
+)
+
+func TestRouter_CircuitLifecycle(t *testing.T) {
+	table := NewCircuitTable(CircuitConfig{}, nil)
+	table.Create("c1", []byte("key"), nil)
+
+	circuit, ok := table.Get("c1")
+	if !ok || circuit.State != CircuitBuilding {
+		t.Fatalf("new circuit should be building, got %v", circuit.State)
+	}
+	if !table.MarkOpen("c1") {
+		t.Fatalf("MarkOpen failed on a building circuit")
+	}
+	if sk, ok := table.BeginClose("c1"); !ok || string(sk) != "key" {
+		t.Fatalf("BeginClose returned '%s' %v", sk, ok)
+	}
+	if _, ok := table.Key("c1"); ok {
+		t.Fatalf("closing circuit should not hand out its key")
+	}
+	if _, ok := table.BeginClose("c1"); ok {
+		t.Fatalf("BeginClose succeeded twice")
+	}
+	if !table.Remove("c1") || table.Remove("c1") {
+		t.Fatalf("Remove should succeed exactly once")
+	}
+	if table.Active() != 0 {
+		t.Fatalf("expected 0 active circuits, got %d", table.Active())
+	}
+}
+
+func TestRouter_CircuitStreamLimit(t *testing.T) {
+	table := NewCircuitTable(CircuitConfig{}, nil)
+	table.Create("c1", util.GenerateAESKey(), nil)
+	newStream := func() *exitStream {
+		return &exitStream{flow: table.Flow("c1"), body: ioutil.NopCloser(bytes.NewReader(nil))}
+	}
+	for streamId := 0; streamId < storprotocol.MaxStreamsPerCircuit; streamId++ {
+		if !table.SetStream("c1", streamId, newStream()) {
+			t.Fatalf("stream %d was refused", streamId)
+		}
+	}
+	if table.SetStream("c1", storprotocol.MaxStreamsPerCircuit, newStream()) {
+		t.Fatalf("circuit took more than %d streams", storprotocol.MaxStreamsPerCircuit)
+	}
+	// Reusing an open stream's id replaces it
+	old := table.Stream("c1", 0)
+	if !table.SetStream("c1", 0, newStream()) || !old.closed {
+		t.Fatalf("stream 0 was not replaced")
+	}
+	table.EndStream("c1", 1, table.Stream("c1", 1))
+	if !table.SetStream("c1", storprotocol.MaxStreamsPerCircuit, newStream()) {
+		t.Fatalf("ending a stream did not free a slot")
+	}
+	if !table.Remove("c1") || table.Stream("c1", 2) != nil {
+		t.Fatalf("circuit was not removed with its streams")
+	}
+}
+
+func TestRouter_CircuitTableParallel(t *testing.T) {
+	oCheck := ochecker.NewOCheck()
+	table := NewCircuitTable(CircuitConfig{Idle: time.Minute, Notify: true}, oCheck.SetNumOfActiveCircuits)
+	const workers = 64
+	const circuitsPerWorker = 200
+
+	stop := make(chan struct{})
+	reaperDone := make(chan struct{})
+	go func() {
+		// Reaper and heartbeat reader run alongside the RPC handlers
+		defer close(reaperDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				// Everything is past the idle timeout from the reaper's point of view
+				now := time.Now().Add(2 * time.Minute)
+				for _, clientId := range table.Expired(now) {
+					table.Expire(clientId, now)
+				}
+				table.PruneTombstones(now.Add(2 * time.Minute))
+				oCheck.GetNumOfActiveCircuits()
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < circuitsPerWorker; i++ {
+				clientId := fmt.Sprintf("%d-%d", w, i)
+				table.Create(clientId, []byte(clientId), nil)
+				if sk, ok := table.Key(clientId); ok && string(sk) != clientId {
+					t.Errorf("circuit %s returned key for %s", clientId, sk)
+				}
+				table.MarkOpen(clientId)
+				if _, ok := table.BeginClose(clientId); ok {
+					table.Remove(clientId)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(stop)
+	<-reaperDone
+
+	now := time.Now().Add(2 * time.Hour)
+	for _, clientId := range table.Expired(now) {
+		table.Expire(clientId, now)
+	}
+	if table.Active() != 0 {
+		t.Fatalf("expected 0 active circuits, got %d", table.Active())
+	}
+	if n := oCheck.GetNumOfActiveCircuits(); n != 0 {
+		t.Fatalf("OCheck reports %d active circuits after all were removed", n)
+	}
+}
+
+func TestRouter_CircuitTimeouts(t *testing.T) {
+	table := NewCircuitTable(CircuitConfig{Idle: time.Minute, MaxLifetime: 10 * time.Minute}, nil)
+	table.Create("c1", []byte("key"), nil)
+	circuit, _ := table.Get("c1")
+	start := circuit.CreatedAt
+
+	if expired := table.Expired(start.Add(30 * time.Second)); len(expired) != 0 {
+		t.Fatalf("circuit expired before its idle timeout: %v", expired)
+	}
+	if expired := table.Expired(start.Add(2 * time.Minute)); len(expired) != 1 {
+		t.Fatalf("idle circuit did not expire")
+	}
+
+	// Activity slides the idle timeout but not the maximum lifetime
+	table.mu.Lock()
+	table.circuits["c1"].LastActive = start.Add(9*time.Minute + 30*time.Second)
+	table.mu.Unlock()
+	if table.Expire("c1", start.Add(9*time.Minute+45*time.Second)) {
+		t.Fatalf("recently used circuit expired")
+	}
+	if !table.Expire("c1", start.Add(10*time.Minute+time.Second)) {
+		t.Fatalf("circuit outlived its maximum lifetime")
+	}
+	if table.Active() != 0 {
+		t.Fatalf("expected 0 active circuits, got %d", table.Active())
+	}
+	if _, ok := table.TakeTombstone("c1"); ok {
+		t.Fatalf("tombstone kept with notifications disabled")
+	}
+}
+
+func TestRouter_ExpiredCircuitNotifiesClient(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.Circuits = NewCircuitTable(CircuitConfig{Idle: time.Minute, Notify: true}, r.OChecker.SetNumOfActiveCircuits)
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	r.expireCircuits(time.Now().Add(2 * time.Minute))
+	if n := r.OChecker.GetNumOfActiveCircuits(); n != 0 {
+		t.Fatalf("OCheck reports %d active circuits after expiry", n)
+	}
+
+	request := storprotocol.STorOnionMessage{ClientId: "c1", Onion: util.EncodeAndEncryptAES(sk, storprotocol.STorEncryptedRouterRequest{})}
+	var response storprotocol.STorRouterHTTPResponse
+	if err := rrl.Send(request, &response); err != nil {
+		t.Fatalf("Send on an expired circuit returned an error %s", err)
+	}
+	var reply storprotocol.STorRouterReply
+	util.DecodeAndDecryptAES(sk, response.Response, &reply)
+	if reply.DidSucceed || !reply.CircuitDestroyed {
+		t.Fatalf("expected a circuit destroyed reply, got %+v", reply)
+	}
+
+	// The client is only told once
+	if err := rrl.Send(request, &response); err == nil {
+		t.Fatalf("second Send on an expired circuit succeeded")
+	}
+}
+
+func TestRouter_StrangerCannotUseCircuit(t *testing.T) {
+	r := newTestRouter(t, 1)
+	_, clientKey, _ := util.GenerateRSAKeyPair()
+	_, strangerKey, _ := util.GenerateRSAKeyPair()
+	rrl := &RouterRPCListener{R: r, PeerPublicKey: util.ConvertPublicKeyToBytes(clientKey)}
+	stranger := &RouterRPCListener{R: r, PeerPublicKey: util.ConvertPublicKeyToBytes(strangerKey)}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	// A handshake from another peer must not take over the circuit
+	err := stranger.Init(initRequest(r, "c1", util.GenerateAESKey()), &initResponse)
+	if err == nil || err.Error() != errNotPreviousHopMsg {
+		t.Fatalf("stranger replaced the circuit: %v", err)
+	}
+	if key, _ := r.Circuits.Key("c1"); !bytes.Equal(key, sk) {
+		t.Fatalf("stranger's handshake changed the circuit key")
+	}
+
+	relay := storprotocol.STorGeneralRouterPackageRequest{ClientId: "c1", EncryptionType: "AES",
+		Payload: util.EncodeAndEncryptAES(sk, storprotocol.STorEncryptedRouterRequest{Seq: nextTestSeq()})}
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := stranger.Init(relay, &response); err == nil {
+		t.Fatalf("stranger extended the circuit")
+	}
+	if err := stranger.Truncate(relay, &response); err == nil {
+		t.Fatalf("stranger truncated the circuit")
+	}
+	if err := stranger.Teardown(relay, &response); err == nil {
+		t.Fatalf("stranger tore down the circuit")
+	}
+	var httpResponse storprotocol.STorRouterHTTPResponse
+	if err := stranger.Send(storprotocol.STorOnionMessage{ClientId: "c1", Onion: relay.Payload}, &httpResponse); err == nil {
+		t.Fatalf("stranger sent on the circuit")
+	}
+	if circuit, ok := r.Circuits.Get("c1"); !ok || circuit.State != CircuitBuilding {
+		t.Fatalf("stranger's requests changed the circuit")
+	}
+
+	// The peer that created the circuit may still start it again
+	if err := rrl.Init(initRequest(r, "c1", util.GenerateAESKey()), &initResponse); err != nil {
+		t.Fatalf("creating peer could not replace its circuit: %s", err)
+	}
+}
@@ -0,0 +1,105 @@
+package router
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DistributedClocks/tracing"
+
+	storprotocol "STor/interface"
+)
+
+// Recorded when Router frees a circuit because a hop on it failed
+type CircuitDestroyed struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when a destroy is received from a neighbouring hop
+type CircuitDestroyRecvd struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when Router passes a destroy on to the next hop
+type CircuitDestroyFwd struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when Router cuts a circuit back to itself after the next hop failed
+type CircuitAwaitingTruncate struct {
+	RouterId int
+	ClientId string
+}
+
+// handles the previous hop, or the client at the guard, telling us the
+// circuit is gone. Destroys only travel forwards: a hop knows its previous
+// hop by key but not by address, so failures further along reach the
+// earlier hops through the Destroyed and AwaitingTruncate flags on replies.
+func (rrl *RouterRPCListener) Destroy(request storprotocol.STorCircuitDestroyRequest, response *storprotocol.STorCircuitDestroyResponse) (err error) {
+	trace := rrl.R.Tracer.ReceiveToken(request.Token)
+	trace.RecordAction(CircuitDestroyRecvd{RouterId: rrl.R.RouterId, ClientId: request.ClientId})
+	defer rrl.R.emulateReply(&err)
+
+	if err := rrl.R.Circuits.CheckPreviousHop(request.ClientId, rrl.PeerPublicKey); err != nil {
+		return err
+	}
+	rrl.R.destroyCircuit(trace, request.ClientId, true)
+	*response = storprotocol.STorCircuitDestroyResponse{
+		Token: trace.GenerateToken(),
+	}
+	return nil
+}
+
+// Frees the circuit at this router and, if forward is set, tells the next hop
+// to do the same
+func (r *Router) destroyCircuit(trace *tracing.Trace, clientId string, forward bool) {
+	circuit, ok := r.Circuits.Take(clientId)
+	if !ok {
+		return
+	}
+	trace.RecordAction(CircuitDestroyed{RouterId: r.RouterId, ClientId: clientId})
+	if forward && circuit.nextAddr != "" {
+		r.forwardDestroy(trace, clientId, circuit.nextAddr, circuit.nextKey)
+	}
+}
+
+// Keeps the circuit only up to this router after its next hop failed, so the
+// client can truncate it here and extend past the failed hop. The reaper
+// frees it if the client does not truncate in time. nextReached is set if
+// the next hop took the request before failing and may still hold the
+// circuit, so it is told to destroy it.
+func (r *Router) awaitTruncate(trace *tracing.Trace, clientId string, nextReached bool) {
+	circuit, ok := r.Circuits.Get(clientId)
+	if !ok {
+		return
+	}
+	r.Circuits.SetNextHop(clientId, "", nil)
+	r.Circuits.AwaitTruncate(clientId, time.Now())
+	trace.RecordAction(CircuitAwaitingTruncate{RouterId: r.RouterId, ClientId: clientId})
+	if nextReached && circuit.nextAddr != "" {
+		go r.forwardDestroy(trace, clientId, circuit.nextAddr, circuit.nextKey)
+	}
+}
+
+func (r *Router) forwardDestroy(trace *tracing.Trace, clientId string, addr string, publicKey []byte) {
+	routerClient, err := r.dialRouter(addr, publicKey)
+	if err != nil {
+		fmt.Println("Unable to pass destroy on to", addr, ":", err)
+		return
+	}
+	defer routerClient.Close()
+
+	trace.RecordAction(CircuitDestroyFwd{RouterId: r.RouterId, ClientId: clientId})
+	request := storprotocol.STorCircuitDestroyRequest{
+		ClientId: clientId,
+		Token:    trace.GenerateToken(),
+	}
+	var response storprotocol.STorCircuitDestroyResponse
+	if err = routerClient.Call("RouterRPCListener.Destroy", request, &response); err != nil {
+		fmt.Println("Unable to pass destroy on to", addr, ":", err)
+		return
+	}
+	r.Tracer.ReceiveToken(response.Token)
+}
@@ -0,0 +1,257 @@
+package router
+
+import (
+	"crypto/tls"
+	"net/rpc"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Serves r's RPC handlers over TLS on a free port until stop is called
+func serveTestRouter(t *testing.T, r *Router) (addr string, stop func()) {
+	listener, err := util.ListenTLS("127.0.0.1:0", r.TLSCert)
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go r.serveConn(conn.(*tls.Conn))
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String(), func() { listener.Close() }
+}
+
+// Builds the Init request that installs sks[len(sks)-1] at the last hop,
+// relayed through the earlier hops whose keys are already installed
+func extendRequest(clientId string, sks [][]byte, hops []*Router, addrs []string) storprotocol.STorGeneralRouterPackageRequest {
+	last := len(sks) - 1
+	payload := util.EncodeAndEncryptRSA(hops[last].OnionPublicKey(), storprotocol.STorEncryptedRouterRequest{
+		ClientId: clientId,
+		Payload:  sks[last],
+	})
+	encryptionType := "RSA"
+	seq := nextTestSeq()
+	for i := last - 1; i >= 0; i-- {
+		payload = util.EncodeAndEncryptAES(sks[i], storprotocol.STorEncryptedRouterRequest{
+			ClientId:       clientId,
+			NextAddr:       addrs[i+1],
+			NextPublicKey:  hops[i+1].PublicKey,
+			EncryptionType: encryptionType,
+			Payload:        payload,
+			Seq:            seq,
+		})
+		encryptionType = "AES"
+	}
+	return storprotocol.STorGeneralRouterPackageRequest{ClientId: clientId, EncryptionType: encryptionType, Payload: payload}
+}
+
+// Starts three routers and builds a circuit through them as a client would
+func buildTestCircuit(t *testing.T, clientId string) (hops []*Router, addrs []string, stops []func(), sks [][]byte, guard *rpc.Client) {
+	for i := 0; i < 3; i++ {
+		r := newTestRouter(t, i+1)
+		addr, stop := serveTestRouter(t, r)
+		hops = append(hops, r)
+		addrs = append(addrs, addr)
+		stops = append(stops, stop)
+		sks = append(sks, util.GenerateAESKey())
+	}
+	clientKey, _, _ := util.GenerateRSAKeyPair()
+	clientCert, _ := util.NewTLSCertificate(clientKey)
+	guard, err := util.DialRPC(addrs[0], clientCert, hops[0].PublicKey)
+	if err != nil {
+		t.Fatalf("unable to dial the guard: %s", err)
+	}
+	t.Cleanup(func() { guard.Close() })
+
+	for i := range hops {
+		var response storprotocol.STorGeneralRouterPackageResponse
+		if err := guard.Call("RouterRPCListener.Init", extendRequest(clientId, sks[:i+1], hops, addrs), &response); err != nil {
+			t.Fatalf("Init through hop %d returned an error %s", i, err)
+		}
+		if response.Destroyed {
+			t.Fatalf("circuit destroyed while extending to hop %d", i)
+		}
+	}
+	return hops, addrs, stops, sks, guard
+}
+
+// Wraps httpRequest in a layer for each hop as the client's onionizeMessage does
+func testOnion(sks [][]byte, hops []*Router, addrs []string, httpRequest storprotocol.STorRouterHTTPRequest) []byte {
+	seq := nextTestSeq()
+	last := len(sks) - 1
+	onion := util.EncodeAndEncryptAES(sks[last], storprotocol.STorEncryptedRouterRequest{Payload: util.Encode(httpRequest), Seq: seq})
+	for i := last - 1; i >= 0; i-- {
+		onion = util.EncodeAndEncryptAES(sks[i], storprotocol.STorEncryptedRouterRequest{NextAddr: addrs[i+1], NextPublicKey: hops[i+1].PublicKey, Payload: onion, Seq: seq})
+	}
+	return onion
+}
+
+func TestRouter_HopFailureKeepsCircuitPrefix(t *testing.T) {
+	hops, addrs, stops, sks, guard := buildTestCircuit(t, "c1")
+	stops[2]()
+
+	onion := testOnion(sks, hops, addrs, storprotocol.STorRouterHTTPRequest{Url: "http://example.com"})
+	var response storprotocol.STorRouterHTTPResponse
+	if err := guard.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &response); err != nil {
+		t.Fatalf("Send returned an error %s", err)
+	}
+	if response.Destroyed {
+		t.Fatalf("guard destroyed the circuit instead of leaving the client to repair it")
+	}
+
+	var guardLayer, layer storprotocol.STorRouterReply
+	util.DecodeAndDecryptAES(sks[0], response.Response, &guardLayer)
+	util.DecodeAndDecryptAES(sks[1], guardLayer.Payload, &layer)
+	if layer.DidSucceed || !layer.NextHopFailed {
+		t.Fatalf("middle did not report its next hop failed, got %+v", layer)
+	}
+	if !response.AwaitingTruncate {
+		t.Fatalf("guard was not told the circuit waits for a truncate")
+	}
+	for i, r := range hops[:2] {
+		if r.Circuits.Active() != 1 {
+			t.Fatalf("hop %d dropped the circuit", i)
+		}
+	}
+	if circuit, _ := hops[1].Circuits.Get("c1"); circuit.nextAddr != "" {
+		t.Fatalf("middle still points at the failed exit %s", circuit.nextAddr)
+	}
+
+	// A client that never truncates leaves nothing behind once the wait is over
+	later := time.Now().Add(defaultCircuitTruncateWait + time.Second)
+	for i, r := range hops[:2] {
+		r.expireCircuits(later)
+		if r.Circuits.Active() != 0 {
+			t.Fatalf("hop %d still holds the circuit after the truncate wait", i)
+		}
+	}
+}
+
+func TestRouter_TruncateKeepsCircuitAfterHopFailure(t *testing.T) {
+	hops, addrs, stops, sks, guard := buildTestCircuit(t, "c1")
+	stops[2]()
+	onion := testOnion(sks, hops, addrs, storprotocol.STorRouterHTTPRequest{Url: "http://example.com"})
+	var sendResponse storprotocol.STorRouterHTTPResponse
+	if err := guard.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &sendResponse); err != nil {
+		t.Fatalf("Send returned an error %s", err)
+	}
+
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := guard.Call("RouterRPCListener.Truncate", truncateRequest("c1", sks[:2], hops, addrs), &response); err != nil {
+		t.Fatalf("Truncate returned an error %s", err)
+	}
+	later := time.Now().Add(defaultCircuitTruncateWait + time.Second)
+	for i, r := range hops[:2] {
+		r.expireCircuits(later)
+		if r.Circuits.Active() != 1 {
+			t.Fatalf("hop %d freed a circuit the client truncated", i)
+		}
+	}
+}
+
+func TestRouter_DestroyPropagatesForward(t *testing.T) {
+	hops, addrs, _, _, guard := buildTestCircuit(t, "c1")
+
+	// Only neighbours on the circuit may destroy it
+	strangerKey, _, _ := util.GenerateRSAKeyPair()
+	strangerCert, _ := util.NewTLSCertificate(strangerKey)
+	stranger, err := util.DialRPC(addrs[1], strangerCert, hops[1].PublicKey)
+	if err != nil {
+		t.Fatalf("unable to dial the middle: %s", err)
+	}
+	defer stranger.Close()
+	var response storprotocol.STorCircuitDestroyResponse
+	if err := stranger.Call("RouterRPCListener.Destroy", storprotocol.STorCircuitDestroyRequest{ClientId: "c1"}, &response); err == nil {
+		t.Fatalf("middle accepted a destroy from a stranger")
+	}
+	if hops[1].Circuits.Active() != 1 {
+		t.Fatalf("stranger's destroy freed the circuit")
+	}
+
+	// Destroys only travel forwards
+	exit, err := util.DialRPC(addrs[1], hops[2].TLSCert, hops[1].PublicKey)
+	if err != nil {
+		t.Fatalf("unable to dial the middle: %s", err)
+	}
+	defer exit.Close()
+	if err := exit.Call("RouterRPCListener.Destroy", storprotocol.STorCircuitDestroyRequest{ClientId: "c1"}, &response); err == nil {
+		t.Fatalf("middle accepted a destroy from the next hop")
+	}
+
+	if err := guard.Call("RouterRPCListener.Destroy", storprotocol.STorCircuitDestroyRequest{ClientId: "c1"}, &response); err != nil {
+		t.Fatalf("Destroy returned an error %s", err)
+	}
+	for i, r := range hops {
+		if r.Circuits.Active() != 0 {
+			t.Fatalf("hop %d still holds the circuit", i)
+		}
+	}
+}
+
+// Builds the Truncate request that ends at hop len(sks)-1
+func truncateRequest(clientId string, sks [][]byte, hops []*Router, addrs []string) storprotocol.STorGeneralRouterPackageRequest {
+	last := len(sks) - 1
+	seq := nextTestSeq()
+	payload := util.EncodeAndEncryptAES(sks[last], storprotocol.STorEncryptedRouterRequest{ClientId: clientId, Seq: seq})
+	for i := last - 1; i >= 0; i-- {
+		payload = util.EncodeAndEncryptAES(sks[i], storprotocol.STorEncryptedRouterRequest{
+			ClientId:       clientId,
+			NextAddr:       addrs[i+1],
+			NextPublicKey:  hops[i+1].PublicKey,
+			EncryptionType: "AES",
+			Payload:        payload,
+			Seq:            seq,
+		})
+	}
+	return storprotocol.STorGeneralRouterPackageRequest{ClientId: clientId, EncryptionType: "AES", Payload: payload}
+}
+
+func TestRouter_TruncateAndExtend(t *testing.T) {
+	hops, addrs, stops, sks, guard := buildTestCircuit(t, "c1")
+	stops[2]()
+
+	// Cut back to the middle; the dead exit cannot be told
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := guard.Call("RouterRPCListener.Truncate", truncateRequest("c1", sks[:2], hops, addrs), &response); err != nil {
+		t.Fatalf("Truncate returned an error %s", err)
+	}
+	var guardLayer, layer storprotocol.STorRouterReply
+	util.DecodeAndDecryptAES(sks[0], response.Payload, &guardLayer)
+	util.DecodeAndDecryptAES(sks[1], guardLayer.Payload, &layer)
+	if !guardLayer.DidSucceed || !layer.DidSucceed {
+		t.Fatalf("truncate failed: %+v %+v", guardLayer, layer)
+	}
+	if circuit, _ := hops[1].Circuits.Get("c1"); circuit.nextAddr != "" {
+		t.Fatalf("middle still points at %s after truncate", circuit.nextAddr)
+	}
+
+	// One handshake adds a replacement exit
+	replacement := newTestRouter(t, 4)
+	replacementAddr, _ := serveTestRouter(t, replacement)
+	hops[2], addrs[2], sks[2] = replacement, replacementAddr, util.GenerateAESKey()
+	if err := guard.Call("RouterRPCListener.Init", extendRequest("c1", sks, hops, addrs), &response); err != nil {
+		t.Fatalf("extending to the replacement returned an error %s", err)
+	}
+	if replacement.Circuits.Active() != 1 {
+		t.Fatalf("replacement exit did not get the circuit")
+	}
+	if circuit, _ := hops[1].Circuits.Get("c1"); circuit.nextAddr != replacementAddr {
+		t.Fatalf("middle points at %s, expected the replacement", circuit.nextAddr)
+	}
+
+	// Truncating to the guard destroys everything after it
+	if err := guard.Call("RouterRPCListener.Truncate", truncateRequest("c1", sks[:1], hops, addrs), &response); err != nil {
+		t.Fatalf("Truncate returned an error %s", err)
+	}
+	if hops[0].Circuits.Active() != 1 || hops[1].Circuits.Active() != 0 || replacement.Circuits.Active() != 0 {
+		t.Fatalf("truncate to the guard left circuits %d %d %d", hops[0].Circuits.Active(), hops[1].Circuits.Active(), replacement.Circuits.Active())
+	}
+}
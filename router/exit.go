@@ -0,0 +1,209 @@
+package router
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+// Checks an exit request against the router's exit policy. The router's own
+// public address is always refused so clients cannot reach its listeners.
+func (r *Router) exitAllowed(rawUrl string) bool {
+	allowed, err := util.ExitPolicyAllowsURL(r.ExitPolicy, rawUrl, lookupIPs)
+	if err != nil || !allowed {
+		return false
+	}
+	_, host, _, _ := util.ParseExitDestination(rawUrl)
+	ips, _ := lookupIPs(host)
+	for _, ip := range ips {
+		if r.isOwnAddress(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *Router) isOwnAddress(ip net.IP) bool {
+	return ip != nil && ip.Equal(net.ParseIP(r.PublicAddr))
+}
+
+func lookupIPs(host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	return net.LookupIP(host)
+}
+
+// Returned by the exit client when a redirect leads somewhere the exit
+// policy refuses
+var errRedirectRejected = errors.New("exit policy rejects redirect")
+
+// The policy is checked on the URL before the request, but the host could
+// resolve differently when the connection is made. The dialer re-checks the
+// address actually dialed so private and self destinations stay unreachable.
+// Redirects are checked against the whole policy like the first URL.
+func (r *Router) newExitClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if r.isOwnAddress(ip) || (!r.ExitPolicy.AllowPrivate && util.IsPrivateIP(ip)) {
+				return errors.New("exit policy rejects address " + host)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: nil,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 60 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			if !r.exitAllowed(req.URL.String()) {
+				return errRedirectRejected
+			}
+			return nil
+		},
+		// No overall timeout: the body is read a chunk at a time for as long
+		// as the client keeps pulling, and idle circuits close their streams
+	}
+}
+
+// Performs the exit request, emulating the link to the web server first.
+// header is sent as the client gave it; the client's header policy has
+// already taken out anything that identifies the user.
+func (r *Router) fetch(method string, rawUrl string, header http.Header, body []byte) (*http.Response, error) {
+	if u, err := url.Parse(rawUrl); err == nil {
+		if err = r.NetEm.Emulate(u.Host); err != nil {
+			return nil, err
+		}
+	}
+	if method == "" {
+		method = http.MethodGet
+	}
+	var bodyReader io.Reader
+	if len(body) > 0 {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, rawUrl, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	return r.exitClient.Do(req)
+}
+
+const (
+	defaultMaxExitResponseBytes = 16 << 20
+	defaultExitChunkBytes       = 256 << 10
+)
+
+var (
+	errNoExitStream      = errors.New("no response to continue")
+	errExitResponseLimit = errors.New("response exceeds exit size limit")
+	errTooManyStreams    = errors.New("too many streams on circuit")
+)
+
+// Response the exit relays to the client one chunk per request. The body is
+// read ahead only as far as the stream and circuit windows allow, so a stream
+// never holds more than its window of chunks in memory and the rest stays
+// unread on the connection to the web server until the client catches up.
+// Everything but body is guarded by flow.mu.
+type exitStream struct {
+	flow    *circuitFlow
+	body    io.ReadCloser
+	read    int64
+	window  int      // chunks the stream may still read ahead
+	cells   [][]byte // read but not yet relayed
+	reading bool     // a chunk is being read from the body
+	done    bool     // nothing more will be queued
+	err     error    // why the stream is done, io.EOF when the body is finished
+	closed  bool
+}
+
+// Stops the stream, handing the window of chunks never relayed back to the circuit
+func (s *exitStream) Close() {
+	if s == nil {
+		return
+	}
+	s.flow.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		s.flow.give(len(s.cells))
+		s.cells = nil
+	}
+	s.flow.mu.Unlock()
+	s.body.Close()
+}
+
+func (r *Router) maxExitResponseBytes() int64 {
+	if r.MaxExitResponseBytes <= 0 {
+		return defaultMaxExitResponseBytes
+	}
+	return r.MaxExitResponseBytes
+}
+
+func (r *Router) exitChunkBytes() int {
+	if r.ExitChunkBytes <= 0 {
+		return defaultExitChunkBytes
+	}
+	return r.ExitChunkBytes
+}
+
+// Makes response the exit stream streamId of the circuit, refusing it up
+// front if it announces a body over the size limit
+func (r *Router) startExitStream(clientId string, streamId int, response *http.Response) error {
+	if response.ContentLength > r.maxExitResponseBytes() {
+		response.Body.Close()
+		return errExitResponseLimit
+	}
+	flow := r.Circuits.Flow(clientId)
+	if flow == nil {
+		response.Body.Close()
+		return errNoExitStream
+	}
+	stream := &exitStream{flow: flow, body: response.Body, window: r.streamWindowCells()}
+	if !r.Circuits.SetStream(clientId, streamId, stream) {
+		return errTooManyStreams
+	}
+	go r.pumpExitStream(clientId, stream)
+	return nil
+}
+
+// Closes a stream the client no longer wants, keeping any circuit sendme it
+// carried
+func (r *Router) endExitStream(trace *tracing.Trace, clientId string, routerHttpRequest storprotocol.STorRouterHTTPRequest) {
+	trace.RecordAction(ExitStreamEnded{RouterId: r.RouterId, ClientId: clientId, StreamId: routerHttpRequest.StreamId})
+	if flow := r.Circuits.Flow(clientId); flow != nil && routerHttpRequest.CircuitSendme {
+		flow.mu.Lock()
+		flow.give(storprotocol.CircuitSendmeIncrement)
+		flow.mu.Unlock()
+	}
+	if stream := r.Circuits.Stream(clientId, routerHttpRequest.StreamId); stream != nil {
+		r.Circuits.EndStream(clientId, routerHttpRequest.StreamId, stream)
+	}
+}
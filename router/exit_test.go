@@ -0,0 +1,291 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Sends an exit request on a one-hop circuit and returns the exit's reply
+func exitRequest(t *testing.T, rrl *RouterRPCListener, sk []byte, httpRequest storprotocol.STorRouterHTTPRequest) storprotocol.STorRouterReply {
+	onion := util.EncodeAndEncryptAES(sk, storprotocol.STorEncryptedRouterRequest{Payload: util.Encode(httpRequest), Seq: nextTestSeq()})
+	var response storprotocol.STorRouterHTTPResponse
+	if err := rrl.Send(storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &response); err != nil {
+		t.Fatalf("Send returned an error %s", err)
+	}
+	var reply storprotocol.STorRouterReply
+	util.DecodeAndDecryptAES(sk, response.Response, &reply)
+	return reply
+}
+
+func TestRouter_ExitStreamsLargeBodiesInChunks(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	r := newTestRouter(t, 1)
+	r.ExitChunkBytes = 32 << 10
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	var body []byte
+	chunks := 0
+	request := storprotocol.STorRouterHTTPRequest{Url: server.URL}
+	for {
+		reply := exitRequest(t, rrl, sk, request)
+		if !reply.DidSucceed {
+			t.Fatalf("exit request failed: %s", reply.ErrMsg)
+		}
+		if len(reply.Payload) > r.ExitChunkBytes {
+			t.Fatalf("chunk of %d bytes is over the %d byte chunk size", len(reply.Payload), r.ExitChunkBytes)
+		}
+		body = append(body, reply.Payload...)
+		chunks++
+		if !reply.HasMore {
+			break
+		}
+		request = storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandNextChunk}
+	}
+	if !bytes.Equal(body, content) {
+		t.Fatalf("reassembled %d bytes, expected %d", len(body), len(content))
+	}
+	if chunks != 4 {
+		t.Fatalf("expected 4 chunks, got %d", chunks)
+	}
+	if r.Circuits.Stream("c1", 0) != nil {
+		t.Fatalf("finished stream was not released")
+	}
+}
+
+func TestRouter_WebsiteGetsNoIdentifyingHeaders(t *testing.T) {
+	// Stands in for the test website, which trusts X-Forwarded-For for the client's address
+	received := make(chan http.Header, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	}))
+	defer server.Close()
+
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	// What a browser sends the client, scrubbed as the client does before onionizing
+	browser := http.Header{
+		"Accept-Language": {"fr-CA,fr;q=0.9"},
+		"Cookie":          {"session=browser"},
+		"Referer":         {"http://localhost:8000/secret"},
+		"Sec-Ch-Ua":       {"\"Chromium\";v=\"99\""},
+		"User-Agent":      {"Mozilla/5.0 (X11; Linux x86_64) Chrome/99.0"},
+		"X-Forwarded-For": {"20.121.112.117"},
+		"X-Real-Ip":       {"20.121.112.117"},
+	}
+	header := util.HeaderPolicy{}.Apply(browser, nil)
+	if reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Url: server.URL, Header: header}); !reply.DidSucceed {
+		t.Fatalf("exit request failed: %s", reply.ErrMsg)
+	}
+
+	got := <-received
+	for _, key := range []string{"Cookie", "Referer", "Sec-Ch-Ua", "X-Forwarded-For", "X-Real-Ip"} {
+		if value := got.Get(key); value != "" {
+			t.Fatalf("website received %s: %q", key, value)
+		}
+	}
+	if got.Get("User-Agent") != util.DefaultUserAgent || got.Get("Accept-Language") != util.DefaultAcceptLanguage {
+		t.Fatalf("website received the browser's user agent or language: %v", got)
+	}
+}
+
+func TestRouter_ExitEnforcesResponseLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// Without Content-Length the limit is only hit while reading
+		if req.URL.Path != "/chunked" {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	r := newTestRouter(t, 1)
+	r.MaxExitResponseBytes = 50000
+	r.ExitChunkBytes = 16 << 10
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	if reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Url: server.URL}); reply.DidSucceed {
+		t.Fatalf("exit fetched a body announced over the limit")
+	}
+
+	request := storprotocol.STorRouterHTTPRequest{Url: server.URL + "/chunked"}
+	for i := 0; ; i++ {
+		reply := exitRequest(t, rrl, sk, request)
+		if !reply.DidSucceed {
+			if reply.ErrMsg != "Response exceeds exit size limit." {
+				t.Fatalf("unexpected error %s", reply.ErrMsg)
+			}
+			break
+		}
+		if !reply.HasMore || i > 10 {
+			t.Fatalf("exit relayed the whole body past the limit")
+		}
+		request = storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandNextChunk}
+	}
+	if r.Circuits.Stream("c1", 0) != nil {
+		t.Fatalf("stream over the limit was not released")
+	}
+}
+
+func TestRouter_StreamsMultiplexedOnCircuit(t *testing.T) {
+	pages := map[string][]byte{
+		"/a": bytes.Repeat([]byte("a"), 40000),
+		"/b": bytes.Repeat([]byte("b"), 40000),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write(pages[req.URL.Path])
+	}))
+	defer server.Close()
+
+	r := newTestRouter(t, 1)
+	r.ExitChunkBytes = 8 << 10
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	// Open three streams on the one circuit before reading any of them to the end
+	bodies := map[int][]byte{}
+	for streamId, path := range map[int]string{1: "/a", 2: "/b", 3: "/a"} {
+		reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Url: server.URL + path, StreamId: streamId})
+		if !reply.DidSucceed || !reply.HasMore {
+			t.Fatalf("stream %d: fetch failed: %s", streamId, reply.ErrMsg)
+		}
+		bodies[streamId] = reply.Payload
+	}
+	if n := r.Circuits.StreamCount("c1"); n != 3 {
+		t.Fatalf("expected 3 open streams, got %d", n)
+	}
+
+	// Ending one stream leaves the others open
+	if reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandEnd, StreamId: 3}); !reply.DidSucceed {
+		t.Fatalf("ending stream 3 failed: %s", reply.ErrMsg)
+	}
+	if reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandNextChunk, StreamId: 3}); reply.DidSucceed {
+		t.Fatalf("ended stream 3 still relays its body")
+	}
+
+	// Pull the remaining streams alternately
+	open := map[int]bool{1: true, 2: true}
+	for len(open) > 0 {
+		for streamId := range open {
+			reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandNextChunk, StreamId: streamId})
+			if !reply.DidSucceed {
+				t.Fatalf("stream %d: %s", streamId, reply.ErrMsg)
+			}
+			bodies[streamId] = append(bodies[streamId], reply.Payload...)
+			if !reply.HasMore {
+				delete(open, streamId)
+			}
+		}
+	}
+	if !bytes.Equal(bodies[1], pages["/a"]) || !bytes.Equal(bodies[2], pages["/b"]) {
+		t.Fatalf("streams were mixed up: got %d and %d bytes", len(bodies[1]), len(bodies[2]))
+	}
+	if n := r.Circuits.StreamCount("c1"); n != 0 {
+		t.Fatalf("finished streams were not released, %d open", n)
+	}
+}
+
+func TestRouter_ExitPassesBackCookiesAndMethod(t *testing.T) {
+	type seen struct {
+		method string
+		body   string
+	}
+	received := make(chan seen, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- seen{method: req.Method, body: string(body)}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Method: http.MethodPost, Url: server.URL + "/login", Body: []byte("user=alice")})
+	if !reply.DidSucceed {
+		t.Fatalf("exit request failed: %s", reply.ErrMsg)
+	}
+	if got := <-received; got.method != http.MethodPost || got.body != "user=alice" {
+		t.Fatalf("web server received %s %q, expected the client's POST", got.method, got.body)
+	}
+	if len(reply.SetCookies) != 1 || !strings.HasPrefix(reply.SetCookies[0], "session=abc") {
+		t.Fatalf("exit did not pass back the cookie the web server set: %v", reply.SetCookies)
+	}
+}
+
+func TestRouter_ExitRedirectsRespectPolicy(t *testing.T) {
+	reached := false
+	rejected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		reached = true
+	}))
+	defer rejected.Close()
+	allowed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/moved":
+			http.Redirect(w, req, rejected.URL, http.StatusFound)
+		case "/":
+			http.Redirect(w, req, "/landing", http.StatusFound)
+		}
+	}))
+	defer allowed.Close()
+	rejectedPort := rejected.URL[strings.LastIndex(rejected.URL, ":")+1:]
+
+	r := newTestRouter(t, 1)
+	r.ExitPolicy.Rules = []storprotocol.ExitRule{{Action: "reject", Ports: rejectedPort}}
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	if reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Url: allowed.URL}); !reply.DidSucceed {
+		t.Fatalf("redirect within the policy was not followed: %s", reply.ErrMsg)
+	}
+	reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Url: allowed.URL + "/moved", StreamId: 1})
+	if reply.DidSucceed || reply.ErrMsg != "Exit policy rejects destination." {
+		t.Fatalf("redirect to a rejected port was not refused: %v %s", reply.DidSucceed, reply.ErrMsg)
+	}
+	if reached {
+		t.Fatalf("exit followed a redirect to a rejected port")
+	}
+}
@@ -0,0 +1,154 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	storprotocol "STor/interface"
+)
+
+const (
+	defaultCircuitWindowCells = 16
+	defaultStreamWindowCells  = 8
+)
+
+var errFlowWindowExhausted = errors.New("flow control window exhausted")
+
+// Recorded when the exit stops reading a stream because the client has not
+// acknowledged the chunks already sent
+type FlowWindowExhausted struct {
+	RouterId int
+	ClientId string
+}
+
+// Chunks the exit may still send on a circuit before the client acknowledges
+// some. Shared by every stream on the circuit; mu also guards their state.
+type circuitFlow struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	window int
+}
+
+func newCircuitFlow(window int) *circuitFlow {
+	f := &circuitFlow{window: window}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Returns n chunks to the window. Called with mu held.
+func (f *circuitFlow) give(n int) {
+	if n > 0 {
+		f.window += n
+		f.cond.Broadcast()
+	}
+}
+
+func (r *Router) streamWindowCells() int {
+	if r.StreamWindowCells < storprotocol.StreamSendmeIncrement {
+		return defaultStreamWindowCells
+	}
+	return r.StreamWindowCells
+}
+
+// Reads the body ahead of the client while both the stream and circuit
+// windows are open. Each chunk read takes one from both windows; the client
+// reopens them with sendmes as it consumes the chunks.
+func (r *Router) pumpExitStream(clientId string, stream *exitStream) {
+	f := stream.flow
+	for {
+		f.mu.Lock()
+		for !stream.closed && (stream.window == 0 || f.window == 0) {
+			f.cond.Wait()
+		}
+		if stream.closed {
+			f.mu.Unlock()
+			return
+		}
+		stream.window--
+		f.window--
+		stream.reading = true
+		f.mu.Unlock()
+
+		// Paced as it is downloaded, which also covers relaying it back
+		buf := make([]byte, r.exitChunkBytes())
+		n, err := io.ReadFull(&throttledReader{r: stream.body, throttle: func(n int) { r.throttle(clientId, n) }}, buf)
+
+		f.mu.Lock()
+		stream.reading = false
+		stream.read += int64(n)
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		if stream.read > r.maxExitResponseBytes() {
+			err = errExitResponseLimit
+		}
+		if n > 0 && err != errExitResponseLimit && !stream.closed {
+			stream.cells = append(stream.cells, buf[:n])
+		} else {
+			stream.window++
+			f.give(1)
+		}
+		if err != nil {
+			stream.done = true
+			stream.err = err
+		}
+		f.cond.Broadcast()
+		f.mu.Unlock()
+		if err != nil || stream.closed {
+			return
+		}
+	}
+}
+
+// Relays the next chunk of exit stream streamId, first reopening the windows
+// for any sendmes the client sent with the request. more is false once the
+// body is finished, at which point the stream is released.
+func (r *Router) readExitChunk(clientId string, streamId int, streamSendme bool, circuitSendme bool) (chunk []byte, more bool, err error) {
+	stream := r.Circuits.Stream(clientId, streamId)
+	if stream == nil {
+		return nil, false, errNoExitStream
+	}
+	f := stream.flow
+	f.mu.Lock()
+	if streamSendme {
+		stream.window += storprotocol.StreamSendmeIncrement
+	}
+	if circuitSendme {
+		f.window += storprotocol.CircuitSendmeIncrement
+	}
+	f.cond.Broadcast()
+	for len(stream.cells) == 0 && !stream.done && !stream.closed {
+		// Nothing queued and nothing coming until the client acknowledges
+		if !stream.reading && (stream.window == 0 || f.window == 0) {
+			f.mu.Unlock()
+			return nil, false, errFlowWindowExhausted
+		}
+		f.cond.Wait()
+	}
+	if stream.closed {
+		f.mu.Unlock()
+		return nil, false, errNoExitStream
+	}
+	if len(stream.cells) > 0 {
+		chunk = stream.cells[0]
+		stream.cells = stream.cells[1:]
+	}
+	// A failed stream reports its error on the pull after the last chunk
+	finished := stream.done && len(stream.cells) == 0
+	streamErr := stream.err
+	f.mu.Unlock()
+
+	if !finished {
+		return chunk, true, nil
+	}
+	if streamErr == io.EOF {
+		r.Circuits.EndStream(clientId, streamId, stream)
+		return chunk, false, nil
+	}
+	if chunk != nil {
+		return chunk, true, nil
+	}
+	r.Circuits.EndStream(clientId, streamId, stream)
+	return nil, false, streamErr
+}
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Body that counts how much the exit has read from the web server
+type countingBody struct {
+	r    *bytes.Reader
+	read int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	atomic.AddInt64(&b.read, int64(n))
+	return n, err
+}
+
+func (b *countingBody) Close() error { return nil }
+
+func (b *countingBody) bytesRead() int64 { return atomic.LoadInt64(&b.read) }
+
+// Starts an exit stream for a body of cells chunks on a fresh circuit
+func startTestStream(t *testing.T, r *Router, cells int) ([]byte, *countingBody) {
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := (&RouterRPCListener{R: r}).Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+	content := bytes.Repeat([]byte("x"), cells*r.ExitChunkBytes)
+	body := &countingBody{r: bytes.NewReader(content)}
+	if err := r.startExitStream("c1", 0, &http.Response{ContentLength: -1, Body: ioutil.NopCloser(body)}); err != nil {
+		t.Fatalf("startExitStream returned an error %s", err)
+	}
+	return content, body
+}
+
+// Waits for the exit to stop reading ahead and returns how much it read
+func waitForReadAhead(body *countingBody) int64 {
+	last := int64(-1)
+	for last != body.bytesRead() {
+		last = body.bytesRead()
+		time.Sleep(50 * time.Millisecond)
+	}
+	return last
+}
+
+func TestRouter_ExitReadAheadStopsAtWindow(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.ExitChunkBytes = 1 << 10
+	r.StreamWindowCells = 4
+	_, body := startTestStream(t, r, 32)
+
+	// The client has not pulled anything yet
+	if read := waitForReadAhead(body); read != int64(4*r.ExitChunkBytes) {
+		t.Fatalf("exit read %d bytes ahead, expected the stream window of %d", read, 4*r.ExitChunkBytes)
+	}
+
+	// Consuming a chunk without acknowledging it does not reopen the window
+	if _, _, err := r.readExitChunk("c1", 0, false, false); err != nil {
+		t.Fatalf("readExitChunk returned an error %s", err)
+	}
+	if read := waitForReadAhead(body); read != int64(4*r.ExitChunkBytes) {
+		t.Fatalf("exit kept reading without a sendme, read %d bytes", read)
+	}
+
+	// A stream sendme lets it read one increment more
+	if _, _, err := r.readExitChunk("c1", 0, true, false); err != nil {
+		t.Fatalf("readExitChunk returned an error %s", err)
+	}
+	if read := waitForReadAhead(body); read != int64((4+storprotocol.StreamSendmeIncrement)*r.ExitChunkBytes) {
+		t.Fatalf("exit read %d bytes after a stream sendme", read)
+	}
+}
+
+func TestRouter_CircuitWindowLimitsSlowConsumer(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.Circuits = NewCircuitTable(CircuitConfig{WindowCells: storprotocol.CircuitSendmeIncrement}, nil)
+	r.ExitChunkBytes = 1 << 10
+	r.StreamWindowCells = 64
+	_, body := startTestStream(t, r, 32)
+
+	if read := waitForReadAhead(body); read != int64(storprotocol.CircuitSendmeIncrement*r.ExitChunkBytes) {
+		t.Fatalf("exit read %d bytes ahead, expected the circuit window", read)
+	}
+
+	// A client that never acknowledges gets the window and then an error
+	for i := 0; i < storprotocol.CircuitSendmeIncrement; i++ {
+		if _, more, err := r.readExitChunk("c1", 0, false, false); err != nil || !more {
+			t.Fatalf("chunk %d: more %v, error %v", i, more, err)
+		}
+	}
+	if _, _, err := r.readExitChunk("c1", 0, false, false); err != errFlowWindowExhausted {
+		t.Fatalf("expected the window to be exhausted, got %v", err)
+	}
+}
+
+func TestRouter_SendmesRelayWholeBody(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.Circuits = NewCircuitTable(CircuitConfig{WindowCells: storprotocol.CircuitSendmeIncrement}, nil)
+	r.ExitChunkBytes = 1 << 10
+	r.StreamWindowCells = storprotocol.StreamSendmeIncrement
+	content, body := startTestStream(t, r, 50)
+
+	// Pulls as the client does, slowly, acknowledging every increment consumed
+	var relayed []byte
+	streamCells, circuitCells := 0, 0
+	streamSendme, circuitSendme := false, false
+	for {
+		chunk, more, err := r.readExitChunk("c1", 0, streamSendme, circuitSendme)
+		if err != nil {
+			t.Fatalf("readExitChunk returned an error %s after %d bytes", err, len(relayed))
+		}
+		relayed = append(relayed, chunk...)
+		if !more {
+			break
+		}
+		outstanding := body.bytesRead() - int64(len(relayed))
+		if outstanding > int64(storprotocol.StreamSendmeIncrement*r.ExitChunkBytes) {
+			t.Fatalf("exit is %d bytes ahead of the client", outstanding)
+		}
+		time.Sleep(time.Millisecond)
+
+		streamCells++
+		circuitCells++
+		streamSendme = streamCells == storprotocol.StreamSendmeIncrement
+		circuitSendme = circuitCells == storprotocol.CircuitSendmeIncrement
+		if streamSendme {
+			streamCells = 0
+		}
+		if circuitSendme {
+			circuitCells = 0
+		}
+	}
+	if !bytes.Equal(relayed, content) {
+		t.Fatalf("relayed %d bytes, expected %d", len(relayed), len(content))
+	}
+	if r.Circuits.Stream("c1", 0) != nil {
+		t.Fatalf("finished stream was not released")
+	}
+}
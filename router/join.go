@@ -0,0 +1,213 @@
+package router
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+const (
+	minJoinBackoff            = time.Second
+	maxJoinBackoff            = time.Minute
+	defaultRegistrationCheck  = 10 * time.Second
+	defaultHeartbeatTimeout   = 15 * time.Second
+	joinStateJoining          = "joining"
+	joinStateJoined           = "joined"
+	joinStateRejoining        = "rejoining"
+	joinStateCoordUnreachable = "coord unreachable"
+	joinStateLeft             = "left"
+)
+
+// Recorded when Router finds out a coord no longer lists it as it is
+type RouterDropped struct {
+	RouterId int
+	Coord    string
+	Reason   string
+}
+
+// Registration progress with one coord, reported on the admin endpoint
+type JoinStatus struct {
+	Coord         string
+	State         string
+	Attempts      int
+	LastError     string
+	LastJoined    time.Time
+	LastHeartbeat time.Time
+}
+
+type joinTracker struct {
+	mu     sync.Mutex
+	status JoinStatus
+}
+
+func (jt *joinTracker) set(update func(*JoinStatus)) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	update(&jt.status)
+}
+
+func (jt *joinTracker) get() JoinStatus {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	return jt.status
+}
+
+// A coord the router registers with. Every coord keeps its own directory,
+// so the router joins, updates and leaves each of them separately.
+type coordLink struct {
+	addr      string
+	publicKey []byte // pinned TLS public key, nil to skip verification
+	status    joinTracker
+	stale     int32 // set to 1 when an update did not reach the coord, accessed atomically
+}
+
+func newCoordLinks(authorities []util.Authority) []*coordLink {
+	links := make([]*coordLink, 0, len(authorities))
+	for _, authority := range authorities {
+		links = append(links, &coordLink{addr: authority.Addr, publicKey: authority.PublicKey})
+	}
+	return links
+}
+
+// Registration progress with every coord, in the order they are configured
+func (r *Router) JoinStatus() []JoinStatus {
+	statuses := make([]JoinStatus, 0, len(r.Coords))
+	for _, coord := range r.Coords {
+		status := coord.status.get()
+		status.Coord = coord.addr
+		status.LastHeartbeat = r.OChecker.LastHeartbeat()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+func (r *Router) dialCoord(coord *coordLink) (*rpc.Client, error) {
+	return util.DialRPC(coord.addr, r.TLSCert, coord.publicKey)
+}
+
+// Calls every coord in turn and returns the last error. A coord the call did
+// not reach is registered with again on its next check, so it does not keep
+// an out of date entry.
+func (r *Router) callCoords(call func(coordClient *rpc.Client) error) error {
+	var lastErr error
+	for _, coord := range r.Coords {
+		coordClient, err := r.dialCoord(coord)
+		if err == nil {
+			err = call(coordClient)
+			coordClient.Close()
+		}
+		if err != nil {
+			atomic.StoreInt32(&coord.stale, 1)
+			lastErr = fmt.Errorf("coord %s: %v", coord.addr, err)
+		}
+	}
+	return lastErr
+}
+
+// Joins the coord, retrying with exponential backoff until it succeeds or the
+// router starts shutting down
+func (r *Router) joinWithRetry(coord *coordLink, state string) {
+	backoff := minJoinBackoff
+	for !r.IsDraining() {
+		coord.status.set(func(s *JoinStatus) {
+			s.State = state
+			s.Attempts++
+		})
+		// Cleared first so an update that fails while joining marks it again
+		atomic.StoreInt32(&coord.stale, 0)
+		err := r.register(coord)
+		if err == nil {
+			coord.status.set(func(s *JoinStatus) {
+				s.State = joinStateJoined
+				s.LastError = ""
+				s.LastJoined = time.Now()
+			})
+			return
+		}
+		fmt.Println("Join with coord", coord.addr, "failed, retrying in", backoff, ":", err)
+		coord.status.set(func(s *JoinStatus) { s.LastError = err.Error() })
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxJoinBackoff {
+			backoff = maxJoinBackoff
+		}
+	}
+}
+
+// Joins the coord, then periodically checks that the coord still lists the
+// router and joins again if it was dropped or missed an update
+func (r *Router) maintainRegistration(coord *coordLink) {
+	r.joinWithRetry(coord, joinStateJoining)
+
+	check := r.RegistrationCheck
+	if check <= 0 {
+		check = defaultRegistrationCheck
+	}
+	heartbeatTimeout := r.HeartbeatTimeout
+	if heartbeatTimeout <= 0 {
+		heartbeatTimeout = defaultHeartbeatTimeout
+	}
+	for {
+		time.Sleep(check)
+		if r.IsDraining() {
+			coord.status.set(func(s *JoinStatus) { s.State = joinStateLeft })
+			return
+		}
+
+		// The coord stops heartbeating routers it has declared failed. Heartbeats
+		// are not told apart by coord, so this only catches every coord going
+		// quiet; a single coord dropping the router shows in its status check.
+		reason := ""
+		lastHeartbeat := r.OChecker.LastHeartbeat()
+		joinedAt := coord.status.get().LastJoined
+		if time.Since(joinedAt) > heartbeatTimeout && time.Since(lastHeartbeat) > heartbeatTimeout {
+			reason = "no heartbeats from coord"
+		}
+		known, err := r.checkRegistration(coord)
+		if err != nil {
+			coord.status.set(func(s *JoinStatus) {
+				s.State = joinStateCoordUnreachable
+				s.LastError = err.Error()
+			})
+			continue
+		}
+		if !known {
+			reason = "coord does not list router"
+		} else if atomic.LoadInt32(&coord.stale) == 1 {
+			reason = "coord missed an update"
+		} else if reason == "" {
+			coord.status.set(func(s *JoinStatus) { s.State = joinStateJoined })
+			continue
+		}
+
+		trace := r.Tracer.CreateTrace()
+		trace.RecordAction(RouterDropped{RouterId: r.RouterId, Coord: coord.addr, Reason: reason})
+		fmt.Println("Rejoining coord", coord.addr, ":", reason)
+		r.joinWithRetry(coord, joinStateRejoining)
+	}
+}
+
+// Asks the coord whether it still lists this router
+func (r *Router) checkRegistration(coord *coordLink) (bool, error) {
+	coordClient, err := r.dialCoord(coord)
+	if err != nil {
+		return false, err
+	}
+	defer coordClient.Close()
+	trace := r.Tracer.CreateTrace()
+	request := storprotocol.STorRouterStatusRequest{
+		Id:    r.RouterId,
+		Token: trace.GenerateToken(),
+	}
+	var response storprotocol.STorRouterStatusResponse
+	if err = coordClient.Call("CoordRPCListener.RouterStatus", request, &response); err != nil {
+		return false, err
+	}
+	r.Tracer.ReceiveToken(response.Token)
+	return response.Known, nil
+}
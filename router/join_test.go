@@ -0,0 +1,166 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Stands in for the coord's router-facing RPCs
+type fakeCoord struct {
+	mu          sync.Mutex
+	joins       int
+	bridgeJoins int
+	forgotten   bool // answer RouterStatus with Known = false
+	refuseKeys  bool // fail UpdateOnionKey
+}
+
+func (fc *fakeCoord) RegisterRouter(request storprotocol.STorRouterJoinRequest, response *storprotocol.STorRouterJoinResponse) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.joins++
+	fc.forgotten = false
+	return nil
+}
+
+func (fc *fakeCoord) RegisterBridge(request storprotocol.STorRouterJoinRequest, response *storprotocol.STorRouterJoinResponse) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.bridgeJoins++
+	return nil
+}
+
+func (fc *fakeCoord) RouterStatus(request storprotocol.STorRouterStatusRequest, response *storprotocol.STorRouterStatusResponse) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	response.Known = !fc.forgotten
+	return nil
+}
+
+func (fc *fakeCoord) UpdateOnionKey(request storprotocol.STorRouterOnionKeyUpdate, response *storprotocol.STorRouterJoinResponse) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if fc.refuseKeys {
+		return errors.New("unavailable")
+	}
+	return nil
+}
+
+func (fc *fakeCoord) DeregisterRouter(request storprotocol.STorRouterLeaveRequest, response *storprotocol.STorRouterLeaveResponse) error {
+	return nil
+}
+
+func (fc *fakeCoord) joinCount() int {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.joins
+}
+
+func startFakeCoord(t *testing.T, addr string, fc *fakeCoord) {
+	key, _, _ := util.GenerateRSAKeyPair()
+	cert, _ := util.NewTLSCertificate(key)
+	listener, err := util.ListenTLS(addr, cert)
+	if err != nil {
+		t.Fatalf("unable to start fake coord: %s", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	server := rpc.NewServer()
+	server.RegisterName("CoordRPCListener", fc)
+	go server.Accept(listener)
+}
+
+func TestRouter_JoinRetriesAndRejoins(t *testing.T) {
+	// Reserve an address for a coord that is not up yet
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	coordAddr := l.Addr().String()
+	l.Close()
+
+	r := newTestRouter(t, 1)
+	r.Coords = newCoordLinks([]util.Authority{{Addr: coordAddr}})
+	r.PublicAddr = "127.0.0.1"
+	r.ClientListenAddr = "127.0.0.1:1"
+	r.CoordListenAddr = "127.0.0.1:2"
+	r.OCheckAddr = "127.0.0.1:3"
+	r.RegistrationCheck = 50 * time.Millisecond
+	r.HeartbeatTimeout = time.Hour
+	defer r.Shutdown()
+
+	go r.maintainRegistration(r.Coords[0])
+	time.Sleep(1500 * time.Millisecond)
+	if status := r.JoinStatus()[0]; status.State != joinStateJoining || status.LastError == "" {
+		t.Fatalf("expected a failed join in progress, got %+v", status)
+	}
+
+	fc := &fakeCoord{}
+	startFakeCoord(t, coordAddr, fc)
+	deadline := time.Now().Add(5 * time.Second)
+	for r.JoinStatus()[0].State != joinStateJoined && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := r.JoinStatus()[0]; status.State != joinStateJoined || status.Attempts < 2 {
+		t.Fatalf("expected to join after retrying, got %+v", status)
+	}
+
+	fc.mu.Lock()
+	fc.forgotten = true
+	fc.mu.Unlock()
+	deadline = time.Now().Add(5 * time.Second)
+	for fc.joinCount() < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if fc.joinCount() < 2 {
+		t.Fatalf("router did not rejoin after the coord dropped it")
+	}
+}
+
+func TestRouter_RegistersWithEveryCoord(t *testing.T) {
+	fcs := []*fakeCoord{{}, {refuseKeys: true}}
+	var authorities []util.Authority
+	for _, fc := range fcs {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := l.Addr().String()
+		l.Close()
+		startFakeCoord(t, addr, fc)
+		authorities = append(authorities, util.Authority{Addr: addr})
+	}
+
+	r := newTestRouter(t, 1)
+	r.Coords = newCoordLinks(authorities)
+	r.PublicAddr = "127.0.0.1"
+	r.ClientListenAddr = "127.0.0.1:1"
+	r.CoordListenAddr = "127.0.0.1:2"
+	r.OCheckAddr = "127.0.0.1:3"
+	r.RegistrationCheck = 50 * time.Millisecond
+	r.HeartbeatTimeout = time.Hour
+	defer r.Shutdown()
+	for _, coord := range r.Coords {
+		go r.maintainRegistration(coord)
+	}
+	waitFor(t, "both coords to be joined", func() bool {
+		return fcs[0].joinCount() == 1 && fcs[1].joinCount() == 1
+	})
+
+	// The coord that missed the new onion key is joined again, with the key; the other is left alone
+	if err := r.publishOnionKey(); err == nil {
+		t.Fatalf("publishOnionKey hid the coord that refused the key")
+	}
+	fcs[1].mu.Lock()
+	fcs[1].refuseKeys = false
+	fcs[1].mu.Unlock()
+	waitFor(t, "the coord that missed the key to be joined again", func() bool { return fcs[1].joinCount() == 2 })
+	time.Sleep(200 * time.Millisecond)
+	if fcs[0].joinCount() != 1 || fcs[1].joinCount() != 2 {
+		t.Fatalf("coords were joined %d and %d times, want 1 and 2", fcs[0].joinCount(), fcs[1].joinCount())
+	}
+	for _, status := range r.JoinStatus() {
+		if status.State != joinStateJoined {
+			t.Fatalf("expected every coord to be joined, got %+v", r.JoinStatus())
+		}
+	}
+}
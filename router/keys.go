@@ -0,0 +1,109 @@
+package router
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/rpc"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+const (
+	defaultOnionKeyLifetime = 24 * time.Hour
+	defaultOnionKeyGrace    = time.Hour
+	errHandshakeDecryptMsg  = "unable to decrypt handshake"
+)
+
+// Recorded when Router replaces its onion key
+type OnionKeyRotated struct {
+	RouterId int
+}
+
+// Loads the long-term identity key from path, or generates a throwaway one
+// if no path is configured
+func loadIdentityKey(path string) (*rsa.PrivateKey, error) {
+	if path == "" {
+		privateKey, _, err := util.GenerateRSAKeyPair()
+		return privateKey, err
+	}
+	return util.LoadOrCreateRSAKey(path)
+}
+
+// Current onion key as published in the directory
+func (r *Router) OnionPublicKey() []byte {
+	r.onionKeyMu.RLock()
+	defer r.onionKeyMu.RUnlock()
+	return util.ConvertPublicKeyToBytes(&r.OnionKey.PublicKey)
+}
+
+// Decrypts a handshake with the current onion key, falling back to the
+// previous one while it is within its grace period
+func (r *Router) decryptHandshake(ciphertext []byte, res interface{}) error {
+	r.onionKeyMu.RLock()
+	current, previous, previousExpiry := r.OnionKey, r.PrevOnionKey, r.prevOnionKeyExpiry
+	r.onionKeyMu.RUnlock()
+
+	err := util.DecodeAndDecryptRSA(current, ciphertext, res)
+	if err != nil && previous != nil && time.Now().Before(previousExpiry) {
+		err = util.DecodeAndDecryptRSA(previous, ciphertext, res)
+	}
+	return err
+}
+
+// How long each onion key is used, and how long it is still accepted after that
+func (r *Router) onionKeySchedule() (lifetime time.Duration, grace time.Duration) {
+	lifetime, grace = r.OnionKeyLifetime, r.OnionKeyGrace
+	if lifetime <= 0 {
+		lifetime = defaultOnionKeyLifetime
+	}
+	if grace <= 0 {
+		grace = defaultOnionKeyGrace
+	}
+	return lifetime, grace
+}
+
+// Replaces the onion key on a schedule and publishes the new one to the coords
+func (r *Router) rotateOnionKeys() {
+	lifetime, grace := r.onionKeySchedule()
+	for {
+		time.Sleep(lifetime)
+		if r.IsDraining() {
+			return
+		}
+		onionKey, _, err := util.GenerateRSAKeyPair()
+		if err != nil {
+			fmt.Println("Error generating onion key:", err)
+			continue
+		}
+		r.onionKeyMu.Lock()
+		r.PrevOnionKey = r.OnionKey
+		r.prevOnionKeyExpiry = time.Now().Add(grace)
+		r.OnionKey = onionKey
+		r.onionKeyMu.Unlock()
+
+		trace := r.Tracer.CreateTrace()
+		trace.RecordAction(OnionKeyRotated{RouterId: r.RouterId})
+		if err = r.publishOnionKey(); err != nil {
+			fmt.Println("Error publishing onion key:", err)
+		}
+	}
+}
+
+func (r *Router) publishOnionKey() error {
+	return r.callCoords(func(coordClient *rpc.Client) error {
+		trace := r.Tracer.CreateTrace()
+		request := storprotocol.STorRouterOnionKeyUpdate{
+			Id:       r.RouterId,
+			OnionKey: r.OnionPublicKey(),
+			Token:    trace.GenerateToken(),
+		}
+		var response storprotocol.STorRouterJoinResponse
+		if err := coordClient.Call("CoordRPCListener.UpdateOnionKey", request, &response); err != nil {
+			return err
+		}
+		r.Tracer.ReceiveToken(response.Token)
+		return nil
+	})
+}
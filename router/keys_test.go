@@ -0,0 +1,48 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+func TestRouter_PreviousOnionKeyGracePeriod(t *testing.T) {
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	oldRequest := initRequest(r, "c1", util.GenerateAESKey())
+	oldOnionKey := r.OnionPublicKey()
+
+	newKey, _, _ := util.GenerateRSAKeyPair()
+	r.onionKeyMu.Lock()
+	r.PrevOnionKey = r.OnionKey
+	r.prevOnionKeyExpiry = time.Now().Add(time.Hour)
+	r.OnionKey = newKey
+	r.onionKeyMu.Unlock()
+
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(oldRequest, &response); err != nil {
+		t.Fatalf("handshake under the previous onion key was rejected during the grace period: %s", err)
+	}
+	if err := rrl.Init(initRequest(r, "c2", util.GenerateAESKey()), &response); err != nil {
+		t.Fatalf("handshake under the current onion key was rejected: %s", err)
+	}
+
+	r.onionKeyMu.Lock()
+	r.prevOnionKeyExpiry = time.Now().Add(-time.Second)
+	r.onionKeyMu.Unlock()
+	// A handshake the router has not seen yet, so it is refused for the key
+	// and not as a replay
+	expiredRequest := storprotocol.STorGeneralRouterPackageRequest{
+		ClientId:       "c3",
+		EncryptionType: "RSA",
+		Payload: util.EncodeAndEncryptRSA(oldOnionKey, storprotocol.STorEncryptedRouterRequest{
+			ClientId: "c3",
+			Payload:  util.GenerateAESKey(),
+		}),
+	}
+	if err := rrl.Init(expiredRequest, &response); err == nil || err.Error() != errHandshakeDecryptMsg {
+		t.Fatalf("handshake under an expired onion key was not refused as undecryptable: %v", err)
+	}
+}
@@ -0,0 +1,87 @@
+package router
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Delay and loss applied to a single link. Zero values mean no emulation.
+type LinkEmulation struct {
+	DelayMs         int     // fixed delay added to every message
+	JitterMs        int     // random extra delay on top of DelayMs
+	Distribution    string  // jitter distribution: "uniform" (default) or "normal"
+	DropProbability float64 // chance in [0, 1] that a message is dropped
+}
+
+type NetworkEmulationConfig struct {
+	LinkEmulation                          // default for every link
+	Links         map[string]LinkEmulation // overrides keyed by next hop address (router Addr or web server host)
+	Seed          int64                    // seed for reproducible runs, 0 seeds from the clock
+}
+
+var ErrDropped = errors.New("message dropped by network emulation")
+
+// Link key for replies travelling back toward the client. The previous hop's
+// address is not known to net/rpc handlers so it always uses the default.
+const upstreamLink = ""
+
+type NetworkEmulator struct {
+	config NetworkEmulationConfig
+	mu     sync.Mutex
+	rand   *rand.Rand
+	sleep  func(time.Duration)
+}
+
+func NewNetworkEmulator(config NetworkEmulationConfig) *NetworkEmulator {
+	seed := config.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &NetworkEmulator{
+		config: config,
+		rand:   rand.New(rand.NewSource(seed)),
+		sleep:  time.Sleep,
+	}
+}
+
+// Blocks for the delay configured for link and returns ErrDropped if the
+// message should be treated as lost
+func (ne *NetworkEmulator) Emulate(link string) error {
+	delay, drop := ne.sample(link)
+	if delay > 0 {
+		ne.sleep(delay)
+	}
+	if drop {
+		return ErrDropped
+	}
+	return nil
+}
+
+func (ne *NetworkEmulator) sample(link string) (time.Duration, bool) {
+	emulation, ok := ne.config.Links[link]
+	if !ok {
+		emulation = ne.config.LinkEmulation
+	}
+	if emulation == (LinkEmulation{}) {
+		return 0, false
+	}
+
+	ne.mu.Lock()
+	defer ne.mu.Unlock()
+	delay := time.Duration(emulation.DelayMs) * time.Millisecond
+	if emulation.JitterMs > 0 {
+		jitter := time.Duration(emulation.JitterMs) * time.Millisecond
+		if emulation.Distribution == "normal" {
+			delay += time.Duration(ne.rand.NormFloat64() * float64(jitter))
+		} else {
+			delay += time.Duration(ne.rand.Int63n(int64(jitter) + 1))
+		}
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	drop := emulation.DropProbability > 0 && ne.rand.Float64() < emulation.DropProbability
+	return delay, drop
+}
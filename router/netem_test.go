@@ -0,0 +1,80 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func recordSleeps(ne *NetworkEmulator) *[]time.Duration {
+	var slept []time.Duration
+	ne.sleep = func(d time.Duration) { slept = append(slept, d) }
+	return &slept
+}
+
+func TestRouter_NetEmDefaultIsNoop(t *testing.T) {
+	ne := NewNetworkEmulator(NetworkEmulationConfig{})
+	slept := recordSleeps(ne)
+	for i := 0; i < 100; i++ {
+		if err := ne.Emulate("10.0.0.1:45010"); err != nil {
+			t.Fatalf("zero config returned %v", err)
+		}
+	}
+	if len(*slept) != 0 {
+		t.Fatalf("zero config slept %d times", len(*slept))
+	}
+}
+
+func TestRouter_NetEmDelayAndJitter(t *testing.T) {
+	ne := NewNetworkEmulator(NetworkEmulationConfig{
+		LinkEmulation: LinkEmulation{DelayMs: 100, JitterMs: 50},
+		Seed:          1,
+	})
+	slept := recordSleeps(ne)
+	for i := 0; i < 100; i++ {
+		ne.Emulate(upstreamLink)
+	}
+	for _, d := range *slept {
+		if d < 100*time.Millisecond || d > 150*time.Millisecond {
+			t.Fatalf("uniform delay %v outside [100ms, 150ms]", d)
+		}
+	}
+}
+
+func TestRouter_NetEmPerLinkOverride(t *testing.T) {
+	ne := NewNetworkEmulator(NetworkEmulationConfig{
+		LinkEmulation: LinkEmulation{DelayMs: 10},
+		Links: map[string]LinkEmulation{
+			"slow:1":  {DelayMs: 500},
+			"lossy:1": {DropProbability: 1},
+		},
+		Seed: 1,
+	})
+	slept := recordSleeps(ne)
+	ne.Emulate("fast:1")
+	ne.Emulate("slow:1")
+	if (*slept)[0] != 10*time.Millisecond || (*slept)[1] != 500*time.Millisecond {
+		t.Fatalf("unexpected delays %v", *slept)
+	}
+	if err := ne.Emulate("lossy:1"); err != ErrDropped {
+		t.Fatalf("expected ErrDropped on lossy link, got %v", err)
+	}
+	if err := ne.Emulate("fast:1"); err != nil {
+		t.Fatalf("default link should not drop, got %v", err)
+	}
+}
+
+func TestRouter_NetEmDropRate(t *testing.T) {
+	ne := NewNetworkEmulator(NetworkEmulationConfig{
+		LinkEmulation: LinkEmulation{DropProbability: 0.3},
+		Seed:          42,
+	})
+	drops := 0
+	for i := 0; i < 10000; i++ {
+		if ne.Emulate(upstreamLink) == ErrDropped {
+			drops++
+		}
+	}
+	if drops < 2700 || drops > 3300 {
+		t.Fatalf("expected about 3000 drops, got %d", drops)
+	}
+}
@@ -0,0 +1,296 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+const (
+	defaultServiceLongPoll   = 30 * time.Second
+	defaultRendezvousTimeout = time.Minute
+	introQueueLen            = 16
+	rendezvousQueueLen       = 16
+	minRendezvousCookieBytes = 16
+)
+
+// Recorded when an onion service makes Router one of its introduction points
+type IntroPointEstablished struct {
+	RouterId int
+	ClientId string
+	Address  string
+}
+
+// Recorded when Router passes a client's introduction on to an onion service
+type IntroductionRelayed struct {
+	RouterId int
+	ClientId string
+	Address  string
+}
+
+// Recorded when an onion service joins a client's circuit at Router
+type RendezvousJoined struct {
+	RouterId       int
+	ClientCircuit  string
+	ServiceCircuit string
+}
+
+// An onion service's circuit to this router, and the introductions waiting for it
+type introPoint struct {
+	clientId string
+	queue    chan []byte
+}
+
+// A client circuit and the service circuit joined to it. The router only
+// sees the payloads encrypted end to end between them.
+type rendezvousPoint struct {
+	clientCircuit  string
+	serviceCircuit string
+	createdAt      time.Time
+	joined         chan struct{}
+	requests       chan rendezvousRequest
+	pending        map[uint64]chan []byte // replies the client is waiting for, guarded by serviceTable.mu
+	nextId         uint64
+}
+
+type rendezvousRequest struct {
+	id      uint64
+	payload []byte
+}
+
+// Introduction and rendezvous points the router serves for onion services
+type serviceTable struct {
+	mu              sync.Mutex
+	intros          map[string]*introPoint      // by service address
+	cookies         map[string]*rendezvousPoint // waiting for the service, by cookie
+	circuits        map[string]*rendezvousPoint // by client or service circuit
+	longPoll        time.Duration               // how long the service's "next" commands wait
+	responseTimeout time.Duration               // how long a client waits for the service
+}
+
+func newServiceTable() *serviceTable {
+	return &serviceTable{
+		intros:          map[string]*introPoint{},
+		cookies:         map[string]*rendezvousPoint{},
+		circuits:        map[string]*rendezvousPoint{},
+		longPoll:        defaultServiceLongPoll,
+		responseTimeout: defaultRendezvousTimeout,
+	}
+}
+
+func isServiceCommand(command string) bool {
+	switch command {
+	case storprotocol.ServiceCommandEstablishIntro,
+		storprotocol.ServiceCommandIntroduce,
+		storprotocol.ServiceCommandNextIntroduction,
+		storprotocol.ServiceCommandEstablishRendezvous,
+		storprotocol.ServiceCommandRendezvous,
+		storprotocol.ServiceCommandRequest,
+		storprotocol.ServiceCommandNextRequest,
+		storprotocol.ServiceCommandResponse:
+		return true
+	}
+	return false
+}
+
+// Carries out an onion service command that arrived on circuit clientId, this
+// router being its last hop. Returns the message for the client if it fails.
+func (r *Router) handleServiceCommand(trace *tracing.Trace, clientId string, command string, cell storprotocol.STorServiceCell) (storprotocol.STorServiceCell, string) {
+	st := r.Services
+	switch command {
+	case storprotocol.ServiceCommandEstablishIntro:
+		if !util.VerifyRSA(cell.PublicKey, util.EstablishIntroDigest(clientId), cell.Signature) {
+			return storprotocol.STorServiceCell{}, "Invalid onion service signature."
+		}
+		address := util.ServiceAddress(cell.PublicKey)
+		st.mu.Lock()
+		st.intros[address] = &introPoint{clientId: clientId, queue: make(chan []byte, introQueueLen)}
+		st.mu.Unlock()
+		trace.RecordAction(IntroPointEstablished{RouterId: r.RouterId, ClientId: clientId, Address: address})
+		return storprotocol.STorServiceCell{Address: address}, ""
+
+	case storprotocol.ServiceCommandIntroduce:
+		st.mu.Lock()
+		intro, ok := st.intros[cell.Address]
+		st.mu.Unlock()
+		if !ok || !r.circuitExists(intro.clientId) {
+			return storprotocol.STorServiceCell{}, "Unknown onion service."
+		}
+		select {
+		case intro.queue <- cell.Payload:
+		default:
+			return storprotocol.STorServiceCell{}, "Introduction point is busy."
+		}
+		trace.RecordAction(IntroductionRelayed{RouterId: r.RouterId, ClientId: clientId, Address: cell.Address})
+		return storprotocol.STorServiceCell{}, ""
+
+	case storprotocol.ServiceCommandNextIntroduction:
+		intro := st.introFor(clientId)
+		if intro == nil {
+			return storprotocol.STorServiceCell{}, "Not an introduction point for this circuit."
+		}
+		select {
+		case payload := <-intro.queue:
+			return storprotocol.STorServiceCell{Payload: payload}, ""
+		case <-time.After(st.longPoll):
+			return storprotocol.STorServiceCell{}, ""
+		}
+
+	case storprotocol.ServiceCommandEstablishRendezvous:
+		if len(cell.Cookie) < minRendezvousCookieBytes {
+			return storprotocol.STorServiceCell{}, "Rendezvous cookie is too short."
+		}
+		rp := &rendezvousPoint{
+			clientCircuit: clientId,
+			createdAt:     time.Now(),
+			joined:        make(chan struct{}),
+			requests:      make(chan rendezvousRequest, rendezvousQueueLen),
+			pending:       map[uint64]chan []byte{},
+		}
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		if _, taken := st.cookies[string(cell.Cookie)]; taken {
+			return storprotocol.STorServiceCell{}, "Rendezvous cookie is in use."
+		}
+		st.cookies[string(cell.Cookie)] = rp
+		st.circuits[clientId] = rp
+		return storprotocol.STorServiceCell{}, ""
+
+	case storprotocol.ServiceCommandRendezvous:
+		st.mu.Lock()
+		rp, ok := st.cookies[string(cell.Cookie)]
+		if !ok {
+			st.mu.Unlock()
+			return storprotocol.STorServiceCell{}, "Unknown rendezvous cookie."
+		}
+		delete(st.cookies, string(cell.Cookie))
+		rp.serviceCircuit = clientId
+		st.circuits[clientId] = rp
+		close(rp.joined)
+		st.mu.Unlock()
+		trace.RecordAction(RendezvousJoined{RouterId: r.RouterId, ClientCircuit: rp.clientCircuit, ServiceCircuit: clientId})
+		return storprotocol.STorServiceCell{}, ""
+
+	case storprotocol.ServiceCommandRequest:
+		return st.relayRequest(clientId, cell.Payload)
+
+	case storprotocol.ServiceCommandNextRequest:
+		rp := st.rendezvousFor(clientId)
+		if rp == nil || rp.serviceCircuit != clientId {
+			return storprotocol.STorServiceCell{}, "No rendezvous on this circuit."
+		}
+		select {
+		case request := <-rp.requests:
+			return storprotocol.STorServiceCell{RequestId: request.id, Payload: request.payload}, ""
+		case <-time.After(st.longPoll):
+			return storprotocol.STorServiceCell{}, ""
+		}
+
+	case storprotocol.ServiceCommandResponse:
+		st.mu.Lock()
+		defer st.mu.Unlock()
+		rp := st.circuits[clientId]
+		if rp == nil || rp.serviceCircuit != clientId {
+			return storprotocol.STorServiceCell{}, "No rendezvous on this circuit."
+		}
+		reply, ok := rp.pending[cell.RequestId]
+		if !ok {
+			return storprotocol.STorServiceCell{}, "No request to respond to."
+		}
+		delete(rp.pending, cell.RequestId)
+		reply <- cell.Payload
+		return storprotocol.STorServiceCell{}, ""
+	}
+	return storprotocol.STorServiceCell{}, "Unknown onion service command."
+}
+
+// Passes a client request to the joined service and waits for its reply
+func (st *serviceTable) relayRequest(clientId string, payload []byte) (storprotocol.STorServiceCell, string) {
+	rp := st.rendezvousFor(clientId)
+	if rp == nil || rp.clientCircuit != clientId {
+		return storprotocol.STorServiceCell{}, "No rendezvous on this circuit."
+	}
+	timeout := time.After(st.responseTimeout)
+	select {
+	case <-rp.joined:
+	case <-timeout:
+		return storprotocol.STorServiceCell{}, "Onion service did not join the rendezvous."
+	}
+
+	reply := make(chan []byte, 1)
+	st.mu.Lock()
+	rp.nextId++
+	id := rp.nextId
+	rp.pending[id] = reply
+	st.mu.Unlock()
+	defer func() {
+		st.mu.Lock()
+		delete(rp.pending, id)
+		st.mu.Unlock()
+	}()
+
+	select {
+	case rp.requests <- rendezvousRequest{id: id, payload: payload}:
+	case <-timeout:
+		return storprotocol.STorServiceCell{}, "Onion service did not respond."
+	}
+	select {
+	case payload := <-reply:
+		return storprotocol.STorServiceCell{RequestId: id, Payload: payload}, ""
+	case <-timeout:
+		return storprotocol.STorServiceCell{}, "Onion service did not respond."
+	}
+}
+
+func (st *serviceTable) introFor(clientId string) *introPoint {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for _, intro := range st.intros {
+		if intro.clientId == clientId {
+			return intro
+		}
+	}
+	return nil
+}
+
+func (st *serviceTable) rendezvousFor(clientId string) *rendezvousPoint {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return st.circuits[clientId]
+}
+
+func (r *Router) circuitExists(clientId string) bool {
+	_, ok := r.Circuits.Key(clientId)
+	return ok
+}
+
+// Forgets introduction and rendezvous points whose circuits are gone, and
+// rendezvous the service never joined
+func (r *Router) pruneServices(now time.Time) {
+	st := r.Services
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	for address, intro := range st.intros {
+		if !r.circuitExists(intro.clientId) {
+			delete(st.intros, address)
+		}
+	}
+	for cookie, rp := range st.cookies {
+		if now.Sub(rp.createdAt) > st.responseTimeout || !r.circuitExists(rp.clientCircuit) {
+			delete(st.cookies, cookie)
+		}
+	}
+	for clientId, rp := range st.circuits {
+		if !r.circuitExists(clientId) {
+			delete(st.circuits, clientId)
+			continue
+		}
+		if rp.serviceCircuit == "" && now.Sub(rp.createdAt) > st.responseTimeout {
+			delete(st.circuits, clientId)
+		}
+	}
+}
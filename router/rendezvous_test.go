@@ -0,0 +1,125 @@
+package router
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Sends an onion service command on a one-hop circuit and returns the reply
+func serviceRequest(t *testing.T, rrl *RouterRPCListener, clientId string, sk []byte, command string, cell storprotocol.STorServiceCell) (storprotocol.STorRouterReply, storprotocol.STorServiceCell) {
+	httpRequest := storprotocol.STorRouterHTTPRequest{Command: command, Service: cell}
+	onion := util.EncodeAndEncryptAES(sk, storprotocol.STorEncryptedRouterRequest{Payload: util.Encode(httpRequest), Seq: nextTestSeq()})
+	var response storprotocol.STorRouterHTTPResponse
+	if err := rrl.Send(storprotocol.STorOnionMessage{ClientId: clientId, Onion: onion}, &response); err != nil {
+		t.Fatalf("Send returned an error %s", err)
+	}
+	var reply storprotocol.STorRouterReply
+	util.DecodeAndDecryptAES(sk, response.Response, &reply)
+	var replyCell storprotocol.STorServiceCell
+	if reply.DidSucceed {
+		util.Decode(reply.Payload, &replyCell)
+	}
+	return reply, replyCell
+}
+
+func TestRouter_IntroductionAndRendezvous(t *testing.T) {
+	// Only the router's view is exercised: one router is both the introduction
+	// and the rendezvous point, with every circuit ending at it
+	r := newTestRouter(t, 1)
+	r.Roles = []string{storprotocol.RoleMiddle}
+	r.Services.longPoll = 100 * time.Millisecond
+	rrl := &RouterRPCListener{R: r}
+	keys := map[string][]byte{}
+	for _, clientId := range []string{"service-intro", "service-rendezvous", "client-intro", "client-rendezvous"} {
+		keys[clientId] = util.GenerateAESKey()
+		var initResponse storprotocol.STorGeneralRouterPackageResponse
+		if err := rrl.Init(initRequest(r, clientId, keys[clientId]), &initResponse); err != nil {
+			t.Fatalf("Init returned an error %s", err)
+		}
+	}
+	send := func(clientId string, command string, cell storprotocol.STorServiceCell) (storprotocol.STorRouterReply, storprotocol.STorServiceCell) {
+		return serviceRequest(t, rrl, clientId, keys[clientId], command, cell)
+	}
+
+	serviceKey, servicePublicKey, _ := util.GenerateRSAKeyPair()
+	publicKey := util.ConvertPublicKeyToBytes(servicePublicKey)
+	address := util.ServiceAddress(publicKey)
+
+	// A signature made for another circuit does not establish an introduction point
+	replayed, _ := util.SignRSA(serviceKey, util.EstablishIntroDigest("elsewhere"))
+	if reply, _ := send("service-intro", storprotocol.ServiceCommandEstablishIntro, storprotocol.STorServiceCell{PublicKey: publicKey, Signature: replayed}); reply.DidSucceed {
+		t.Fatalf("introduction point established with a replayed signature")
+	}
+	signature, _ := util.SignRSA(serviceKey, util.EstablishIntroDigest("service-intro"))
+	if reply, cell := send("service-intro", storprotocol.ServiceCommandEstablishIntro, storprotocol.STorServiceCell{PublicKey: publicKey, Signature: signature}); !reply.DidSucceed || cell.Address != address {
+		t.Fatalf("establishing the introduction point failed: %s", reply.ErrMsg)
+	}
+
+	// Nothing to hand the service yet
+	if reply, cell := send("service-intro", storprotocol.ServiceCommandNextIntroduction, storprotocol.STorServiceCell{}); !reply.DidSucceed || cell.Payload != nil {
+		t.Fatalf("expected an empty poll, got %+v, %s", cell, reply.ErrMsg)
+	}
+
+	cookie := []byte("0123456789abcdef")
+	if reply, _ := send("client-rendezvous", storprotocol.ServiceCommandEstablishRendezvous, storprotocol.STorServiceCell{Cookie: cookie}); !reply.DidSucceed {
+		t.Fatalf("establishing the rendezvous failed: %s", reply.ErrMsg)
+	}
+	if reply, _ := send("client-intro", storprotocol.ServiceCommandIntroduce, storprotocol.STorServiceCell{Address: "unknown" + storprotocol.ServiceAddressSuffix, Payload: []byte("hi")}); reply.DidSucceed {
+		t.Fatalf("introduced to an unknown service")
+	}
+	if reply, _ := send("client-intro", storprotocol.ServiceCommandIntroduce, storprotocol.STorServiceCell{Address: address, Payload: []byte("introduction")}); !reply.DidSucceed {
+		t.Fatalf("introduce failed: %s", reply.ErrMsg)
+	}
+	if reply, cell := send("service-intro", storprotocol.ServiceCommandNextIntroduction, storprotocol.STorServiceCell{}); !reply.DidSucceed || string(cell.Payload) != "introduction" {
+		t.Fatalf("service did not get the introduction: %+v, %s", cell, reply.ErrMsg)
+	}
+
+	if reply, _ := send("service-rendezvous", storprotocol.ServiceCommandRendezvous, storprotocol.STorServiceCell{Cookie: []byte("fedcba9876543210")}); reply.DidSucceed {
+		t.Fatalf("joined a rendezvous with the wrong cookie")
+	}
+	if reply, _ := send("service-rendezvous", storprotocol.ServiceCommandRendezvous, storprotocol.STorServiceCell{Cookie: cookie}); !reply.DidSucceed {
+		t.Fatalf("joining the rendezvous failed: %s", reply.ErrMsg)
+	}
+
+	// The client's request waits at the rendezvous point for the service's reply
+	type result struct {
+		reply storprotocol.STorRouterReply
+		cell  storprotocol.STorServiceCell
+	}
+	done := make(chan result)
+	go func() {
+		reply, cell := send("client-rendezvous", storprotocol.ServiceCommandRequest, storprotocol.STorServiceCell{Payload: []byte("request")})
+		done <- result{reply, cell}
+	}()
+	var request storprotocol.STorServiceCell
+	for request.Payload == nil {
+		var reply storprotocol.STorRouterReply
+		if reply, request = send("service-rendezvous", storprotocol.ServiceCommandNextRequest, storprotocol.STorServiceCell{}); !reply.DidSucceed {
+			t.Fatalf("polling for requests failed: %s", reply.ErrMsg)
+		}
+	}
+	if !bytes.Equal(request.Payload, []byte("request")) {
+		t.Fatalf("service got %q", request.Payload)
+	}
+	if reply, _ := send("client-rendezvous", storprotocol.ServiceCommandResponse, storprotocol.STorServiceCell{RequestId: request.RequestId, Payload: []byte("forged")}); reply.DidSucceed {
+		t.Fatalf("the client circuit answered its own request")
+	}
+	if reply, _ := send("service-rendezvous", storprotocol.ServiceCommandResponse, storprotocol.STorServiceCell{RequestId: request.RequestId, Payload: []byte("response")}); !reply.DidSucceed {
+		t.Fatalf("responding failed: %s", reply.ErrMsg)
+	}
+	res := <-done
+	if !res.reply.DidSucceed || string(res.cell.Payload) != "response" {
+		t.Fatalf("client got %+v, %s", res.cell, res.reply.ErrMsg)
+	}
+
+	// Introduction points go away with their circuits
+	r.Circuits.Remove("service-intro")
+	r.pruneServices(time.Now())
+	if reply, _ := send("client-intro", storprotocol.ServiceCommandIntroduce, storprotocol.STorServiceCell{Address: address, Payload: []byte("late")}); reply.DidSucceed {
+		t.Fatalf("introduced through a closed introduction circuit")
+	}
+}
@@ -0,0 +1,108 @@
+package router
+
+import (
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+const (
+	// Sequence numbers this far behind the highest seen on a circuit are
+	// refused; streams sharing a circuit can arrive out of order, but not by this much
+	replayWindowSize = 1024
+	// How often handshakes old enough to have expired are dropped
+	handshakeCachePrune = time.Minute
+	errReplayedCellMsg  = "replayed cell"
+)
+
+// Recorded when Router refuses a handshake or relay cell it has already seen
+type ReplayRejected struct {
+	RouterId int
+	ClientId string
+	Seq      uint64 // 0 for a handshake
+}
+
+// Sequence numbers already used on a circuit. The client numbers every relay
+// cell it sends on the circuit from 1 up.
+type replayWindow struct {
+	highest uint64
+	seen    map[uint64]bool
+}
+
+func newReplayWindow() *replayWindow {
+	return &replayWindow{seen: map[uint64]bool{}}
+}
+
+// Records seq and returns true, or returns false if it was used before or is
+// too far behind to tell
+func (w *replayWindow) accept(seq uint64) bool {
+	if seq == 0 || seq+replayWindowSize <= w.highest || w.seen[seq] {
+		return false
+	}
+	w.seen[seq] = true
+	if seq > w.highest {
+		w.highest = seq
+	}
+	if len(w.seen) > 2*replayWindowSize {
+		for old := range w.seen {
+			if old+replayWindowSize <= w.highest {
+				delete(w.seen, old)
+			}
+		}
+	}
+	return true
+}
+
+// Refuses a relay cell whose sequence number the circuit has already seen
+func (r *Router) acceptSeq(trace *tracing.Trace, clientId string, seq uint64) error {
+	if r.Circuits.AcceptSeq(clientId, seq) {
+		return nil
+	}
+	trace.RecordAction(ReplayRejected{RouterId: r.RouterId, ClientId: clientId, Seq: seq})
+	return errors.New(errReplayedCellMsg)
+}
+
+// Digests of the handshakes the router has decrypted. A handshake can be
+// decrypted for as long as its onion key is current or in its grace period,
+// so it is remembered that long.
+type handshakeCache struct {
+	mu        sync.Mutex
+	lifetime  time.Duration
+	seen      map[[sha256.Size]byte]time.Time
+	lastPrune time.Time
+}
+
+func newHandshakeCache(lifetime time.Duration) *handshakeCache {
+	return &handshakeCache{lifetime: lifetime, seen: map[[sha256.Size]byte]time.Time{}, lastPrune: time.Now()}
+}
+
+// Records the handshake and returns true, or returns false if it was seen before
+func (hc *handshakeCache) add(payload []byte, now time.Time) bool {
+	digest := sha256.Sum256(payload)
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+	if now.Sub(hc.lastPrune) > handshakeCachePrune {
+		for d, seenAt := range hc.seen {
+			if now.Sub(seenAt) > hc.lifetime {
+				delete(hc.seen, d)
+			}
+		}
+		hc.lastPrune = now
+	}
+	if seenAt, ok := hc.seen[digest]; ok && now.Sub(seenAt) <= hc.lifetime {
+		return false
+	}
+	hc.seen[digest] = now
+	return true
+}
+
+// Forgets a handshake that could not be decrypted, so it costs no memory
+func (hc *handshakeCache) forget(payload []byte) {
+	digest := sha256.Sum256(payload)
+	hc.mu.Lock()
+	delete(hc.seen, digest)
+	hc.mu.Unlock()
+}
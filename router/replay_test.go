@@ -0,0 +1,150 @@
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+func TestRouter_ReplayWindow(t *testing.T) {
+	w := newReplayWindow()
+	if w.accept(0) {
+		t.Fatalf("sequence number 0 was accepted")
+	}
+	for _, seq := range []uint64{5, 3, 4, 1} {
+		if !w.accept(seq) {
+			t.Fatalf("sequence number %d was refused on first use", seq)
+		}
+	}
+	if w.accept(3) {
+		t.Fatalf("sequence number 3 was accepted twice")
+	}
+	if !w.accept(5 + replayWindowSize) {
+		t.Fatalf("sequence number far ahead was refused")
+	}
+	if w.accept(2) {
+		t.Fatalf("sequence number too far behind to check was accepted")
+	}
+}
+
+func TestRouter_HandshakeCache(t *testing.T) {
+	hc := newHandshakeCache(time.Minute)
+	now := time.Now()
+	if !hc.add([]byte("h1"), now) || hc.add([]byte("h1"), now) {
+		t.Fatalf("handshake was not refused the second time")
+	}
+	hc.forget([]byte("h1"))
+	if !hc.add([]byte("h1"), now) {
+		t.Fatalf("forgotten handshake was refused")
+	}
+	if !hc.add([]byte("h1"), now.Add(2*time.Minute)) {
+		t.Fatalf("handshake was refused after its onion key expired")
+	}
+}
+
+// Decrypts one layer of a relayed payload as the router holding sk does
+func peel(sk []byte, payload []byte) storprotocol.STorEncryptedRouterRequest {
+	var layer storprotocol.STorEncryptedRouterRequest
+	util.DecodeAndDecryptAES(sk, payload, &layer)
+	return layer
+}
+
+func TestRouter_RejectsReplayedHandshakesAtEachHop(t *testing.T) {
+	hops, addrs, _, _, guard := buildTestCircuit(t, "c1")
+	sks := [][]byte{util.GenerateAESKey(), util.GenerateAESKey(), util.GenerateAESKey()}
+	var captured []storprotocol.STorGeneralRouterPackageRequest
+	for i := range hops {
+		request := extendRequest("c2", sks[:i+1], hops, addrs)
+		var response storprotocol.STorGeneralRouterPackageResponse
+		if err := guard.Call("RouterRPCListener.Init", request, &response); err != nil {
+			t.Fatalf("Init through hop %d returned an error %s", i, err)
+		}
+		captured = append(captured, request)
+	}
+
+	// Replayed to the guard, as seen on the client's link
+	for i, request := range captured {
+		var response storprotocol.STorGeneralRouterPackageResponse
+		if err := guard.Call("RouterRPCListener.Init", request, &response); err == nil || err.Error() != errReplayedCellMsg {
+			t.Fatalf("guard accepted the replayed handshake for hop %d: %v", i, err)
+		}
+	}
+
+	// Replayed straight to the middle and exit, as seen on the links between routers
+	strangerKey, _, _ := util.GenerateRSAKeyPair()
+	strangerCert, _ := util.NewTLSCertificate(strangerKey)
+	for hop := 1; hop < len(hops); hop++ {
+		layer := storprotocol.STorEncryptedRouterRequest{Payload: captured[hop].Payload}
+		for i := 0; i < hop; i++ {
+			layer = peel(sks[i], layer.Payload)
+		}
+		request := storprotocol.STorGeneralRouterPackageRequest{ClientId: "c2", EncryptionType: layer.EncryptionType, Payload: layer.Payload, PowNonce: layer.PowNonce}
+		client, err := util.DialRPC(addrs[hop], strangerCert, hops[hop].PublicKey)
+		if err != nil {
+			t.Fatalf("unable to dial hop %d: %s", hop, err)
+		}
+		var response storprotocol.STorGeneralRouterPackageResponse
+		err = client.Call("RouterRPCListener.Init", request, &response)
+		client.Close()
+		if err == nil || err.Error() != errReplayedCellMsg {
+			t.Fatalf("hop %d accepted a replayed handshake: %v", hop, err)
+		}
+		if circuit, _ := hops[hop].Circuits.Get("c2"); !bytes.Equal(circuit.sk, sks[hop]) {
+			t.Fatalf("replayed handshake changed the key at hop %d", hop)
+		}
+	}
+}
+
+func TestRouter_RejectsReplayedCellsAtEachHop(t *testing.T) {
+	var fetches int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt64(&fetches, 1)
+		w.Write([]byte("hello"))
+	}))
+	defer server.Close()
+
+	hops, addrs, _, sks, guard := buildTestCircuit(t, "c1")
+	onion := testOnion(sks, hops, addrs, storprotocol.STorRouterHTTPRequest{Url: server.URL})
+	var response storprotocol.STorRouterHTTPResponse
+	if err := guard.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &response); err != nil {
+		t.Fatalf("Send returned an error %s", err)
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Fatalf("exit fetched the page %d times, want 1", n)
+	}
+
+	if err := guard.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &response); err == nil || err.Error() != errReplayedCellMsg {
+		t.Fatalf("guard accepted a replayed onion: %v", err)
+	}
+
+	// The onion each later hop received, replayed to it directly over a link
+	// as its previous hop, the only peer it takes cells from
+	relayed := onion
+	for hop := 1; hop < len(hops); hop++ {
+		relayed = peel(sks[hop-1], relayed).Payload
+		client, err := util.DialRPC(addrs[hop], hops[hop-1].TLSCert, hops[hop].PublicKey)
+		if err != nil {
+			t.Fatalf("unable to dial hop %d: %s", hop, err)
+		}
+		err = client.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: relayed}, &response)
+		client.Close()
+		if err == nil || err.Error() != errReplayedCellMsg {
+			t.Fatalf("hop %d accepted a replayed onion: %v", hop, err)
+		}
+	}
+	if n := atomic.LoadInt64(&fetches); n != 1 {
+		t.Fatalf("replays made the exit fetch the page %d times", n)
+	}
+
+	// Fresh cells on the same circuit still go through
+	onion = testOnion(sks, hops, addrs, storprotocol.STorRouterHTTPRequest{Url: server.URL})
+	if err := guard.Call("RouterRPCListener.Send", storprotocol.STorOnionMessage{ClientId: "c1", Onion: onion}, &response); err != nil {
+		t.Fatalf("Send after the replays returned an error %s", err)
+	}
+}
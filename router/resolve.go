@@ -0,0 +1,98 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+// DNS lookups the exit performs for clients. *net.Resolver implements it.
+type ExitResolver interface {
+	LookupIP(ctx context.Context, network string, host string) ([]net.IP, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+const (
+	exitResolveTimeout = 10 * time.Second
+	exitResolveTTL     = 60
+)
+
+// Recorded when Exit Router performs a DNS lookup for the client
+type ExitResolveRequest struct {
+	RouterId  int
+	ClientId  string
+	QueryType string
+	Name      string
+}
+
+func (r *Router) resolver() ExitResolver {
+	if r.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return r.Resolver
+}
+
+// Looks up the name or address in routerHttpRequest.Url so the client never
+// has to ask its local resolver. Returns the message for the client if it
+// fails. Lookups are held to the exit policy like fetches, so clients cannot
+// use the exit to map its private network.
+func (r *Router) resolveForClient(trace *tracing.Trace, clientId string, routerHttpRequest storprotocol.STorRouterHTTPRequest) (storprotocol.STorResolveResponse, string) {
+	trace.RecordAction(ExitResolveRequest{RouterId: r.RouterId, ClientId: clientId, QueryType: routerHttpRequest.QueryType, Name: routerHttpRequest.Url})
+
+	if !r.HasRole(storprotocol.RoleExit) {
+		return storprotocol.STorResolveResponse{}, "Router does not act as an exit."
+	}
+	name := routerHttpRequest.Url
+	if !r.resolveAllowed(name, net.ParseIP(name)) {
+		return storprotocol.STorResolveResponse{}, "Exit policy rejects destination."
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exitResolveTimeout)
+	defer cancel()
+
+	var answers []string
+	var err error
+	switch routerHttpRequest.QueryType {
+	case storprotocol.ResolveA, storprotocol.ResolveAAAA:
+		network := "ip4"
+		if routerHttpRequest.QueryType == storprotocol.ResolveAAAA {
+			network = "ip6"
+		}
+		var ips []net.IP
+		ips, err = r.resolver().LookupIP(ctx, network, name)
+		for _, ip := range ips {
+			if r.resolveAllowed(name, ip) {
+				answers = append(answers, ip.String())
+			}
+		}
+		if len(ips) > 0 && len(answers) == 0 {
+			return storprotocol.STorResolveResponse{}, "Exit policy rejects destination."
+		}
+	case storprotocol.ResolvePTR:
+		if net.ParseIP(name) == nil {
+			return storprotocol.STorResolveResponse{}, "PTR lookups need an address."
+		}
+		answers, err = r.resolver().LookupAddr(ctx, name)
+	default:
+		return storprotocol.STorResolveResponse{}, "Unsupported query type."
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return storprotocol.STorResolveResponse{NotFound: true}, ""
+	}
+	if err != nil {
+		return storprotocol.STorResolveResponse{}, "Unable to resolve name."
+	}
+	return storprotocol.STorResolveResponse{Answers: answers, TTL: exitResolveTTL}, ""
+}
+
+// Whether the exit may look up or hand out name at ip (nil if not known yet)
+func (r *Router) resolveAllowed(name string, ip net.IP) bool {
+	return !r.isOwnAddress(ip) && util.ExitPolicyAllowsHost(r.ExitPolicy, name, ip)
+}
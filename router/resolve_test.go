@@ -0,0 +1,127 @@
+package router
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Answers lookups from fixed tables instead of the network
+type stubResolver struct {
+	hosts map[string][]net.IP
+	addrs map[string][]string
+}
+
+func (s stubResolver) LookupIP(ctx context.Context, network string, host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, ip := range s.hosts[host] {
+		if (network == "ip4") == (ip.To4() != nil) {
+			ips = append(ips, ip)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (s stubResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := s.addrs[addr]; ok {
+		return names, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestRouter_ExitResolvesNames(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.Resolver = stubResolver{
+		hosts: map[string][]net.IP{"example.com": {net.ParseIP("93.184.216.34"), net.ParseIP("2606:2800::1")}},
+		addrs: map[string][]string{"93.184.216.34": {"example.com."}},
+	}
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	cases := []struct {
+		queryType string
+		name      string
+		expected  storprotocol.STorResolveResponse
+	}{
+		{storprotocol.ResolveA, "example.com", storprotocol.STorResolveResponse{Answers: []string{"93.184.216.34"}, TTL: exitResolveTTL}},
+		{storprotocol.ResolveAAAA, "example.com", storprotocol.STorResolveResponse{Answers: []string{"2606:2800::1"}, TTL: exitResolveTTL}},
+		{storprotocol.ResolvePTR, "93.184.216.34", storprotocol.STorResolveResponse{Answers: []string{"example.com."}, TTL: exitResolveTTL}},
+		{storprotocol.ResolveA, "missing.example.com", storprotocol.STorResolveResponse{NotFound: true}},
+	}
+	for _, c := range cases {
+		reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandResolve, QueryType: c.queryType, Url: c.name})
+		if !reply.DidSucceed || !reply.IsWebServer {
+			t.Fatalf("%s %s failed: %s", c.queryType, c.name, reply.ErrMsg)
+		}
+		var resolved storprotocol.STorResolveResponse
+		util.Decode(reply.Payload, &resolved)
+		if !reflect.DeepEqual(resolved, c.expected) {
+			t.Fatalf("%s %s: got %+v, expected %+v", c.queryType, c.name, resolved, c.expected)
+		}
+	}
+
+	for _, request := range []storprotocol.STorRouterHTTPRequest{
+		{Command: storprotocol.ExitCommandResolve, QueryType: "MX", Url: "example.com"},
+		{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolvePTR, Url: "example.com"},
+	} {
+		if reply := exitRequest(t, rrl, sk, request); reply.DidSucceed {
+			t.Fatalf("%s %s was resolved", request.QueryType, request.Url)
+		}
+	}
+
+	// Only exits resolve names
+	r.Roles = []string{storprotocol.RoleMiddle}
+	request := storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolveA, Url: "example.com"}
+	if reply := exitRequest(t, rrl, sk, request); reply.DidSucceed {
+		t.Fatalf("a router that is not an exit resolved a name")
+	}
+}
+
+func TestRouter_ExitResolveRespectsPolicy(t *testing.T) {
+	r := newTestRouter(t, 1)
+	r.ExitPolicy = storprotocol.ExitPolicy{Rules: []storprotocol.ExitRule{{Action: "reject", Host: "*.blocked.com"}}}
+	r.Resolver = stubResolver{
+		hosts: map[string][]net.IP{
+			"intranet.example.com": {net.ParseIP("10.0.0.5")},
+			"mixed.example.com":    {net.ParseIP("93.184.216.34"), net.ParseIP("192.168.1.1")},
+			"www.blocked.com":      {net.ParseIP("93.184.216.35")},
+		},
+		addrs: map[string][]string{"10.0.0.5": {"intranet.example.com."}},
+	}
+	rrl := &RouterRPCListener{R: r}
+	sk := util.GenerateAESKey()
+	var initResponse storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &initResponse); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	for _, request := range []storprotocol.STorRouterHTTPRequest{
+		{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolveA, Url: "intranet.example.com"},
+		{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolveA, Url: "www.blocked.com"},
+		{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolveA, Url: "localhost"},
+		{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolvePTR, Url: "10.0.0.5"},
+	} {
+		if reply := exitRequest(t, rrl, sk, request); reply.DidSucceed {
+			t.Fatalf("%s %s was resolved against the exit policy", request.QueryType, request.Url)
+		}
+	}
+
+	// Private answers are dropped from an otherwise public name
+	reply := exitRequest(t, rrl, sk, storprotocol.STorRouterHTTPRequest{Command: storprotocol.ExitCommandResolve, QueryType: storprotocol.ResolveA, Url: "mixed.example.com"})
+	var resolved storprotocol.STorResolveResponse
+	util.Decode(reply.Payload, &resolved)
+	if !reply.DidSucceed || !reflect.DeepEqual(resolved.Answers, []string{"93.184.216.34"}) {
+		t.Fatalf("expected only the public address, got %+v %s", resolved, reply.ErrMsg)
+	}
+}
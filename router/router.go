@@ -2,13 +2,14 @@ package router
 
 import (
 	"crypto/rsa"
+	"crypto/tls"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/http"
 	"net/rpc"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DistributedClocks/tracing"
@@ -21,35 +22,93 @@ import (
 // ======================== PUBLIC TYPES ========================
 
 type Router struct {
-	RouterId         int
-	PrivateKey       *rsa.PrivateKey      // private asymetric key
-	PublicKey        []byte               // public asymmetric key
-	SharedKeyMap     map[string]SharedKey // clientId -> shared key map
-	ClientListenAddr string               // RPC (TCP) address to listen for Client
-	CoordListenAddr  string               // RPC (TCP) address to listen for Coord
-	CoordAddr        string               // RPC (TCP) address to dial to Coord
-	PublicAddr       string               // VM's public address
-	OCheckAddr       string               // UDP address to listen for heartbeats
-	ErrCh            chan error           // Channel for sending errors
-	OChecker         *ochecker.OCheck     // Ocheck heartbeat library
-	Tracer           *tracing.Tracer      // Tracing
-	Trace            *tracing.Trace
+	RouterId             int
+	PrivateKey           *rsa.PrivateKey         // long-term identity key
+	PublicKey            []byte                  // public identity key
+	OnionKey             *rsa.PrivateKey         // medium-term key for circuit handshakes, rotated
+	PrevOnionKey         *rsa.PrivateKey         // onion key before the last rotation
+	OnionKeyLifetime     time.Duration           // how often the onion key is rotated
+	OnionKeyGrace        time.Duration           // how long PrevOnionKey is still accepted
+	TLSCert              tls.Certificate         // certificate bound to PrivateKey, presented on every link
+	Circuits             *CircuitTable           // clientId -> circuit (shared key and state)
+	ClientListenAddr     string                  // RPC (TCP) address to listen for Client
+	CoordListenAddr      string                  // RPC (TCP) address to listen for Coord
+	Coords               []*coordLink            // coords the router registers with, each keeping its own directory
+	PublicAddr           string                  // VM's public address
+	OCheckAddr           string                  // UDP address to listen for heartbeats
+	ErrCh                chan error              // Channel for sending errors
+	OChecker             *ochecker.OCheck        // Ocheck heartbeat library
+	NetEm                *NetworkEmulator        // Injected delay and loss, no-op by default
+	Bandwidth            *tokenBucket            // limit on everything the router relays, nil for unlimited
+	BandwidthCapacity    int64                   // sustained bytes per second advertised to the coord, 0 if unlimited
+	MaxExitResponseBytes int64                   // largest body the router fetches as an exit
+	ExitChunkBytes       int                     // how much of a body is relayed per client request
+	StreamWindowCells    int                     // chunks read ahead per stream before the client acknowledges them
+	ExitPolicy           storprotocol.ExitPolicy // destinations the router fetches as an exit
+	Resolver             ExitResolver            // DNS lookups for clients' resolve requests, net.DefaultResolver if nil
+	Services             *serviceTable           // introduction and rendezvous points for onion services
+	Roles                []string                // circuit positions the router accepts, empty means all
+	Bridge               bool                    // registered with the coord's bridge authority instead of the directory
+	Transport            util.Transport          // wraps connections to ClientListenAddr, nil for plain TLS
+	Crypto               *cryptoPool             // workers for handshake and onion-layer decryption
+	Admission            *admissionControl       // puzzle demanded with handshakes under load
+	Handshakes           *handshakeCache         // handshakes already decrypted, to refuse replays
+	exitClient           *http.Client            // HTTP client for exit requests, refuses private addresses at dial time
+	ShutdownGrace        time.Duration           // how long Shutdown waits for open circuits
+	AdminListenAddr      string                  // HTTP address for the operator status endpoint
+	RegistrationCheck    time.Duration           // how often the router confirms the coord still lists it
+	HeartbeatTimeout     time.Duration           // silence from the coord after which the router joins again
+	Tracer               *tracing.Tracer         // Tracing
+	Trace                *tracing.Trace
+	onionKeyMu           sync.RWMutex // guards OnionKey, PrevOnionKey and prevOnionKeyExpiry
+	prevOnionKeyExpiry   time.Time
+	draining             int32         // set to 1 once Shutdown starts, accessed atomically
+	shutdownCh           chan struct{} // closed when Shutdown completes
 }
 
 type RouterConfig struct {
-	RouterId          int
-	ClientListenAddr  string
-	CoordListenAddr   string
-	OCheckAddr        string
-	CoordAddr         string
-	TracingServerAddr string
-	PublicAddr        string
-	Secret            []byte
-	TracingIdentity   string
+	RouterId                   int
+	ClientListenAddr           string
+	CoordListenAddr            string
+	OCheckAddr                 string
+	CoordAddr                  string
+	TracingServerAddr          string
+	PublicAddr                 string
+	Secret                     []byte
+	TracingIdentity            string
+	CoordPublicKeyFile         string
+	Coords                     []util.AuthorityConfig // every coord to register with; CoordAddr and CoordPublicKeyFile if empty
+	NetworkEmulation           NetworkEmulationConfig
+	ExitPolicy                 storprotocol.ExitPolicy
+	Roles                      []string // any of "guard", "middle", "exit"; empty takes every role
+	ShutdownGraceSeconds       int
+	IdentityKeyFile            string // PEM file with the long-term identity key (created if missing)
+	OnionKeyLifetimeMinutes    int
+	OnionKeyGraceMinutes       int
+	AdminListenAddr            string         // HTTP address for the operator status endpoint, empty disables it
+	RegistrationCheckSeconds   int            // how often the router confirms the coord still lists it
+	HeartbeatTimeoutSeconds    int            // silence from the coord after which the router joins again
+	CircuitIdleTimeoutSeconds  int            // circuits unused for this long are torn down
+	CircuitMaxLifetimeSeconds  int            // circuits older than this are torn down even if busy
+	CircuitTruncateWaitSeconds int            // circuits whose next hop failed are torn down unless truncated within this
+	NotifyExpiredCircuits      bool           // tell the client on its next request that its circuit expired
+	Bandwidth                  BandwidthLimit // total for the router, also advertised to the coord
+	CircuitBandwidth           BandwidthLimit // for each circuit
+	MaxExitResponseBytes       int64          // largest body fetched as an exit (default 16 MiB)
+	ExitChunkBytes             int            // body relayed per client request (default 256 KiB)
+	CircuitWindowCells         int            // chunks the exit sends on a circuit before the client acknowledges them
+	StreamWindowCells          int            // chunks the exit reads ahead on a stream before the client acknowledges them
+	Bridge                     bool           // unlisted first hop, reached only by clients with its bridge line
+	Transport                  string         // pluggable transport clients must use to reach a bridge, e.g. "scramble"
+	TransportSecretFile        string         // file holding the transport's hex secret (created if missing), handed to clients in the bridge line only
+	PowThreshold               int            // handshakes in progress before puzzles are demanded (default 8)
+	CryptoWorkers              int            // goroutines doing public-key and onion-layer work (default one per CPU)
+	CryptoQueue                int            // handshakes waiting for a worker before more are refused (default 64)
 }
 
 type RouterRPCListener struct {
-	R *Router
+	R             *Router
+	PeerPublicKey []byte // public key of the TLS certificate the previous hop (or client) presented
 }
 
 // ======================== TRACING STRUCTS ========================
@@ -99,9 +158,17 @@ type RouterRequestRecvd struct {
 type ExitRouterRequest struct {
 	RouterId  int
 	ClientId  string
+	StreamId  int
 	Plaintext string
 }
 
+// Recorded when the client closes a stream at the Exit Router before its body is finished
+type ExitStreamEnded struct {
+	RouterId int
+	ClientId string
+	StreamId int
+}
+
 // Recorded when a Router is relaying the response from the web server back
 type ResponseRelay struct {
 	RouterId      int
@@ -128,14 +195,38 @@ type CircuitTeardownFwd struct {
 	ClientId string
 }
 
-type SharedKey struct {
-	sk  []byte
-	TTL time.Time
+// Recorded when Router tears down a circuit that was idle or alive for too long
+type CircuitExpired struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when Router starts shutting down
+type RouterLeaving struct {
+	RouterId       int
+	ActiveCircuits int
+}
+
+// Recorded when Router has finished shutting down
+type RouterLeft struct {
+	RouterId          int
+	AbandonedCircuits int
 }
 
 func NewRouter(configPath string) *Router {
 	var config = &RouterConfig{}
 	util.ReadJSONConfig(configPath, config)
+	coords, err := util.LoadAuthorities(config.CoordAddr, config.CoordPublicKeyFile, config.Coords)
+	util.CheckErr(err, "Error reading coord public key: %v\n", err)
+
+	// The identity key must exist before any listener starts since it backs the TLS certificate
+	privateKey, err := loadIdentityKey(config.IdentityKeyFile)
+	util.CheckErr(err, "Error loading router identity key: %v\n", err)
+	onionKey, _, err := util.GenerateRSAKeyPair()
+	util.CheckErr(err, "Error generating router onion key: %v\n", err)
+	cert, err := util.NewTLSCertificate(privateKey)
+	util.CheckErr(err, "Error creating router certificate: %v\n", err)
+
 	// Set up tracing
 	tracer := tracing.NewTracer(tracing.TracerConfig{
 		ServerAddress:  config.TracingServerAddr,
@@ -143,24 +234,73 @@ func NewRouter(configPath string) *Router {
 		Secret:         config.Secret,
 	})
 
+	oChecker := ochecker.NewOCheck()
+	crypto := newCryptoPool(config.CryptoWorkers, config.CryptoQueue, oChecker.SetCryptoQueueDepth)
 	router := &Router{
 		RouterId:         config.RouterId,
-		PrivateKey:       nil,
-		PublicKey:        nil,
-		SharedKeyMap:     map[string]SharedKey{},
-		ClientListenAddr: config.ClientListenAddr,
-		CoordListenAddr:  config.CoordListenAddr,
-		OCheckAddr:       config.OCheckAddr,
-		CoordAddr:        config.CoordAddr,
-		PublicAddr:       config.PublicAddr,
-		ErrCh:            make(chan error),
-		OChecker:         ochecker.NewOCheck(),
-		Tracer:           tracer,
+		PrivateKey:       privateKey,
+		PublicKey:        util.ConvertPublicKeyToBytes(&privateKey.PublicKey),
+		OnionKey:         onionKey,
+		OnionKeyLifetime: time.Duration(config.OnionKeyLifetimeMinutes) * time.Minute,
+		OnionKeyGrace:    time.Duration(config.OnionKeyGraceMinutes) * time.Minute,
+		TLSCert:          cert,
+		Circuits: NewCircuitTable(CircuitConfig{
+			Idle:         time.Duration(config.CircuitIdleTimeoutSeconds) * time.Second,
+			MaxLifetime:  time.Duration(config.CircuitMaxLifetimeSeconds) * time.Second,
+			TruncateWait: time.Duration(config.CircuitTruncateWaitSeconds) * time.Second,
+			Notify:       config.NotifyExpiredCircuits,
+			Bandwidth:    config.CircuitBandwidth,
+			WindowCells:  config.CircuitWindowCells,
+		}, oChecker.SetNumOfActiveCircuits),
+		ClientListenAddr:     config.ClientListenAddr,
+		CoordListenAddr:      config.CoordListenAddr,
+		OCheckAddr:           config.OCheckAddr,
+		Coords:               newCoordLinks(coords),
+		PublicAddr:           config.PublicAddr,
+		ErrCh:                make(chan error),
+		OChecker:             oChecker,
+		NetEm:                NewNetworkEmulator(config.NetworkEmulation),
+		Bandwidth:            newTokenBucket(config.Bandwidth),
+		BandwidthCapacity:    config.Bandwidth.RateBytes,
+		MaxExitResponseBytes: config.MaxExitResponseBytes,
+		ExitChunkBytes:       config.ExitChunkBytes,
+		StreamWindowCells:    config.StreamWindowCells,
+		ExitPolicy:           config.ExitPolicy,
+		Services:             newServiceTable(),
+		Crypto:               crypto,
+		Admission:            newAdmissionControl(config.PowThreshold, crypto.handshakeDepth),
+		Roles:                config.Roles,
+		ShutdownGrace:        time.Duration(config.ShutdownGraceSeconds) * time.Second,
+		AdminListenAddr:      config.AdminListenAddr,
+		RegistrationCheck:    time.Duration(config.RegistrationCheckSeconds) * time.Second,
+		HeartbeatTimeout:     time.Duration(config.HeartbeatTimeoutSeconds) * time.Second,
+		shutdownCh:           make(chan struct{}),
+		Tracer:               tracer,
 	}
+	if config.Bridge {
+		// A bridge only ever stands in for a client's guard
+		router.Bridge = true
+		router.Roles = []string{storprotocol.RoleGuard}
+	}
+	// Other routers dial the client listener with plain TLS, only bridge users know the transport
+	if config.Transport != util.TransportNone && !config.Bridge {
+		err = errors.New("only bridges take a transport")
+	} else if config.Transport != util.TransportNone {
+		var secret []byte
+		if config.TransportSecretFile == "" {
+			err = errors.New("a transport needs a TransportSecretFile")
+		} else if secret, err = util.LoadOrCreateTransportSecret(config.TransportSecretFile); err == nil {
+			router.Transport, err = util.NewTransport(config.Transport, secret)
+		}
+	}
+	util.CheckErr(err, "Error setting up transport: %v\n", err)
+	lifetime, grace := router.onionKeySchedule()
+	router.Handshakes = newHandshakeCache(lifetime + grace)
+	router.exitClient = router.newExitClient()
 	return router
 }
 
-// should not return if successful
+// should not return if successful, returns nil after Shutdown
 func (r *Router) StartRouter() error {
 	trace := r.Tracer.CreateTrace()
 	trace.RecordAction(RouterStart{RouterId: r.RouterId})
@@ -171,16 +311,24 @@ func (r *Router) StartRouter() error {
 
 	go r.TeardownAfterTTL()
 
-	err := <-r.ErrCh
-	return err
-}
+	go r.rotateOnionKeys()
 
-var timeout time.Duration = 300 * time.Millisecond
+	go r.adjustAdmission()
+
+	go r.listenAdmin()
+
+	select {
+	case err := <-r.ErrCh:
+		return err
+	case <-r.shutdownCh:
+		return nil
+	}
+}
 
 // ======================== RPC API ========================
 
 // handles router init requests
-func (rrl *RouterRPCListener) Init(request storprotocol.STorGeneralRouterPackageRequest, response *storprotocol.STorGeneralRouterPackageResponse) error {
+func (rrl *RouterRPCListener) Init(request storprotocol.STorGeneralRouterPackageRequest, response *storprotocol.STorGeneralRouterPackageResponse) (err error) {
 	payload := request.Payload
 	encryptionType := request.EncryptionType
 	clientId := request.ClientId
@@ -188,29 +336,55 @@ func (rrl *RouterRPCListener) Init(request storprotocol.STorGeneralRouterPackage
 
 	trace := rrl.R.Tracer.ReceiveToken(request.Token)
 	trace.RecordAction(RouterCircuitInitRecvd{RouterId: rrl.R.RouterId, ClientId: clientId})
-	time.Sleep(timeout)
+	defer rrl.R.emulateReply(&err)
 
 	if encryptionType == "AES" {
 		// For relaying the Circuit Init request to other Routers
-		util.DecodeAndDecryptAES(rrl.R.SharedKeyMap[clientId].sk, payload, &routerArgs)
+		if err := rrl.R.Circuits.CheckPreviousHop(clientId, rrl.PeerPublicKey); err != nil {
+			return err
+		}
+		sk, ok := rrl.R.Circuits.Key(clientId)
+		if !ok {
+			if reply, expired := rrl.R.expiredCircuitReply(clientId); expired {
+				*response = storprotocol.STorGeneralRouterPackageResponse{
+					Payload:   reply,
+					Destroyed: true,
+					Token:     trace.GenerateToken(),
+				}
+				return nil
+			}
+			return errors.New("shared key does not exist in map")
+		}
+		rrl.R.Circuits.MarkOpen(clientId)
+		rrl.R.Crypto.doRelay(func() { util.DecodeAndDecryptAES(sk, payload, &routerArgs) })
+		if err := rrl.R.acceptSeq(trace, clientId, routerArgs.Seq); err != nil {
+			return err
+		}
 		nextRequest := storprotocol.STorGeneralRouterPackageRequest{
 			ClientId:       routerArgs.ClientId,
 			Payload:        routerArgs.Payload,
 			EncryptionType: routerArgs.EncryptionType,
+			PowNonce:       routerArgs.PowNonce,
 		}
+		rrl.R.Circuits.SetNextHop(clientId, routerArgs.NextAddr, routerArgs.NextPublicKey)
 
-		routerClient, err := rpc.Dial("tcp", routerArgs.NextAddr)
+		routerClient, err := rrl.R.dialRouter(routerArgs.NextAddr, routerArgs.NextPublicKey)
 		if err != nil {
+			// The circuit is kept up to this hop so the client can truncate it here
+			// and extend past the failed hop
+			rrl.R.awaitTruncate(trace, clientId, false)
 			errPayload := &storprotocol.STorRouterReply{
-				Payload:    nil,
-				DidSucceed: false,
-				ErrMsg:     "Unable to contact next router.",
+				Payload:       nil,
+				DidSucceed:    false,
+				ErrMsg:        "Unable to contact next router.",
+				NextHopFailed: true,
 			}
 
 			// Error propogation using AES encryption
 			*response = storprotocol.STorGeneralRouterPackageResponse{
-				Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
-				Token:   trace.GenerateToken(),
+				Payload:          util.EncodeAndEncryptAES(sk, errPayload),
+				AwaitingTruncate: true,
+				Token:            trace.GenerateToken(),
 			}
 			return nil
 		}
@@ -222,49 +396,91 @@ func (rrl *RouterRPCListener) Init(request storprotocol.STorGeneralRouterPackage
 		routerClient.Close()
 
 		if err != nil {
+			// The next hop may still be up with only its reply lost, so it is
+			// told to destroy the circuit
+			rrl.R.awaitTruncate(trace, clientId, true)
 			errPayload := &storprotocol.STorRouterReply{
-				Payload:    nil,
-				DidSucceed: false,
-				ErrMsg:     "Unable to send to next router.",
+				Payload:       nil,
+				DidSucceed:    false,
+				ErrMsg:        "Unable to send to next router.",
+				NextHopFailed: true,
 			}
 
 			// Error propogation using AES encryption
 			*response = storprotocol.STorGeneralRouterPackageResponse{
-				Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
-				Token:   trace.GenerateToken(),
+				Payload:          util.EncodeAndEncryptAES(sk, errPayload),
+				AwaitingTruncate: true,
+				Token:            trace.GenerateToken(),
 			}
 			return nil
 		}
 
+		destroyed := response.Destroyed
+		if destroyed {
+			rrl.R.destroyCircuit(trace, clientId, false)
+		} else if response.AwaitingTruncate {
+			rrl.R.Circuits.AwaitTruncate(clientId, time.Now())
+		}
 		routerReply := &storprotocol.STorRouterReply{
 			Payload:    response.Payload,
 			DidSucceed: true,
 		}
 
 		*response = storprotocol.STorGeneralRouterPackageResponse{
-			Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, routerReply),
-			Token:   response.Token,
+			Payload:          util.EncodeAndEncryptAES(sk, routerReply),
+			Destroyed:        destroyed,
+			AwaitingTruncate: response.AwaitingTruncate,
+			Token:            response.Token,
 		}
 	} else {
+		// A draining router finishes existing circuits but accepts no new ones
+		if rrl.R.IsDraining() {
+			return errors.New("router is shutting down")
+		}
+
+		// The puzzle is checked first, so a flood of handshakes costs the router no RSA work
+		if reason := rrl.R.Admission.admit(clientId, request.PowNonce, time.Now()); reason != "" {
+			trace.RecordAction(HandshakeRejected{RouterId: rrl.R.RouterId, ClientId: clientId, Reason: reason})
+			return errors.New(reason)
+		}
+
+		// A replayed handshake would install the same key again
+		if !rrl.R.Handshakes.add(payload, time.Now()) {
+			trace.RecordAction(ReplayRejected{RouterId: rrl.R.RouterId, ClientId: clientId})
+			return errors.New(errReplayedCellMsg)
+		}
+
 		// For establishing a Client's shared key in our mapping
-		util.DecodeAndDecryptRSA(rrl.R.PrivateKey, payload, &routerArgs)
-		rrl.R.SharedKeyMap[clientId] = SharedKey{routerArgs.Payload, time.Now().Add(5 * time.Minute)}
+		var decryptErr error
+		if !rrl.R.Crypto.doHandshake(func() { decryptErr = rrl.R.decryptHandshake(payload, &routerArgs) }) {
+			// Not decrypted, so the client may send it again
+			rrl.R.Handshakes.forget(payload)
+			trace.RecordAction(HandshakeRejected{RouterId: rrl.R.RouterId, ClientId: clientId, Reason: errRouterBusyMsg})
+			return errors.New(errRouterBusyMsg)
+		}
+		if decryptErr != nil {
+			rrl.R.Handshakes.forget(payload)
+			return errors.New(errHandshakeDecryptMsg)
+		}
+		sk := routerArgs.Payload
+		if err := rrl.R.Circuits.Create(clientId, sk, rrl.PeerPublicKey); err != nil {
+			return err
+		}
 
 		routerReply := &storprotocol.STorRouterReply{
 			DidSucceed: true,
 			Payload:    nil,
 		}
 		*response = storprotocol.STorGeneralRouterPackageResponse{
-			Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, routerReply),
+			Payload: util.EncodeAndEncryptAES(sk, routerReply),
 			Token:   trace.GenerateToken(),
 		}
-		rrl.R.OChecker.SetNumOfActiveCircuits(rrl.R.OChecker.NumOfActiveCircuits + 1)
 	}
 	return nil
 }
 
 // response is nil if there are no errors
-func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPackageRequest, response *storprotocol.STorGeneralRouterPackageResponse) error {
+func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPackageRequest, response *storprotocol.STorGeneralRouterPackageResponse) (err error) {
 	payload := request.Payload
 	encryptionType := request.EncryptionType
 	clientId := request.ClientId
@@ -272,23 +488,29 @@ func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPac
 
 	trace := rrl.R.Tracer.ReceiveToken(request.Token)
 	trace.RecordAction(CircuitTeardownRecvd{RouterId: rrl.R.RouterId, ClientId: clientId})
-	time.Sleep(timeout)
+	defer rrl.R.emulateReply(&err)
 
 	if encryptionType == "AES" {
 		// For relaying the Circuit Init request to other Routers
 		nextRequest := storprotocol.STorGeneralRouterPackageRequest{}
-		util.DecodeAndDecryptAES(rrl.R.SharedKeyMap[clientId].sk, payload, &routerArgs)
+		if err := rrl.R.Circuits.CheckPreviousHop(clientId, rrl.PeerPublicKey); err != nil {
+			return err
+		}
+		sk, ok := rrl.R.Circuits.BeginClose(clientId)
+		if !ok {
+			return errors.New("shared key does not exist in map")
+		}
+		defer rrl.R.Circuits.Remove(clientId)
+		rrl.R.Crypto.doRelay(func() { util.DecodeAndDecryptAES(sk, payload, &routerArgs) })
 		nextRequest.ClientId = routerArgs.ClientId
 		nextRequest.Payload = routerArgs.Payload
 		nextRequest.EncryptionType = routerArgs.EncryptionType
 
 		if routerArgs.NextAddr == "" {
-			delete(rrl.R.SharedKeyMap, request.ClientId)
-			rrl.R.OChecker.SetNumOfActiveCircuits(rrl.R.OChecker.NumOfActiveCircuits - 1)
 			response.Token = trace.GenerateToken()
 			return nil
 		}
-		routerClient, err := rpc.Dial("tcp", routerArgs.NextAddr)
+		routerClient, err := rrl.R.dialRouter(routerArgs.NextAddr, routerArgs.NextPublicKey)
 		if err != nil {
 			errPayload := &storprotocol.STorRouterReply{
 				Payload:    nil,
@@ -298,7 +520,7 @@ func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPac
 
 			// Error propogation using AES encryption
 			*response = storprotocol.STorGeneralRouterPackageResponse{
-				Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
+				Payload: util.EncodeAndEncryptAES(sk, errPayload),
 				Token:   trace.GenerateToken(),
 			}
 			return nil
@@ -317,7 +539,7 @@ func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPac
 
 			// Error propogation using AES encryption
 			*response = storprotocol.STorGeneralRouterPackageResponse{
-				Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
+				Payload: util.EncodeAndEncryptAES(sk, errPayload),
 				Token:   trace.GenerateToken(),
 			}
 			return nil
@@ -328,30 +550,44 @@ func (rrl *RouterRPCListener) Teardown(request storprotocol.STorGeneralRouterPac
 			DidSucceed: true,
 		}
 		*response = storprotocol.STorGeneralRouterPackageResponse{
-			Payload: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, routerReply),
+			Payload: util.EncodeAndEncryptAES(sk, routerReply),
 			Token:   response.Token,
 		}
-
-		delete(rrl.R.SharedKeyMap, request.ClientId)
-		rrl.R.OChecker.SetNumOfActiveCircuits(rrl.R.OChecker.NumOfActiveCircuits - 1)
 	}
 
 	return nil
 }
 
 // handles router send requests
-func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, routerReply *storprotocol.STorRouterHTTPResponse) error {
+func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, routerReply *storprotocol.STorRouterHTTPResponse) (err error) {
 	trace := rrl.R.Tracer.ReceiveToken(request.Token)
 	trace.RecordAction(RouterRequestRecvd{RouterId: rrl.R.RouterId, ClientId: request.ClientId, RequestOnion: util.TracePayload(request.Onion)})
+	defer rrl.R.emulateReply(&err)
 
-	_, ok := rrl.R.SharedKeyMap[request.ClientId]
+	if err := rrl.R.Circuits.CheckPreviousHop(request.ClientId, rrl.PeerPublicKey); err != nil {
+		return err
+	}
+	sk, ok := rrl.R.Circuits.Key(request.ClientId)
 	if !ok {
+		if reply, expired := rrl.R.expiredCircuitReply(request.ClientId); expired {
+			*routerReply = storprotocol.STorRouterHTTPResponse{
+				Response:  reply,
+				Destroyed: true,
+				Token:     trace.GenerateToken(),
+			}
+			return nil
+		}
 		return errors.New("shared key does not exist in map")
 	}
+	// Every relayed request keeps the circuit from idling out
+	rrl.R.Circuits.MarkOpen(request.ClientId)
+	rrl.R.throttle(request.ClientId, len(request.Onion))
 
 	encryptedRouterRequest := storprotocol.STorEncryptedRouterRequest{}
-	time.Sleep(timeout)
-	util.DecodeAndDecryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, request.Onion, &encryptedRouterRequest)
+	rrl.R.Crypto.doRelay(func() { util.DecodeAndDecryptAES(sk, request.Onion, &encryptedRouterRequest) })
+	if err := rrl.R.acceptSeq(trace, request.ClientId, encryptedRouterRequest.Seq); err != nil {
+		return err
+	}
 
 	if encryptedRouterRequest.NextAddr != "" {
 		// Onion with one layer peeled off
@@ -360,17 +596,22 @@ func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, router
 			Onion:    encryptedRouterRequest.Payload,
 		}
 
-		routerClient, err := rpc.Dial("tcp", encryptedRouterRequest.NextAddr)
+		routerClient, err := rrl.R.dialRouter(encryptedRouterRequest.NextAddr, encryptedRouterRequest.NextPublicKey)
 		if err != nil {
+			// The circuit is kept up to this hop so the client can truncate it here
+			// and extend past the failed hop
+			rrl.R.awaitTruncate(trace, request.ClientId, false)
 			errPayload := storprotocol.STorRouterReply{
-				Payload:    nil,
-				DidSucceed: false,
-				ErrMsg:     "Unable to contact next router.",
+				Payload:       nil,
+				DidSucceed:    false,
+				ErrMsg:        "Unable to contact next router.",
+				NextHopFailed: true,
 			}
 
 			*routerReply = storprotocol.STorRouterHTTPResponse{
-				Response: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
-				Token:    trace.GenerateToken(),
+				Response:         util.EncodeAndEncryptAES(sk, errPayload),
+				AwaitingTruncate: true,
+				Token:            trace.GenerateToken(),
 			}
 
 			return nil
@@ -380,17 +621,23 @@ func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, router
 		trace.RecordAction(RouterRequestFwd{RouterId: rrl.R.RouterId, ClientId: request.ClientId, RequestOnion: util.TracePayload(onionMessage.Onion)})
 		onionMessage.Token = trace.GenerateToken()
 		err = routerClient.Call("RouterRPCListener.Send", onionMessage, &routerHTTPResponse)
+		routerClient.Close()
 
 		if err != nil {
+			// The next hop may still be up with only its reply lost, so it is
+			// told to destroy the circuit
+			rrl.R.awaitTruncate(trace, request.ClientId, true)
 			errPayload := &storprotocol.STorRouterReply{
-				Payload:    nil,
-				DidSucceed: false,
-				ErrMsg:     "Unable to send to next router.",
+				Payload:       nil,
+				DidSucceed:    false,
+				ErrMsg:        "Unable to send to next router.",
+				NextHopFailed: true,
 			}
 			// Propogation of error
 			*routerReply = storprotocol.STorRouterHTTPResponse{
-				Response: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
-				Token:    trace.GenerateToken(),
+				Response:         util.EncodeAndEncryptAES(sk, errPayload),
+				AwaitingTruncate: true,
+				Token:            trace.GenerateToken(),
 			}
 			return nil
 		}
@@ -398,51 +645,115 @@ func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, router
 		// Upon returning from request
 		trace = rrl.R.Tracer.ReceiveToken(routerHTTPResponse.Token)
 		trace.RecordAction(ResponseRelayRecvd{RouterId: rrl.R.RouterId, ClientId: request.ClientId, ResponseOnion: util.TracePayload(routerHTTPResponse.Response)})
-		time.Sleep(timeout)
+		if routerHTTPResponse.Destroyed {
+			rrl.R.destroyCircuit(trace, request.ClientId, false)
+		} else if routerHTTPResponse.AwaitingTruncate {
+			rrl.R.Circuits.AwaitTruncate(request.ClientId, time.Now())
+		}
 
 		payload := storprotocol.STorRouterReply{
 			Payload:     routerHTTPResponse.Response,
 			IsWebServer: false,
 			DidSucceed:  true,
 		}
-		responseByte := util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, payload)
+		responseByte := util.EncodeAndEncryptAES(sk, payload)
+		rrl.R.throttle(request.ClientId, len(responseByte))
 		trace.RecordAction(ResponseRelay{RouterId: rrl.R.RouterId, ClientId: request.ClientId, ResponseOnion: util.TracePayload(responseByte)})
 		*routerReply = storprotocol.STorRouterHTTPResponse{
-			Response: responseByte,
-			Token:    trace.GenerateToken(),
+			Response:         responseByte,
+			Destroyed:        routerHTTPResponse.Destroyed,
+			AwaitingTruncate: routerHTTPResponse.AwaitingTruncate,
+			Token:            trace.GenerateToken(),
 		}
 	} else {
 		routerHttpRequest := storprotocol.STorRouterHTTPRequest{}
 		util.Decode(encryptedRouterRequest.Payload, &routerHttpRequest)
 
-		trace.RecordAction(ExitRouterRequest{RouterId: rrl.R.RouterId, ClientId: request.ClientId, Plaintext: routerHttpRequest.Url})
-
-		// if time permits, we would need something for POSTs
-		msg, err := http.Get(routerHttpRequest.Url)
-		if err != nil {
-			errPayload := storprotocol.STorRouterReply{
-				Payload:    nil,
-				DidSucceed: false,
-				ErrMsg:     "Unable to contact the web server.",
+		if isServiceCommand(routerHttpRequest.Command) {
+			cell, errMsg := rrl.R.handleServiceCommand(trace, request.ClientId, routerHttpRequest.Command, routerHttpRequest.Service)
+			payload := storprotocol.STorRouterReply{
+				IsWebServer: errMsg == "",
+				DidSucceed:  errMsg == "",
+				ErrMsg:      errMsg,
+			}
+			if errMsg == "" {
+				payload.Payload = util.Encode(cell)
+			}
+			responseByte := util.EncodeAndEncryptAES(sk, payload)
+			rrl.R.throttle(request.ClientId, len(responseByte))
+			*routerReply = storprotocol.STorRouterHTTPResponse{
+				Response: responseByte,
+				Token:    trace.GenerateToken(),
+			}
+			return nil
+		}
+		if routerHttpRequest.Command == storprotocol.ExitCommandResolve {
+			resolved, errMsg := rrl.R.resolveForClient(trace, request.ClientId, routerHttpRequest)
+			payload := storprotocol.STorRouterReply{
+				IsWebServer: errMsg == "",
+				DidSucceed:  errMsg == "",
+				ErrMsg:      errMsg,
+			}
+			if errMsg == "" {
+				payload.Payload = util.Encode(resolved)
 			}
-
 			*routerReply = storprotocol.STorRouterHTTPResponse{
-				Response: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
+				Response: util.EncodeAndEncryptAES(sk, payload),
 				Token:    trace.GenerateToken(),
 			}
 			return nil
 		}
-		body, err := ioutil.ReadAll(msg.Body)
+		if routerHttpRequest.Command == storprotocol.ExitCommandEnd {
+			rrl.R.endExitStream(trace, request.ClientId, routerHttpRequest)
+			payload := storprotocol.STorRouterReply{
+				IsWebServer: true,
+				DidSucceed:  true,
+			}
+			*routerReply = storprotocol.STorRouterHTTPResponse{
+				Response: util.EncodeAndEncryptAES(sk, payload),
+				Token:    trace.GenerateToken(),
+			}
+			return nil
+		}
+		var setCookies []string
+		if routerHttpRequest.Command != storprotocol.ExitCommandNextChunk {
+			var errMsg string
+			if setCookies, errMsg = rrl.R.startExitRequest(trace, request.ClientId, routerHttpRequest); errMsg != "" {
+				errPayload := storprotocol.STorRouterReply{
+					Payload:    nil,
+					DidSucceed: false,
+					ErrMsg:     errMsg,
+				}
+
+				*routerReply = storprotocol.STorRouterHTTPResponse{
+					Response: util.EncodeAndEncryptAES(sk, errPayload),
+					Token:    trace.GenerateToken(),
+				}
+				return nil
+			}
+		}
+
+		body, more, err := rrl.R.readExitChunk(request.ClientId, routerHttpRequest.StreamId, routerHttpRequest.StreamSendme, routerHttpRequest.CircuitSendme)
 		if err != nil {
+			errMsg := "Unable to read http response."
+			switch err {
+			case errFlowWindowExhausted:
+				trace.RecordAction(FlowWindowExhausted{RouterId: rrl.R.RouterId, ClientId: request.ClientId})
+				errMsg = "Flow control window exhausted."
+			case errExitResponseLimit:
+				errMsg = "Response exceeds exit size limit."
+			case errNoExitStream:
+				errMsg = "No response to continue."
+			}
 			errPayload := storprotocol.STorRouterReply{
 				Payload:    nil,
 				DidSucceed: false,
-				ErrMsg:     "Unable to read http response.",
+				ErrMsg:     errMsg,
 			}
 
 			*routerReply = storprotocol.STorRouterHTTPResponse{
-				Response: util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, errPayload),
-				Token:    request.Token,
+				Response: util.EncodeAndEncryptAES(sk, errPayload),
+				Token:    trace.GenerateToken(),
 			}
 			return nil
 		}
@@ -451,8 +762,10 @@ func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, router
 			Payload:     body,
 			IsWebServer: true,
 			DidSucceed:  true,
+			HasMore:     more,
+			SetCookies:  setCookies,
 		}
-		responseByte := util.EncodeAndEncryptAES(rrl.R.SharedKeyMap[request.ClientId].sk, payload)
+		responseByte := util.EncodeAndEncryptAES(sk, payload)
 
 		trace.RecordAction(ResponseRelay{RouterId: rrl.R.RouterId, ClientId: request.ClientId, ResponseOnion: util.TracePayload(responseByte)})
 		*routerReply = storprotocol.STorRouterHTTPResponse{
@@ -465,64 +778,160 @@ func (rrl *RouterRPCListener) Send(request storprotocol.STorOnionMessage, router
 
 // ======================== PRIVATE METHODS ========================
 
+// Checks and performs a new exit request, leaving the response as the exit
+// stream routerHttpRequest.StreamId. Returns the cookies the web server set,
+// which the client keeps for the circuit, or the message for the client if
+// it fails.
+func (r *Router) startExitRequest(trace *tracing.Trace, clientId string, routerHttpRequest storprotocol.STorRouterHTTPRequest) ([]string, string) {
+	trace.RecordAction(ExitRouterRequest{RouterId: r.RouterId, ClientId: clientId, StreamId: routerHttpRequest.StreamId, Plaintext: routerHttpRequest.Url})
+
+	if !r.HasRole(storprotocol.RoleExit) {
+		return nil, "Router does not act as an exit."
+	}
+	if !r.exitAllowed(routerHttpRequest.Url) {
+		return nil, "Exit policy rejects destination."
+	}
+	msg, err := r.fetch(routerHttpRequest.Method, routerHttpRequest.Url, routerHttpRequest.Header, routerHttpRequest.Body)
+	if errors.Is(err, errRedirectRejected) {
+		return nil, "Exit policy rejects destination."
+	}
+	if err != nil {
+		return nil, "Unable to contact the web server."
+	}
+	setCookies := msg.Header.Values("Set-Cookie")
+	switch r.startExitStream(clientId, routerHttpRequest.StreamId, msg) {
+	case nil:
+	case errTooManyStreams:
+		return nil, "Too many streams on circuit."
+	case errExitResponseLimit:
+		return nil, "Response exceeds exit size limit."
+	default:
+		return nil, "No response to continue."
+	}
+	return setCookies, ""
+}
+
+// A router configured without roles takes every role
+func (r *Router) HasRole(role string) bool {
+	return util.HasRole(r.Roles, role)
+}
+
 func (r *Router) convertToPublicAddress(privateAddr string) string {
 	port := strings.Split(privateAddr, ":")[1]
 
 	return r.PublicAddr + ":" + port
 }
 
-func (r *Router) keyExchangeAndHeartBeat() {
-	coordClient, _ := rpc.Dial("tcp", r.CoordAddr)
-	privateKey, publicKey, err := util.GenerateRSAKeyPair()
-	if err != nil {
-		r.ErrCh <- err
+// Dials the next router in a circuit, emulating the link to it first
+func (r *Router) dialRouter(addr string, publicKey []byte) (*rpc.Client, error) {
+	if err := r.NetEm.Emulate(addr); err != nil {
+		return nil, err
 	}
-	r.PrivateKey = privateKey
-	r.PublicKey = util.ConvertPublicKeyToBytes(publicKey)
+	return util.DialRPC(addr, r.TLSCert, publicKey)
+}
+
+// Deferred by the RPC handlers so every reply crosses the emulated link back
+// to the previous hop. A dropped reply surfaces as an RPC error.
+func (r *Router) emulateReply(err *error) {
+	if *err == nil {
+		*err = r.NetEm.Emulate(upstreamLink)
+	}
+}
 
+func (r *Router) keyExchangeAndHeartBeat() {
 	// Start heartbeats for coord
 	startStruct := ochecker.StartStruct{
 		AckLocalIPAckLocalPort:     r.OCheckAddr,
 		EpochNonce:                 1,
 		HBeatLocalIPHBeatLocalPort: "",
 	}
-	_, _, listeningAddr, _ := r.OChecker.Start(startStruct)
+	_, _, listeningAddr, err := r.OChecker.Start(startStruct)
+	if err != nil {
+		fmt.Println("Error starting OCheck:", err)
+		r.ErrCh <- err
+		return
+	}
 
 	r.OCheckAddr = listeningAddr
 
+	for _, coord := range r.Coords {
+		go r.maintainRegistration(coord)
+	}
+}
+
+// Sends a single join request to the coord
+func (r *Router) register(coord *coordLink) error {
+	coordClient, err := r.dialCoord(coord)
+	if err != nil {
+		return err
+	}
+	defer coordClient.Close()
+
 	trace := r.Tracer.CreateTrace()
 	trace.RecordAction(RouterJoining{RouterId: r.RouterId})
+	powSeed, powDifficulty := r.Admission.params()
 	coordArgs := storprotocol.STorRouterJoinRequest{
 		Id:               r.RouterId,
 		PublicKey:        r.PublicKey,
+		OnionKey:         r.OnionPublicKey(),
 		ClientListenAddr: r.convertToPublicAddress(r.ClientListenAddr),
 		CoordListenAddr:  r.convertToPublicAddress(r.CoordListenAddr),
 		OCheckAddr:       r.convertToPublicAddress(r.OCheckAddr),
+		ExitPolicy:       r.ExitPolicy,
+		Roles:            r.Roles,
+		Bandwidth:        r.BandwidthCapacity,
+		PowSeed:          powSeed,
+		PowDifficulty:    powDifficulty,
 		Token:            trace.GenerateToken(),
 	}
 	var coordReply storprotocol.STorRouterJoinResponse
+	method := "CoordRPCListener.RegisterRouter"
+	if r.Bridge {
+		method = "CoordRPCListener.RegisterBridge"
+	}
 	fmt.Println("Router join request")
-	coordClient.Call("CoordRPCListener.RegisterRouter", &coordArgs, &coordReply)
+	if err = coordClient.Call(method, &coordArgs, &coordReply); err != nil {
+		return err
+	}
 
 	trace = r.Tracer.ReceiveToken(coordReply.Token)
 	trace.RecordAction(RouterJoined{RouterId: r.RouterId})
-
-	coordClient.Close()
+	return nil
 }
 
+// Tears down circuits that have been idle or alive for too long
 func (r *Router) TeardownAfterTTL() {
 	for {
-		var toDelete []string
-		for clientId, sharedKey := range r.SharedKeyMap {
-			if time.Now().After(sharedKey.TTL) {
-				toDelete = append(toDelete, clientId)
-			}
-		}
-		for _, clientId := range toDelete {
-			delete(r.SharedKeyMap, clientId)
+		r.expireCircuits(time.Now())
+		time.Sleep(r.Circuits.ReapInterval())
+	}
+}
+
+func (r *Router) expireCircuits(now time.Time) {
+	for _, clientId := range r.Circuits.Expired(now) {
+		if r.Circuits.Expire(clientId, now) {
+			trace := r.Tracer.CreateTrace()
+			trace.RecordAction(CircuitExpired{RouterId: r.RouterId, ClientId: clientId})
 		}
-		time.Sleep(time.Minute)
 	}
+	r.Circuits.PruneTombstones(now)
+	r.pruneServices(now)
+}
+
+// Reply for a request on a circuit this router expired, encrypted with the
+// circuit's old key so it reaches the client like any other error
+func (r *Router) expiredCircuitReply(clientId string) ([]byte, bool) {
+	sk, ok := r.Circuits.TakeTombstone(clientId)
+	if !ok {
+		return nil, false
+	}
+	errPayload := storprotocol.STorRouterReply{
+		Payload:          nil,
+		DidSucceed:       false,
+		ErrMsg:           "Circuit expired.",
+		CircuitDestroyed: true,
+	}
+	return util.EncodeAndEncryptAES(sk, errPayload), true
 }
 
 func (r *Router) listenCoord() {
@@ -531,7 +940,7 @@ func (r *Router) listenCoord() {
 		-
 	*/
 	r.keyExchangeAndHeartBeat()
-	r.listen(r.CoordListenAddr)
+	r.listen(r.CoordListenAddr, nil)
 }
 
 func (r *Router) listenClient() {
@@ -539,10 +948,10 @@ func (r *Router) listenClient() {
 		RPC functions:
 		-
 	*/
-	r.listen(r.ClientListenAddr)
+	r.listen(r.ClientListenAddr, r.Transport)
 }
 
-func (r *Router) listen(addr string) {
+func (r *Router) listen(addr string, transport util.Transport) {
 	// setup connection
 	laddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
@@ -550,7 +959,7 @@ func (r *Router) listen(addr string) {
 		r.ErrCh <- err
 		return
 	}
-	conn, err := net.ListenTCP("tcp", laddr)
+	listener, err := util.ListenTLSOver(laddr.String(), r.TLSCert, transport)
 	if err != nil {
 		fmt.Println("Error listening on address", laddr.String(), ":", err)
 		r.ErrCh <- err
@@ -558,6 +967,16 @@ func (r *Router) listen(addr string) {
 	}
 
 	// start RPC listener
-	rpc.Register(&RouterRPCListener{r})
-	rpc.Accept(conn)
+	util.AcceptLoop(listener, func(conn net.Conn) { r.serveConn(conn.(*tls.Conn)) })
+}
+
+// Each connection gets its own RPC server so handlers know which neighbour is calling
+func (r *Router) serveConn(conn *tls.Conn) {
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return
+	}
+	server := rpc.NewServer()
+	server.Register(&RouterRPCListener{R: r, PeerPublicKey: util.TLSPeerPublicKey(conn.ConnectionState())})
+	server.ServeConn(conn)
 }
@@ -0,0 +1,128 @@
+package router
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DistributedClocks/tracing"
+
+	storprotocol "STor/interface"
+	ochecker "STor/oCheck"
+	"STor/util"
+)
+
+// Starts an in-process tracing server so routers can be exercised without the real deployment
+func newTestTracer(t *testing.T, identity string) *tracing.Tracer {
+	dir := t.TempDir()
+	server := tracing.NewTracingServer(tracing.TracingServerConfig{
+		ServerBind:       "127.0.0.1:0",
+		OutputFile:       filepath.Join(dir, "trace_output.log"),
+		ShivizOutputFile: filepath.Join(dir, "shiviz_output.log"),
+	})
+	if err := server.Open(); err != nil {
+		t.Fatalf("unable to start tracing server: %s", err)
+	}
+	go server.Accept()
+	t.Cleanup(func() { server.Close() })
+
+	tracer := tracing.NewTracer(tracing.TracerConfig{
+		ServerAddress:  server.Listener.Addr().String(),
+		TracerIdentity: identity,
+	})
+	tracer.SetShouldPrint(false)
+	return tracer
+}
+
+// Builds a router that is not listening anywhere; RPC handlers are called directly
+func newTestRouter(t *testing.T, routerId int) *Router {
+	privateKey, publicKey, err := util.GenerateRSAKeyPair()
+	if err != nil {
+		t.Fatalf("GenerateRSAKeyPair returned an error %s", err)
+	}
+	onionKey, _, _ := util.GenerateRSAKeyPair()
+	cert, _ := util.NewTLSCertificate(privateKey)
+	oChecker := ochecker.NewOCheck()
+	r := &Router{
+		RouterId:   routerId,
+		PrivateKey: privateKey,
+		PublicKey:  util.ConvertPublicKeyToBytes(publicKey),
+		OnionKey:   onionKey,
+		TLSCert:    cert,
+		Circuits:   NewCircuitTable(CircuitConfig{}, oChecker.SetNumOfActiveCircuits),
+		Coords:     newCoordLinks([]util.Authority{{Addr: "127.0.0.1:1"}}),
+		ErrCh:      make(chan error),
+		OChecker:   oChecker,
+		NetEm:      NewNetworkEmulator(NetworkEmulationConfig{}),
+		ExitPolicy: storprotocol.ExitPolicy{AllowPrivate: true},
+		Services:   newServiceTable(),
+		Tracer:     newTestTracer(t, "router"),
+		shutdownCh: make(chan struct{}),
+	}
+	r.Crypto = newCryptoPool(0, 0, oChecker.SetCryptoQueueDepth)
+	t.Cleanup(r.Crypto.stop)
+	r.Handshakes = newHandshakeCache(time.Hour)
+	r.Admission = newAdmissionControl(0, r.Crypto.handshakeDepth)
+	r.exitClient = r.newExitClient()
+	return r
+}
+
+var testSeq uint64
+
+// A relay sequence number no test cell has used yet
+func nextTestSeq() uint64 {
+	return atomic.AddUint64(&testSeq, 1)
+}
+
+// Builds the client's RSA Init request installing sk at r
+func initRequest(r *Router, clientId string, sk []byte) storprotocol.STorGeneralRouterPackageRequest {
+	return storprotocol.STorGeneralRouterPackageRequest{
+		ClientId:       clientId,
+		EncryptionType: "RSA",
+		Payload: util.EncodeAndEncryptRSA(r.OnionPublicKey(), storprotocol.STorEncryptedRouterRequest{
+			ClientId: clientId,
+			Payload:  sk,
+		}),
+	}
+}
+
+func TestRouter_ShutdownDrainsCircuits(t *testing.T) {
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", util.GenerateAESKey()), &response); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+	r.ShutdownGrace = 5 * time.Second
+
+	done := make(chan struct{})
+	go func() {
+		r.Shutdown()
+		close(done)
+	}()
+	for !r.IsDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := rrl.Init(initRequest(r, "c2", util.GenerateAESKey()), &response); err == nil {
+		t.Fatalf("draining router accepted a new circuit")
+	}
+	select {
+	case <-done:
+		t.Fatalf("Shutdown returned while a circuit was still open")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	r.Circuits.Remove("c1")
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Shutdown did not return after the last circuit closed")
+	}
+	select {
+	case <-r.shutdownCh:
+	default:
+		t.Fatalf("Shutdown did not signal StartRouter to return")
+	}
+}
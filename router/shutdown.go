@@ -0,0 +1,66 @@
+package router
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+
+	storprotocol "STor/interface"
+
+	"github.com/DistributedClocks/tracing"
+)
+
+const defaultShutdownGrace = 30 * time.Second
+
+// Stops accepting new circuits, deregisters from the coords and waits up to
+// the configured grace period for open circuits to be torn down before
+// stopping OCheck and the crypto workers. StartRouter returns once Shutdown
+// is done.
+func (r *Router) Shutdown() {
+	if !atomic.CompareAndSwapInt32(&r.draining, 0, 1) {
+		return
+	}
+	trace := r.Tracer.CreateTrace()
+	trace.RecordAction(RouterLeaving{RouterId: r.RouterId, ActiveCircuits: int(r.Circuits.Active())})
+	fmt.Println("Router shutting down with", r.Circuits.Active(), "open circuits")
+
+	if err := r.deregister(trace); err != nil {
+		fmt.Println("Error deregistering from coords:", err)
+	}
+
+	grace := r.ShutdownGrace
+	if grace <= 0 {
+		grace = defaultShutdownGrace
+	}
+	deadline := time.Now().Add(grace)
+	for r.Circuits.Active() > 0 && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	r.OChecker.Stop()
+	r.Crypto.stop()
+	trace.RecordAction(RouterLeft{RouterId: r.RouterId, AbandonedCircuits: int(r.Circuits.Active())})
+	close(r.shutdownCh)
+}
+
+// True once Shutdown has started; new circuits are refused from then on
+func (r *Router) IsDraining() bool {
+	return atomic.LoadInt32(&r.draining) == 1
+}
+
+func (r *Router) deregister(trace *tracing.Trace) error {
+	return r.callCoords(func(coordClient *rpc.Client) error {
+		request := storprotocol.STorRouterLeaveRequest{
+			Id:        r.RouterId,
+			PublicKey: r.PublicKey,
+			Token:     trace.GenerateToken(),
+		}
+		var response storprotocol.STorRouterLeaveResponse
+		if err := coordClient.Call("CoordRPCListener.DeregisterRouter", request, &response); err != nil {
+			return err
+		}
+		r.Tracer.ReceiveToken(response.Token)
+		return nil
+	})
+}
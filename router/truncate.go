@@ -0,0 +1,150 @@
+package router
+
+import (
+	"errors"
+	"time"
+
+	"github.com/DistributedClocks/tracing"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Recorded when a Truncate request is received
+type CircuitTruncateRecvd struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when forwarding a Truncate request to the next Router
+type CircuitTruncateFwd struct {
+	RouterId int
+	ClientId string
+}
+
+// Recorded when Router becomes the last hop of a truncated circuit
+type CircuitTruncated struct {
+	RouterId int
+	ClientId string
+}
+
+// handles the client cutting its circuit back to the hop the onion ends at.
+// Hops past it are destroyed; the client extends from there with Init.
+func (rrl *RouterRPCListener) Truncate(request storprotocol.STorGeneralRouterPackageRequest, response *storprotocol.STorGeneralRouterPackageResponse) (err error) {
+	clientId := request.ClientId
+	routerArgs := storprotocol.STorEncryptedRouterRequest{}
+
+	trace := rrl.R.Tracer.ReceiveToken(request.Token)
+	trace.RecordAction(CircuitTruncateRecvd{RouterId: rrl.R.RouterId, ClientId: clientId})
+	defer rrl.R.emulateReply(&err)
+
+	if err := rrl.R.Circuits.CheckPreviousHop(clientId, rrl.PeerPublicKey); err != nil {
+		return err
+	}
+	sk, ok := rrl.R.Circuits.Key(clientId)
+	if !ok {
+		if reply, expired := rrl.R.expiredCircuitReply(clientId); expired {
+			*response = storprotocol.STorGeneralRouterPackageResponse{
+				Payload:   reply,
+				Destroyed: true,
+				Token:     trace.GenerateToken(),
+			}
+			return nil
+		}
+		return errors.New("shared key does not exist in map")
+	}
+	rrl.R.Circuits.MarkOpen(clientId)
+	rrl.R.Crypto.doRelay(func() { util.DecodeAndDecryptAES(sk, request.Payload, &routerArgs) })
+	if err := rrl.R.acceptSeq(trace, clientId, routerArgs.Seq); err != nil {
+		return err
+	}
+	// Every hop the truncate passes through is one the client keeps
+	rrl.R.Circuits.CancelTruncateWait(clientId)
+
+	if routerArgs.NextAddr == "" {
+		rrl.R.truncateCircuit(trace, clientId)
+		routerReply := &storprotocol.STorRouterReply{
+			Payload:    nil,
+			DidSucceed: true,
+		}
+		*response = storprotocol.STorGeneralRouterPackageResponse{
+			Payload: util.EncodeAndEncryptAES(sk, routerReply),
+			Token:   trace.GenerateToken(),
+		}
+		return nil
+	}
+
+	nextRequest := storprotocol.STorGeneralRouterPackageRequest{
+		ClientId:       routerArgs.ClientId,
+		Payload:        routerArgs.Payload,
+		EncryptionType: routerArgs.EncryptionType,
+	}
+	routerClient, err := rrl.R.dialRouter(routerArgs.NextAddr, routerArgs.NextPublicKey)
+	if err != nil {
+		rrl.R.awaitTruncate(trace, clientId, false)
+		errPayload := &storprotocol.STorRouterReply{
+			Payload:       nil,
+			DidSucceed:    false,
+			ErrMsg:        "Unable to contact next router.",
+			NextHopFailed: true,
+		}
+		*response = storprotocol.STorGeneralRouterPackageResponse{
+			Payload:          util.EncodeAndEncryptAES(sk, errPayload),
+			AwaitingTruncate: true,
+			Token:            trace.GenerateToken(),
+		}
+		return nil
+	}
+
+	trace.RecordAction(CircuitTruncateFwd{RouterId: rrl.R.RouterId, ClientId: clientId})
+	nextRequest.Token = trace.GenerateToken()
+	err = routerClient.Call("RouterRPCListener.Truncate", nextRequest, response)
+	routerClient.Close()
+	if err != nil {
+		rrl.R.awaitTruncate(trace, clientId, true)
+		errPayload := &storprotocol.STorRouterReply{
+			Payload:       nil,
+			DidSucceed:    false,
+			ErrMsg:        "Unable to send to next router.",
+			NextHopFailed: true,
+		}
+		*response = storprotocol.STorGeneralRouterPackageResponse{
+			Payload:          util.EncodeAndEncryptAES(sk, errPayload),
+			AwaitingTruncate: true,
+			Token:            trace.GenerateToken(),
+		}
+		return nil
+	}
+
+	destroyed := response.Destroyed
+	if destroyed {
+		rrl.R.destroyCircuit(trace, clientId, false)
+	} else if response.AwaitingTruncate {
+		rrl.R.Circuits.AwaitTruncate(clientId, time.Now())
+	}
+	routerReply := &storprotocol.STorRouterReply{
+		Payload:    response.Payload,
+		DidSucceed: true,
+	}
+	*response = storprotocol.STorGeneralRouterPackageResponse{
+		Payload:          util.EncodeAndEncryptAES(sk, routerReply),
+		Destroyed:        destroyed,
+		AwaitingTruncate: response.AwaitingTruncate,
+		Token:            response.Token,
+	}
+	return nil
+}
+
+// Makes this router the last hop of the circuit, destroying whatever is
+// still reachable past it
+func (r *Router) truncateCircuit(trace *tracing.Trace, clientId string) {
+	circuit, ok := r.Circuits.Get(clientId)
+	if !ok {
+		return
+	}
+	r.Circuits.SetNextHop(clientId, "", nil)
+	trace.RecordAction(CircuitTruncated{RouterId: r.RouterId, ClientId: clientId})
+	if circuit.nextAddr != "" {
+		r.forwardDestroy(trace, clientId, circuit.nextAddr, circuit.nextKey)
+	}
+}
@@ -0,0 +1,155 @@
+package router
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	defaultCryptoQueue = 64
+	// Relay jobs waiting per worker before Send and relayed Init block
+	relayQueuePerWorker = 16
+	errRouterBusyMsg    = "router is busy"
+)
+
+// Runs the router's public-key and onion-layer work on a fixed number of
+// workers. Layers of established circuits are always taken ahead of new
+// handshakes, and handshakes beyond the queue are shed instead of piling up
+// on net/rpc goroutines.
+type cryptoPool struct {
+	relay      chan *cryptoJob
+	handshakes chan *cryptoJob
+	pending    int64 // handshakes queued or running, accessed atomically
+	report     func(uint64)
+	quit       chan struct{} // closed by stop to end the workers
+	stopOnce   sync.Once
+}
+
+// A job runs exactly once, on a worker or, if the pool stops before a worker
+// takes it, on the goroutine that submitted it
+type cryptoJob struct {
+	once sync.Once
+	fn   func()
+	done chan struct{}
+}
+
+func newCryptoJob(fn func()) *cryptoJob {
+	return &cryptoJob{fn: fn, done: make(chan struct{})}
+}
+
+// Returns once the job has run, waiting for whoever is running it
+func (j *cryptoJob) run() {
+	j.once.Do(func() {
+		defer close(j.done)
+		j.fn()
+	})
+}
+
+// report is called with the number of jobs waiting whenever it changes, and may be nil
+func newCryptoPool(workers int, queueSize int, report func(uint64)) *cryptoPool {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize <= 0 {
+		queueSize = defaultCryptoQueue
+	}
+	p := &cryptoPool{
+		relay:      make(chan *cryptoJob, workers*relayQueuePerWorker),
+		handshakes: make(chan *cryptoJob, queueSize),
+		report:     report,
+		quit:       make(chan struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *cryptoPool) work() {
+	for {
+		// Drain relay work first; a handshake only runs when none is waiting
+		select {
+		case job := <-p.relay:
+			p.run(job)
+			continue
+		default:
+		}
+		select {
+		case job := <-p.relay:
+			p.run(job)
+		case job := <-p.handshakes:
+			p.run(job)
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+func (p *cryptoPool) run(job *cryptoJob) {
+	p.reportDepth()
+	job.run()
+}
+
+// Ends the workers. Jobs still queued are run by whoever submitted them.
+func (p *cryptoPool) stop() {
+	p.stopOnce.Do(func() { close(p.quit) })
+}
+
+// Waits for a worker to run job, or runs it here once the pool has stopped
+func (p *cryptoPool) await(job *cryptoJob) {
+	select {
+	case <-job.done:
+	case <-p.quit:
+		job.run()
+	}
+}
+
+// Runs job for an established circuit, waiting for room in the queue if needed
+func (p *cryptoPool) doRelay(job func()) {
+	j := newCryptoJob(job)
+	select {
+	case p.relay <- j:
+		p.reportDepth()
+	case <-p.quit:
+	}
+	p.await(j)
+}
+
+// Runs a handshake job and returns true, or returns false at once if the
+// handshake queue is full or the pool has stopped
+func (p *cryptoPool) doHandshake(job func()) bool {
+	select {
+	case <-p.quit:
+		return false
+	default:
+	}
+	j := newCryptoJob(job)
+	atomic.AddInt64(&p.pending, 1)
+	select {
+	case p.handshakes <- j:
+	default:
+		atomic.AddInt64(&p.pending, -1)
+		return false
+	}
+	p.reportDepth()
+	p.await(j)
+	atomic.AddInt64(&p.pending, -1)
+	return true
+}
+
+// Jobs waiting for a worker
+func (p *cryptoPool) queueDepth() int {
+	return len(p.relay) + len(p.handshakes)
+}
+
+// Handshakes waiting for or being worked on by a worker
+func (p *cryptoPool) handshakeDepth() int {
+	return int(atomic.LoadInt64(&p.pending))
+}
+
+func (p *cryptoPool) reportDepth() {
+	if p.report != nil {
+		p.report(uint64(p.queueDepth()))
+	}
+}
@@ -0,0 +1,159 @@
+package router
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+	"STor/util"
+)
+
+// Occupies the pool's only worker with a handshake until the returned func is called
+func blockWorker(t *testing.T, p *cryptoPool) func() {
+	started, release := make(chan struct{}), make(chan struct{})
+	go p.doHandshake(func() {
+		close(started)
+		<-release
+	})
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatalf("worker did not pick up the handshake")
+	}
+	return func() { close(release) }
+}
+
+func waitFor(t *testing.T, what string, done func() bool) {
+	for deadline := time.Now().Add(time.Second); !done(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func waitForQueue(t *testing.T, p *cryptoPool, depth int) {
+	waitFor(t, "the crypto queue", func() bool { return p.queueDepth() == depth })
+}
+
+func TestRouter_CryptoPoolPrioritisesRelayTraffic(t *testing.T) {
+	var reported uint64
+	var mu sync.Mutex
+	p := newCryptoPool(1, 4, func(depth uint64) {
+		mu.Lock()
+		reported = depth
+		mu.Unlock()
+	})
+	defer p.stop()
+	release := blockWorker(t, p)
+
+	var order []string
+	var wg sync.WaitGroup
+	record := func(kind string) func() {
+		return func() {
+			mu.Lock()
+			order = append(order, kind)
+			mu.Unlock()
+		}
+	}
+	wg.Add(3)
+	go func() { defer wg.Done(); p.doHandshake(record("handshake")) }()
+	go func() { defer wg.Done(); p.doHandshake(record("handshake")) }()
+	waitForQueue(t, p, 2)
+	go func() { defer wg.Done(); p.doRelay(record("relay")) }()
+	waitFor(t, "the queue depth to be reported", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return reported == 3
+	})
+
+	release()
+	wg.Wait()
+	if order[0] != "relay" {
+		t.Fatalf("jobs ran in order %v, want relay traffic first", order)
+	}
+	waitFor(t, "every handshake to finish", func() bool { return p.handshakeDepth() == 0 })
+}
+
+func TestRouter_InitShedsHandshakesWhenBusy(t *testing.T) {
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	r.Crypto = newCryptoPool(1, 1, nil)
+	defer r.Crypto.stop()
+	release := blockWorker(t, r.Crypto)
+	go r.Crypto.doHandshake(func() {})
+	waitForQueue(t, r.Crypto, 1)
+
+	var response storprotocol.STorGeneralRouterPackageResponse
+	err := rrl.Init(initRequest(r, "c1", util.GenerateAESKey()), &response)
+	if err == nil || err.Error() != errRouterBusyMsg {
+		t.Fatalf("handshake beyond the queue was not shed: %v", err)
+	}
+	if _, ok := r.Circuits.Get("c1"); ok {
+		t.Fatalf("circuit was created for a shed handshake")
+	}
+
+	release()
+	waitForQueue(t, r.Crypto, 0)
+	if err = rrl.Init(initRequest(r, "c1", util.GenerateAESKey()), &response); err != nil {
+		t.Fatalf("handshake was rejected once the queue drained: %s", err)
+	}
+}
+
+func TestRouter_CryptoPoolStops(t *testing.T) {
+	before := runtime.NumGoroutine()
+	p := newCryptoPool(4, 4, nil)
+	ran := false
+	p.doRelay(func() { ran = true })
+	if !ran {
+		t.Fatalf("relay job did not run")
+	}
+
+	p.stop()
+	p.stop()
+	waitFor(t, "the workers to stop", func() bool { return runtime.NumGoroutine() <= before })
+
+	// Nothing waits forever on a stopped pool
+	ran = false
+	p.doRelay(func() { ran = true })
+	if !ran {
+		t.Fatalf("relay job submitted after stop did not run")
+	}
+	if p.doHandshake(func() {}) {
+		t.Fatalf("stopped pool took a handshake")
+	}
+}
+
+func TestRouter_TruncateDecryptsInCryptoPool(t *testing.T) {
+	r := newTestRouter(t, 1)
+	rrl := &RouterRPCListener{R: r}
+	r.Crypto = newCryptoPool(1, 1, nil)
+	defer r.Crypto.stop()
+	sk := util.GenerateAESKey()
+	var response storprotocol.STorGeneralRouterPackageResponse
+	if err := rrl.Init(initRequest(r, "c1", sk), &response); err != nil {
+		t.Fatalf("Init returned an error %s", err)
+	}
+
+	release := blockWorker(t, r.Crypto)
+	done := make(chan error, 1)
+	go func() {
+		request := storprotocol.STorGeneralRouterPackageRequest{ClientId: "c1",
+			Payload: util.EncodeAndEncryptAES(sk, storprotocol.STorEncryptedRouterRequest{Seq: nextTestSeq()})}
+		var response storprotocol.STorGeneralRouterPackageResponse
+		done <- rrl.Truncate(request, &response)
+	}()
+	// Queued behind the busy worker rather than decrypted on the RPC goroutine
+	waitForQueue(t, r.Crypto, 1)
+	select {
+	case err := <-done:
+		t.Fatalf("truncate finished while the pool was busy: %v", err)
+	default:
+	}
+
+	release()
+	if err := <-done; err != nil {
+		t.Fatalf("Truncate returned an error %s", err)
+	}
+}
@@ -0,0 +1,150 @@
+package util
+
+import (
+	storprotocol "STor/interface"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Tolerated difference between a coord's clock and the client's
+const directoryClockSkew = 5 * time.Minute
+
+// A coord as listed in a config file
+type AuthorityConfig struct {
+	Addr          string
+	PublicKeyFile string // PEM file with the coord's identity key, empty to skip verification
+}
+
+// A coord and its pinned identity key, which its TLS certificate and
+// directory must be signed with
+type Authority struct {
+	Addr      string
+	PublicKey []byte // nil to skip verification; directories cannot be checked then
+}
+
+// Loads the coords a config lists in coords, or the single one given by
+// coordAddr and coordPublicKeyFile if coords is empty
+func LoadAuthorities(coordAddr string, coordPublicKeyFile string, coords []AuthorityConfig) ([]Authority, error) {
+	if len(coords) == 0 {
+		coords = []AuthorityConfig{{Addr: coordAddr, PublicKeyFile: coordPublicKeyFile}}
+	}
+	authorities := make([]Authority, 0, len(coords))
+	for _, coord := range coords {
+		publicKey, err := ReadPublicKeyFile(coord.PublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		authorities = append(authorities, Authority{Addr: coord.Addr, PublicKey: publicKey})
+	}
+	return authorities, nil
+}
+
+// Smallest number of votes that is more than half of n
+func Majority(n int) int {
+	return n/2 + 1
+}
+
+// Returns, by id, the routers that more than half of authorities list with
+// the same identity key, address, onion key and exit policy. directories holds the
+// listing of each authority that answered, so one that did not counts
+// against every router.
+func AgreedDirectory(directories [][]storprotocol.Router, authorities int) map[int]storprotocol.Router {
+	votes := map[string]int{}
+	listed := map[string]storprotocol.Router{}
+	for _, directory := range directories {
+		// An authority gets one vote per router id, however often it lists it
+		voted := map[int]bool{}
+		for _, router := range directory {
+			if voted[router.RouterId] {
+				continue
+			}
+			voted[router.RouterId] = true
+			key := directoryEntry(router)
+			votes[key]++
+			listed[key] = router
+		}
+	}
+	agreed := map[int]storprotocol.Router{}
+	for key, n := range votes {
+		if n >= Majority(authorities) {
+			agreed[listed[key].RouterId] = listed[key]
+		}
+	}
+	return agreed
+}
+
+// Returns the entries agreed has for routers, or false if it is missing any
+// of them or lists one differently
+func ListedRouters(agreed map[int]storprotocol.Router, routers []storprotocol.Router) ([]storprotocol.Router, bool) {
+	listed := make([]storprotocol.Router, 0, len(routers))
+	for _, router := range routers {
+		entry, ok := agreed[router.RouterId]
+		if !ok || directoryEntry(entry) != directoryEntry(router) {
+			return nil, false
+		}
+		listed = append(listed, entry)
+	}
+	return listed, true
+}
+
+// What a coord signs in a directory: everything but the signature
+func DirectoryDigest(directory storprotocol.STorDirectory) []byte {
+	h := sha256.New()
+	writeField := func(b []byte) { writeDigestField(h, b) }
+	writeInt := func(n uint64) {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		writeField(b[:])
+	}
+	writeField([]byte("stor-directory"))
+	writeInt(directory.Version)
+	published, _ := directory.PublishedAt.UTC().MarshalBinary()
+	writeField(published)
+	validUntil, _ := directory.ValidUntil.UTC().MarshalBinary()
+	writeField(validUntil)
+	for _, router := range directory.Routers {
+		writeInt(uint64(router.RouterId))
+		writeField(router.PublicKey)
+		writeField(router.OnionKey)
+		writeField([]byte(router.Addr))
+		writeField(router.PowSeed)
+		writeInt(uint64(router.PowDifficulty))
+		policy := router.ExitPolicy
+		writeInt(uint64(len(policy.Rules)))
+		for _, rule := range policy.Rules {
+			for _, field := range []string{rule.Action, rule.Host, rule.CIDR, rule.Ports, rule.Scheme} {
+				writeField([]byte(field))
+			}
+		}
+		writeField([]byte(policy.DefaultAction))
+		writeField([]byte(strconv.FormatBool(policy.AllowPrivate)))
+	}
+	return h.Sum(nil)
+}
+
+// Checks that directory is signed by the coord holding publicKey and is
+// current at now
+func CheckDirectory(directory storprotocol.STorDirectory, publicKey []byte, now time.Time) error {
+	switch {
+	case publicKey == nil:
+		return errors.New("no key is pinned for the coord")
+	case !VerifyRSA(publicKey, DirectoryDigest(directory), directory.Signature):
+		return errors.New("directory is not signed by the coord's key")
+	case directory.PublishedAt.After(now.Add(directoryClockSkew)):
+		return errors.New("directory is published in the future")
+	case now.After(directory.ValidUntil):
+		return errors.New("directory has expired")
+	}
+	return nil
+}
+
+// What authorities must agree on about a router. The puzzle changes with the
+// router's load and each authority hears of it at a slightly different time.
+// The exit policy is included since clients choose exits by it.
+func directoryEntry(router storprotocol.Router) string {
+	return fmt.Sprintf("%d|%x|%s|%x|%#v", router.RouterId, router.PublicKey, router.Addr, router.OnionKey, router.ExitPolicy)
+}
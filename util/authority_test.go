@@ -0,0 +1,86 @@
+package util
+
+import (
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	storprotocol "STor/interface"
+)
+
+func TestUtil_AgreedDirectory(t *testing.T) {
+	r1 := storprotocol.Router{RouterId: 1, PublicKey: []byte("k1"), OnionKey: []byte("o1"), Addr: "a1"}
+	r2 := storprotocol.Router{RouterId: 2, PublicKey: []byte("k2"), OnionKey: []byte("o2"), Addr: "a2"}
+	forged := storprotocol.Router{RouterId: 2, PublicKey: []byte("evil"), OnionKey: []byte("o2"), Addr: "a2"}
+	busy := r1
+	busy.PowDifficulty = 8
+
+	// Three authorities, one of them down and one lying about router 2
+	agreed := AgreedDirectory([][]storprotocol.Router{{r1, r2}, {busy, forged, forged}}, 3)
+	if _, ok := ListedRouters(agreed, []storprotocol.Router{r1}); !ok {
+		t.Fatalf("router listed the same way by two of three authorities was not agreed")
+	}
+	if _, ok := agreed[2]; ok {
+		t.Fatalf("router 2 was agreed although the authorities that answered disagree")
+	}
+	if _, ok := ListedRouters(agreed, []storprotocol.Router{r1, forged}); ok {
+		t.Fatalf("ring with a forged router was accepted")
+	}
+
+	agreed = AgreedDirectory([][]storprotocol.Router{{r1, r2}, {r1, forged}, {r1, r2}}, 3)
+	if _, ok := ListedRouters(agreed, []storprotocol.Router{r1, r2}); !ok {
+		t.Fatalf("majority did not decide router 2")
+	}
+	if _, ok := ListedRouters(agreed, []storprotocol.Router{forged}); ok {
+		t.Fatalf("router 2 as only one authority lists it was agreed")
+	}
+	if Majority(1) != 1 || Majority(2) != 2 || Majority(4) != 3 {
+		t.Fatalf("Majority miscounts")
+	}
+}
+
+func TestUtil_CheckDirectory(t *testing.T) {
+	coordKey, _, _ := GenerateRSAKeyPair()
+	otherKey, _, _ := GenerateRSAKeyPair()
+	publicKey := ConvertPublicKeyToBytes(&coordKey.PublicKey)
+	now := time.Now()
+	sign := func(directory storprotocol.STorDirectory, key *rsa.PrivateKey) storprotocol.STorDirectory {
+		directory.Signature, _ = SignRSA(key, DirectoryDigest(directory))
+		return directory
+	}
+	directory := storprotocol.STorDirectory{
+		Version:     3,
+		PublishedAt: now,
+		ValidUntil:  now.Add(10 * time.Minute),
+		Routers:     []storprotocol.Router{{RouterId: 1, PublicKey: []byte("k1"), OnionKey: []byte("o1"), Addr: "a1"}},
+	}
+	signed := sign(directory, coordKey)
+	if err := CheckDirectory(signed, publicKey, now); err != nil {
+		t.Fatalf("valid directory was refused: %s", err)
+	}
+	if CheckDirectory(signed, nil, now) == nil {
+		t.Fatalf("directory was accepted without a pinned key")
+	}
+	if CheckDirectory(sign(directory, otherKey), publicKey, now) == nil {
+		t.Fatalf("directory signed by another key was accepted")
+	}
+
+	// Any change to a signed directory breaks the signature
+	tampered := signed
+	tampered.Routers = []storprotocol.Router{{RouterId: 1, PublicKey: []byte("evil"), OnionKey: []byte("o1"), Addr: "a1"}}
+	if CheckDirectory(tampered, publicKey, now) == nil {
+		t.Fatalf("directory with a swapped router key was accepted")
+	}
+	tampered = signed
+	tampered.ValidUntil = now.Add(time.Hour)
+	if CheckDirectory(tampered, publicKey, now) == nil {
+		t.Fatalf("directory with an extended lifetime was accepted")
+	}
+
+	if CheckDirectory(signed, publicKey, now.Add(11*time.Minute)) == nil {
+		t.Fatalf("expired directory was accepted")
+	}
+	if CheckDirectory(signed, publicKey, now.Add(-time.Hour)) == nil {
+		t.Fatalf("directory published in the future was accepted")
+	}
+}
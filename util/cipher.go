@@ -108,6 +108,10 @@ func ConvertPublicKeyToBytes(puk *rsa.PublicKey) []byte {
 
 func ConvertBytesToPublicKey(key []byte) *rsa.PublicKey {
 	block, _ := pem.Decode(key)
+	if block == nil {
+		fmt.Fprintf(os.Stderr, "Error from converting bytes to public key: no PEM data\n")
+		return nil
+	}
 	b, err := x509.ParsePKCS1PublicKey(block.Bytes)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error from converting bytes to public key: %s\n", err)
@@ -124,9 +128,12 @@ func EncodeAndEncryptRSA(puk []byte, payload interface{}) []byte {
 }
 
 // res needs to be a pointer
-func DecodeAndDecryptRSA(prk *rsa.PrivateKey, ciphertext []byte, res interface{}) {
-	p := DecryptRSAPrivate(prk, ciphertext)
-	Decode(p, res)
+func DecodeAndDecryptRSA(prk *rsa.PrivateKey, ciphertext []byte, res interface{}) error {
+	p, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, prk, ciphertext, nil)
+	if err != nil {
+		return err
+	}
+	return Decode(p, res)
 }
 
 // res needs to be a pointer
@@ -34,3 +34,16 @@ func RouterIds(routers []storprotocol.Router) []int {
 	}
 	return routerIds
 }
+
+// Reports whether a router advertising roles can take role. No roles means all roles.
+func HasRole(roles []string, role string) bool {
+	if len(roles) == 0 {
+		return true
+	}
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
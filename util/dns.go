@@ -0,0 +1,174 @@
+package util
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Just enough of the DNS wire format (RFC 1035) for the client to answer
+// A, AAAA and PTR queries from local applications
+
+const (
+	DNSTypeA    = 1
+	DNSTypePTR  = 12
+	DNSTypeAAAA = 28
+
+	DNSRcodeSuccess        = 0
+	DNSRcodeFormatError    = 1
+	DNSRcodeServerFailure  = 2
+	DNSRcodeNameError      = 3
+	DNSRcodeNotImplemented = 4
+
+	dnsHeaderLen = 12
+	dnsClassIN   = 1
+)
+
+var errMalformedDNS = errors.New("malformed DNS message")
+
+// The single question of a DNS query
+type DNSQuestion struct {
+	Id               uint16
+	Name             string // without the trailing dot
+	Type             uint16
+	Class            uint16
+	RecursionDesired bool
+}
+
+// Parses a query holding exactly one question
+func ParseDNSQuery(msg []byte) (DNSQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return DNSQuestion{}, errMalformedDNS
+	}
+	q := DNSQuestion{
+		Id:               binary.BigEndian.Uint16(msg[0:2]),
+		RecursionDesired: msg[2]&0x01 != 0,
+	}
+	if msg[2]&0x80 != 0 || binary.BigEndian.Uint16(msg[4:6]) != 1 {
+		return q, errMalformedDNS
+	}
+	var labels []string
+	off := dnsHeaderLen
+	for {
+		if off >= len(msg) {
+			return q, errMalformedDNS
+		}
+		n := int(msg[off])
+		off++
+		if n == 0 {
+			break
+		}
+		// Queries have nothing to point back to, so compression is not expected
+		if n&0xC0 != 0 || off+n > len(msg) {
+			return q, errMalformedDNS
+		}
+		labels = append(labels, string(msg[off:off+n]))
+		off += n
+	}
+	if off+4 > len(msg) {
+		return q, errMalformedDNS
+	}
+	q.Name = strings.Join(labels, ".")
+	q.Type = binary.BigEndian.Uint16(msg[off : off+2])
+	q.Class = binary.BigEndian.Uint16(msg[off+2 : off+4])
+	return q, nil
+}
+
+// Builds the response to q. answers are addresses for A and AAAA questions
+// and names for PTR questions; any that do not fit the question type are left out.
+func BuildDNSResponse(q DNSQuestion, rcode int, answers []string, ttl uint32) []byte {
+	name := encodeDNSName(q.Name)
+	var records [][]byte
+	for _, answer := range answers {
+		var data []byte
+		switch q.Type {
+		case DNSTypeA:
+			data = net.ParseIP(answer).To4()
+		case DNSTypeAAAA:
+			if ip := net.ParseIP(answer); ip != nil && ip.To4() == nil {
+				data = ip.To16()
+			}
+		case DNSTypePTR:
+			data = encodeDNSName(strings.TrimSuffix(answer, "."))
+		}
+		if data == nil {
+			continue
+		}
+		// The owner name points back at the question, which follows the header
+		record := []byte{0xC0, dnsHeaderLen}
+		record = appendUint16(record, q.Type)
+		record = appendUint16(record, dnsClassIN)
+		record = appendUint32(record, ttl)
+		record = appendUint16(record, uint16(len(data)))
+		records = append(records, append(record, data...))
+	}
+
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg[0:2], q.Id)
+	msg[2] = 0x80 // response
+	if q.RecursionDesired {
+		msg[2] |= 0x01
+	}
+	msg[3] = 0x80 | byte(rcode&0x0F) // recursion available
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	binary.BigEndian.PutUint16(msg[6:8], uint16(len(records)))
+	msg = append(msg, name...)
+	msg = appendUint16(msg, q.Type)
+	msg = appendUint16(msg, q.Class)
+	for _, record := range records {
+		msg = append(msg, record...)
+	}
+	return msg
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func encodeDNSName(name string) []byte {
+	var encoded []byte
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if len(label) > 63 {
+				label = label[:63]
+			}
+			encoded = append(encoded, byte(len(label)))
+			encoded = append(encoded, label...)
+		}
+	}
+	return append(encoded, 0)
+}
+
+// Returns the address a PTR question under in-addr.arpa or ip6.arpa asks about
+func ParseReverseDNSName(name string) (net.IP, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasSuffix(name, ".in-addr.arpa") {
+		octets := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(octets) == 4 {
+			if ip := net.ParseIP(fmt.Sprintf("%s.%s.%s.%s", octets[3], octets[2], octets[1], octets[0])); ip != nil {
+				return ip, nil
+			}
+		}
+	} else if strings.HasSuffix(name, ".ip6.arpa") {
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) == 32 {
+			var hex strings.Builder
+			for i := len(nibbles) - 1; i >= 0; i-- {
+				hex.WriteString(nibbles[i])
+				if i%4 == 0 && i > 0 {
+					hex.WriteByte(':')
+				}
+			}
+			if ip := net.ParseIP(hex.String()); ip != nil {
+				return ip, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("%s is not a reverse lookup name", name)
+}
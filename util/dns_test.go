@@ -0,0 +1,61 @@
+package util
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	msg := []byte{byte(id >> 8), byte(id), 0x01, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, encodeDNSName(name)...)
+	return append(msg, byte(qtype>>8), byte(qtype), 0, dnsClassIN)
+}
+
+func TestUtil_DNSQueryAndResponse(t *testing.T) {
+	q, err := ParseDNSQuery(dnsQuery(0x1234, "www.example.com", DNSTypeA))
+	if err != nil {
+		t.Fatalf("ParseDNSQuery returned an error %s", err)
+	}
+	if q.Id != 0x1234 || q.Name != "www.example.com" || q.Type != DNSTypeA || !q.RecursionDesired {
+		t.Fatalf("parsed %+v", q)
+	}
+
+	// The IPv6 answer does not fit an A question and is left out
+	response := BuildDNSResponse(q, DNSRcodeSuccess, []string{"93.184.216.34", "2606:2800::1", "10.0.0.1"}, 60)
+	if binary.BigEndian.Uint16(response[0:2]) != 0x1234 || response[2]&0x80 == 0 || response[3]&0x0F != DNSRcodeSuccess {
+		t.Fatalf("bad response header % x", response[:dnsHeaderLen])
+	}
+	if answers := binary.BigEndian.Uint16(response[6:8]); answers != 2 {
+		t.Fatalf("expected 2 answers, got %d", answers)
+	}
+	if !bytes.Contains(response, net.ParseIP("93.184.216.34").To4()) || !bytes.Contains(response, net.ParseIP("10.0.0.1").To4()) {
+		t.Fatalf("response is missing an address")
+	}
+
+	for _, msg := range [][]byte{nil, dnsQuery(1, "x", DNSTypeA)[:14], append([]byte{0, 1, 0x80}, make([]byte, 9)...)} {
+		if _, err := ParseDNSQuery(msg); err == nil {
+			t.Fatalf("malformed query % x was accepted", msg)
+		}
+	}
+}
+
+func TestUtil_ParseReverseDNSName(t *testing.T) {
+	cases := map[string]string{
+		"4.3.2.1.in-addr.arpa":  "1.2.3.4",
+		"4.3.2.1.IN-ADDR.ARPA.": "1.2.3.4",
+		"1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa": "2001:db8::1",
+	}
+	for name, expected := range cases {
+		ip, err := ParseReverseDNSName(name)
+		if err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("%s: got %v, %v, expected %s", name, ip, err, expected)
+		}
+	}
+	for _, name := range []string{"example.com", "3.2.1.in-addr.arpa", "x.3.2.1.in-addr.arpa"} {
+		if _, err := ParseReverseDNSName(name); err == nil {
+			t.Fatalf("%s was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package util
+
+import (
+	storprotocol "STor/interface"
+	"errors"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var privateNetworks = parseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func IsPrivateIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range privateNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a URL into the parts an exit policy looks at, filling in the
+// default port for the scheme
+func ParseExitDestination(rawUrl string) (scheme string, host string, port int, err error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", "", 0, err
+	}
+	scheme = strings.ToLower(u.Scheme)
+	host = strings.ToLower(u.Hostname())
+	if host == "" {
+		return "", "", 0, errors.New("destination has no host")
+	}
+	switch {
+	case u.Port() != "":
+		port, err = strconv.Atoi(u.Port())
+	case scheme == "https":
+		port = 443
+	default:
+		port = 80
+	}
+	return scheme, host, port, err
+}
+
+// Decides whether policy lets an exit fetch scheme://host:port. ips are the
+// addresses host resolves to and every one of them must be allowed; with no
+// ips, CIDR rules never match and only literal private addresses are caught.
+func ExitPolicyAllows(policy storprotocol.ExitPolicy, scheme string, host string, port int, ips []net.IP) bool {
+	if len(ips) == 0 {
+		return exitPolicyAllowsIP(policy, scheme, host, port, net.ParseIP(host))
+	}
+	for _, ip := range ips {
+		if !exitPolicyAllowsIP(policy, scheme, host, port, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Same as ExitPolicyAllows for a URL, resolving its host with lookup
+// (nil skips resolution)
+func ExitPolicyAllowsURL(policy storprotocol.ExitPolicy, rawUrl string, lookup func(string) ([]net.IP, error)) (bool, error) {
+	scheme, host, port, err := ParseExitDestination(rawUrl)
+	if err != nil {
+		return false, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if lookup != nil {
+		if ips, err = lookup(host); err != nil {
+			return false, err
+		}
+	}
+	return ExitPolicyAllows(policy, scheme, host, port, ips), nil
+}
+
+// Decides whether policy lets an exit reach host, at address ip if it is not
+// nil, on any scheme and port. Exits use this for DNS lookups, which name no
+// port: a rule limited to some ports or a scheme only decides if it accepts.
+func ExitPolicyAllowsHost(policy storprotocol.ExitPolicy, host string, ip net.IP) bool {
+	host = strings.ToLower(host)
+	if !policy.AllowPrivate && (IsPrivateIP(ip) || host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return false
+	}
+	for _, rule := range policy.Rules {
+		accept := strings.ToLower(rule.Action) == "accept"
+		if rule.Ports != "" || rule.Scheme != "" {
+			if !accept {
+				continue
+			}
+			rule.Ports, rule.Scheme = "", ""
+		}
+		if exitRuleMatches(rule, "", host, 0, ip) {
+			return accept
+		}
+	}
+	return strings.ToLower(policy.DefaultAction) != "reject"
+}
+
+// Returns the ids of the routers whose exit policy refuses rawUrl whatever
+// its host resolves to. Clients use this to keep both their destination and
+// the DNS lookup for it to themselves; the exit still checks the resolved
+// addresses before it fetches.
+func RefusingExits(routers []storprotocol.Router, rawUrl string) ([]int, error) {
+	scheme, host, port, err := ParseExitDestination(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	var refusing []int
+	for _, router := range routers {
+		if !exitPolicyMayAllow(router.ExitPolicy, scheme, host, port) {
+			refusing = append(refusing, router.RouterId)
+		}
+	}
+	return refusing, nil
+}
+
+// Like ExitPolicyAllows when host is an address. For a name, a CIDR rule
+// that accepts is taken to match, since the name might resolve into it, and
+// one that rejects is taken not to.
+func exitPolicyMayAllow(policy storprotocol.ExitPolicy, scheme string, host string, port int) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return exitPolicyAllowsIP(policy, scheme, host, port, ip)
+	}
+	if !policy.AllowPrivate && (host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return false
+	}
+	for _, rule := range policy.Rules {
+		accept := strings.ToLower(rule.Action) == "accept"
+		if rule.CIDR != "" {
+			rule.CIDR = ""
+			if accept && exitRuleMatches(rule, scheme, host, port, nil) {
+				return true
+			}
+			continue
+		}
+		if exitRuleMatches(rule, scheme, host, port, nil) {
+			return accept
+		}
+	}
+	return strings.ToLower(policy.DefaultAction) != "reject"
+}
+
+func exitPolicyAllowsIP(policy storprotocol.ExitPolicy, scheme string, host string, port int, ip net.IP) bool {
+	if !policy.AllowPrivate && (IsPrivateIP(ip) || host == "localhost" || strings.HasSuffix(host, ".localhost")) {
+		return false
+	}
+	for _, rule := range policy.Rules {
+		if exitRuleMatches(rule, scheme, host, port, ip) {
+			return strings.ToLower(rule.Action) == "accept"
+		}
+	}
+	return strings.ToLower(policy.DefaultAction) != "reject"
+}
+
+func exitRuleMatches(rule storprotocol.ExitRule, scheme string, host string, port int, ip net.IP) bool {
+	if rule.Scheme != "" && !strings.EqualFold(rule.Scheme, scheme) {
+		return false
+	}
+	if rule.Host != "" && !hostMatches(strings.ToLower(rule.Host), host) {
+		return false
+	}
+	if rule.Ports != "" && !portMatches(rule.Ports, port) {
+		return false
+	}
+	if rule.CIDR != "" {
+		_, network, err := net.ParseCIDR(rule.CIDR)
+		if err != nil || ip == nil || !network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+func hostMatches(pattern string, host string) bool {
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:]) || host == pattern[2:]
+	}
+	return pattern == host
+}
+
+func portMatches(ports string, port int) bool {
+	bounds := strings.SplitN(ports, "-", 2)
+	low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	if err != nil {
+		return false
+	}
+	high := low
+	if len(bounds) == 2 {
+		if high, err = strconv.Atoi(strings.TrimSpace(bounds[1])); err != nil {
+			return false
+		}
+	}
+	return port >= low && port <= high
+}
@@ -0,0 +1,113 @@
+package util
+
+import (
+	storprotocol "STor/interface"
+	"net"
+	"testing"
+)
+
+func TestUtil_ExitPolicy(t *testing.T) {
+	policy := storprotocol.ExitPolicy{
+		Rules: []storprotocol.ExitRule{
+			{Action: "reject", Host: "*.blocked.com"},
+			{Action: "reject", CIDR: "20.0.0.0/8", Ports: "8000-8999"},
+			{Action: "accept", Scheme: "https"},
+			{Action: "accept", Ports: "80"},
+		},
+		DefaultAction: "reject",
+	}
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("20.1.2.3")}, nil
+	}
+
+	cases := []struct {
+		url     string
+		allowed bool
+	}{
+		{"http://example.com/", true},
+		{"https://example.com:9443/", true},
+		{"http://example.com:8080/", false},
+		{"http://www.blocked.com/", false},
+		{"http://blocked.com/", false},
+		{"https://20.1.2.3:8500/", false},
+		{"http://localhost/", false},
+		{"http://127.0.0.1/", false},
+		{"http://192.168.1.10/", false},
+		{"http://[::1]/", false},
+	}
+	for _, c := range cases {
+		allowed, err := ExitPolicyAllowsURL(policy, c.url, lookup)
+		if err != nil {
+			t.Fatalf("ExitPolicyAllowsURL(%s) returned an error %s", c.url, err)
+		}
+		if allowed != c.allowed {
+			t.Errorf("ExitPolicyAllowsURL(%s) = %v, expected %v", c.url, allowed, c.allowed)
+		}
+	}
+
+	policy.AllowPrivate = true
+	if allowed, _ := ExitPolicyAllowsURL(policy, "http://127.0.0.1/", nil); !allowed {
+		t.Errorf("AllowPrivate should let loopback through to the rules")
+	}
+}
+
+func TestUtil_ExitPolicyResolvesToPrivate(t *testing.T) {
+	lookup := func(host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("93.184.216.34"), net.ParseIP("10.0.0.5")}, nil
+	}
+	if allowed, _ := ExitPolicyAllowsURL(storprotocol.ExitPolicy{}, "http://rebind.example/", lookup); allowed {
+		t.Errorf("a host resolving to any private address should be rejected")
+	}
+}
+
+func TestUtil_RefusingExits(t *testing.T) {
+	routers := []storprotocol.Router{
+		{RouterId: 1},
+		{RouterId: 2, ExitPolicy: storprotocol.ExitPolicy{DefaultAction: "reject"}},
+		// Might accept the host, depending on what it resolves to
+		{RouterId: 3, ExitPolicy: storprotocol.ExitPolicy{
+			Rules:         []storprotocol.ExitRule{{Action: "accept", CIDR: "93.184.0.0/16"}},
+			DefaultAction: "reject",
+		}},
+		{RouterId: 4, ExitPolicy: storprotocol.ExitPolicy{
+			Rules: []storprotocol.ExitRule{{Action: "reject", Ports: "80"}},
+		}},
+	}
+	refusing, err := RefusingExits(routers, "http://example.com/")
+	if err != nil || len(refusing) != 2 || refusing[0] != 2 || refusing[1] != 4 {
+		t.Fatalf("expected exits [2 4] to refuse, got %v %v", refusing, err)
+	}
+	refusing, _ = RefusingExits(routers, "https://10.0.0.1/")
+	if len(refusing) != 4 {
+		t.Fatalf("expected every exit to refuse a private address, got %v", refusing)
+	}
+	if _, err = RefusingExits(routers, "http://"); err == nil {
+		t.Fatalf("destination without a host was accepted")
+	}
+}
+
+func TestUtil_ExitPolicyAllowsHost(t *testing.T) {
+	policy := storprotocol.ExitPolicy{
+		Rules: []storprotocol.ExitRule{
+			{Action: "reject", Host: "*.blocked.com"},
+			{Action: "reject", Ports: "25"},
+			{Action: "accept", Ports: "443", CIDR: "20.0.0.0/8"},
+		},
+		DefaultAction: "reject",
+	}
+	if !ExitPolicyAllowsHost(policy, "example.com", net.ParseIP("20.1.2.3")) {
+		t.Errorf("a host reachable on port 443 should be resolvable")
+	}
+	if ExitPolicyAllowsHost(policy, "example.com", net.ParseIP("30.1.2.3")) {
+		t.Errorf("a host no rule accepts should not be resolvable")
+	}
+	if ExitPolicyAllowsHost(policy, "www.blocked.com", net.ParseIP("20.1.2.3")) {
+		t.Errorf("a rejected host should not be resolvable")
+	}
+	if ExitPolicyAllowsHost(storprotocol.ExitPolicy{}, "intranet.example", net.ParseIP("192.168.1.10")) {
+		t.Errorf("a private address should not be resolvable")
+	}
+	if !ExitPolicyAllowsHost(storprotocol.ExitPolicy{AllowPrivate: true}, "localhost", net.ParseIP("127.0.0.1")) {
+		t.Errorf("AllowPrivate should let loopback through")
+	}
+}
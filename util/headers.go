@@ -0,0 +1,106 @@
+package util
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Sent in place of the browser's, so every client looks the same to the web server
+const (
+	DefaultUserAgent      = "Mozilla/5.0 (Windows NT 10.0; rv:102.0) Gecko/20100101 Firefox/102.0"
+	DefaultAcceptLanguage = "en-US,en;q=0.5"
+)
+
+// Headers that identify the browser, its user or where they came from. An
+// entry ending in "*" matches every header starting with the rest of it.
+var DefaultStrippedHeaders = []string{
+	"Authorization",
+	"Cf-Connecting-Ip",
+	"Client-Ip",
+	"Dnt",
+	"Forwarded",
+	"From",
+	"If-Modified-Since",
+	"If-None-Match", // an ETag can be a tracking id
+	"Origin",
+	"Referer",
+	"Sec-Ch-*", // client hints give away the platform and browser version
+	"Sec-Fetch-*",
+	"True-Client-Ip",
+	"Via",
+	"X-Client-Ip",
+	"X-Forwarded-*",
+	"X-Real-Ip",
+}
+
+// Never passed on, whatever the policy says. The browser's cookies link its
+// requests across circuits, hop-by-hop headers are about the link to the
+// client, and the exit negotiates compression itself and relays the body decoded.
+var alwaysStrippedHeaders = []string{
+	"Accept-Encoding",
+	"Connection",
+	"Cookie",
+	"Keep-Alive",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// What the client tells web servers about the browser
+type HeaderPolicy struct {
+	Strip          []string // headers removed from every request, DefaultStrippedHeaders if empty
+	UserAgent      string   // DefaultUserAgent if empty
+	AcceptLanguage string   // DefaultAcceptLanguage if empty
+}
+
+// Returns a copy of header with identifying headers removed and the rest
+// normalised, carrying cookies instead of the browser's own
+func (p HeaderPolicy) Apply(header http.Header, cookies []*http.Cookie) http.Header {
+	strip := p.Strip
+	if len(strip) == 0 {
+		strip = DefaultStrippedHeaders
+	}
+	scrubbed := http.Header{}
+	for key, values := range header {
+		key = http.CanonicalHeaderKey(key)
+		if matchesHeader(alwaysStrippedHeaders, key) || matchesHeader(strip, key) {
+			continue
+		}
+		scrubbed[key] = append([]string(nil), values...)
+	}
+
+	userAgent, acceptLanguage := p.UserAgent, p.AcceptLanguage
+	if userAgent == "" {
+		userAgent = DefaultUserAgent
+	}
+	if acceptLanguage == "" {
+		acceptLanguage = DefaultAcceptLanguage
+	}
+	scrubbed.Set("User-Agent", userAgent)
+	scrubbed.Set("Accept-Language", acceptLanguage)
+	if len(cookies) > 0 {
+		pairs := make([]string, 0, len(cookies))
+		for _, cookie := range cookies {
+			pairs = append(pairs, (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+		}
+		scrubbed.Set("Cookie", strings.Join(pairs, "; "))
+	}
+	return scrubbed
+}
+
+func matchesHeader(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		pattern = http.CanonicalHeaderKey(pattern)
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+		} else if pattern == key {
+			return true
+		}
+	}
+	return false
+}
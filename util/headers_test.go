@@ -0,0 +1,47 @@
+package util
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestUtil_HeaderPolicy(t *testing.T) {
+	browser := http.Header{
+		"Accept":             {"text/html"},
+		"Accept-Encoding":    {"gzip, br"},
+		"Accept-Language":    {"fr-CA,fr;q=0.9"},
+		"Cookie":             {"session=browser"},
+		"Referer":            {"http://example.com/secret"},
+		"Sec-Ch-Ua-Platform": {"\"Linux\""},
+		"User-Agent":         {"Mozilla/5.0 (X11; Linux x86_64) Chrome/99.0"},
+		"X-Forwarded-For":    {"20.121.112.117"},
+	}
+	scrubbed := HeaderPolicy{}.Apply(browser, []*http.Cookie{{Name: "site", Value: "circuit1", Path: "/"}})
+
+	for _, key := range []string{"Accept-Encoding", "Referer", "Sec-Ch-Ua-Platform", "X-Forwarded-For"} {
+		if value := scrubbed.Get(key); value != "" {
+			t.Fatalf("%s was passed on as %q", key, value)
+		}
+	}
+	if scrubbed.Get("Cookie") != "site=circuit1" {
+		t.Fatalf("Cookie is %q, want only the circuit's cookie", scrubbed.Get("Cookie"))
+	}
+	if scrubbed.Get("User-Agent") != DefaultUserAgent || scrubbed.Get("Accept-Language") != DefaultAcceptLanguage {
+		t.Fatalf("user agent and language were not normalised: %v", scrubbed)
+	}
+	if scrubbed.Get("Accept") != "text/html" {
+		t.Fatalf("Accept was not passed on")
+	}
+	if browser.Get("Cookie") != "session=browser" {
+		t.Fatalf("Apply changed the browser's header")
+	}
+
+	// A custom strip list replaces the default, but browser cookies never pass
+	scrubbed = HeaderPolicy{Strip: []string{"accept"}, UserAgent: "stor"}.Apply(browser, nil)
+	if scrubbed.Get("Accept") != "" || scrubbed.Get("Cookie") != "" {
+		t.Fatalf("custom policy passed on %v", scrubbed)
+	}
+	if scrubbed.Get("Referer") == "" || scrubbed.Get("User-Agent") != "stor" {
+		t.Fatalf("custom policy was not applied: %v", scrubbed)
+	}
+}
@@ -0,0 +1,74 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base32"
+	"encoding/binary"
+	"hash"
+	"strings"
+
+	storprotocol "STor/interface"
+)
+
+// Characters of the key hash kept in an address, 80 bits like Tor's v2 addresses
+const serviceAddressChars = 16
+
+var serviceAddressEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Derives an onion service address from the service's PEM encoded public
+// key, so a client holding the address can tell the key is genuine. Returns
+// "" for an invalid key.
+func ServiceAddress(publicKey []byte) string {
+	key := ConvertBytesToPublicKey(publicKey)
+	if key == nil {
+		return ""
+	}
+	hash := sha256.Sum256(x509.MarshalPKCS1PublicKey(key))
+	encoded := strings.ToLower(serviceAddressEncoding.EncodeToString(hash[:]))
+	return encoded[:serviceAddressChars] + storprotocol.ServiceAddressSuffix
+}
+
+func IsServiceAddress(host string) bool {
+	return strings.HasSuffix(strings.ToLower(host), storprotocol.ServiceAddressSuffix)
+}
+
+// What the service key signs in a descriptor: everything but the signature
+func DescriptorDigest(descriptor storprotocol.STorServiceDescriptor) []byte {
+	h := sha256.New()
+	writeField := func(b []byte) { writeDigestField(h, b) }
+	writeField([]byte(descriptor.Address))
+	writeField(descriptor.PublicKey)
+	published, _ := descriptor.PublishedAt.UTC().MarshalBinary()
+	writeField(published)
+	for _, router := range descriptor.IntroPoints {
+		var id [8]byte
+		binary.BigEndian.PutUint64(id[:], uint64(router.RouterId))
+		writeField(id[:])
+		writeField(router.PublicKey)
+		writeField(router.OnionKey)
+		writeField([]byte(router.Addr))
+	}
+	return h.Sum(nil)
+}
+
+// Length-prefixes b so fields cannot run into each other
+func writeDigestField(h hash.Hash, b []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(b)))
+	h.Write(length[:])
+	h.Write(b)
+}
+
+// Checks that a descriptor is signed by the key its address was derived from
+func VerifyDescriptor(descriptor storprotocol.STorServiceDescriptor) bool {
+	return descriptor.Address == ServiceAddress(descriptor.PublicKey) &&
+		VerifyRSA(descriptor.PublicKey, DescriptorDigest(descriptor), descriptor.Signature)
+}
+
+// What a service signs to make a router its introduction point on the
+// circuit clientId, so the signature cannot be replayed on another circuit
+func EstablishIntroDigest(clientId string) []byte {
+	hash := sha256.Sum256([]byte("stor-establish-intro:" + clientId))
+	return hash[:]
+}
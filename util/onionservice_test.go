@@ -0,0 +1,29 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	storprotocol "STor/interface"
+)
+
+func TestUtil_ServiceAddress(t *testing.T) {
+	_, publicKey, _ := GenerateRSAKeyPair()
+	_, otherKey, _ := GenerateRSAKeyPair()
+	address := ServiceAddress(ConvertPublicKeyToBytes(publicKey))
+	if !IsServiceAddress(address) || len(address) != serviceAddressChars+len(storprotocol.ServiceAddressSuffix) || strings.ToLower(address) != address {
+		t.Fatalf("unexpected address %s", address)
+	}
+	if address != ServiceAddress(ConvertPublicKeyToBytes(publicKey)) {
+		t.Fatalf("address is not stable")
+	}
+	if address == ServiceAddress(ConvertPublicKeyToBytes(otherKey)) {
+		t.Fatalf("two keys share an address")
+	}
+	if ServiceAddress([]byte("not a key")) != "" {
+		t.Fatalf("invalid key has an address")
+	}
+	if IsServiceAddress("example.com") {
+		t.Fatalf("example.com taken for an onion service")
+	}
+}
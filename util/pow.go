@@ -0,0 +1,51 @@
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+)
+
+// Hashcash-style client puzzles for circuit handshakes. A solution is a nonce
+// for which sha256(seed || clientId || nonce) starts with difficulty zero
+// bits; seed is the router's current puzzle seed, so solutions cannot be
+// computed ahead of time or used at another router.
+
+func powDigest(seed []byte, clientId string, nonce uint64) [sha256.Size]byte {
+	msg := make([]byte, 0, len(seed)+len(clientId)+8)
+	msg = append(msg, seed...)
+	msg = append(msg, clientId...)
+	var n [8]byte
+	binary.BigEndian.PutUint64(n[:], nonce)
+	return sha256.Sum256(append(msg, n[:]...))
+}
+
+func leadingZeroBits(digest []byte) int {
+	zeros := 0
+	for _, b := range digest {
+		if b != 0 {
+			return zeros + bits.LeadingZeros8(b)
+		}
+		zeros += 8
+	}
+	return zeros
+}
+
+// Checks a solution. Any nonce solves a puzzle of difficulty 0 or less.
+func CheckPow(seed []byte, clientId string, nonce uint64, difficulty int) bool {
+	if difficulty <= 0 {
+		return true
+	}
+	digest := powDigest(seed, clientId, nonce)
+	return leadingZeroBits(digest[:]) >= difficulty
+}
+
+// Finds a solution by trying nonces in turn; each extra bit of difficulty
+// doubles the expected work
+func SolvePow(seed []byte, clientId string, difficulty int) uint64 {
+	var nonce uint64
+	for !CheckPow(seed, clientId, nonce, difficulty) {
+		nonce++
+	}
+	return nonce
+}
@@ -0,0 +1,24 @@
+package util
+
+import (
+	"testing"
+)
+
+func TestUtil_ProofOfWork(t *testing.T) {
+	seed := []byte("router seed")
+	nonce := SolvePow(seed, "c1", 12)
+	if !CheckPow(seed, "c1", nonce, 12) {
+		t.Fatalf("solution %d does not check", nonce)
+	}
+
+	// The solution is bound to the router's seed and the circuit
+	if CheckPow([]byte("other seed"), "c1", nonce, 12) || CheckPow(seed, "c2", nonce, 12) || CheckPow(seed, "c1", nonce, 40) {
+		t.Fatalf("solution was accepted for a different puzzle")
+	}
+	if !CheckPow(seed, "c1", 12345, 0) {
+		t.Fatalf("difficulty 0 must accept any nonce")
+	}
+	if leadingZeroBits([]byte{0, 0x1F}) != 11 || leadingZeroBits([]byte{0x80}) != 0 {
+		t.Fatalf("leadingZeroBits miscounts")
+	}
+}
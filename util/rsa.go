@@ -5,6 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
 )
 
 func GenerateRSAKeyPair() (*rsa.PrivateKey, *rsa.PublicKey, error) {
@@ -35,3 +40,64 @@ func DecryptRSA(privateKey *rsa.PrivateKey, ciphertext []byte) (string, error) {
 
 	return string(plaintext), nil
 }
+
+// Reads a PEM encoded RSA private key from path. If the file does not exist a
+// new key is generated and written to path, with its public half in path.pub
+func LoadOrCreateRSAKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		privateKey, publicKey, err := GenerateRSAKeyPair()
+		if err != nil {
+			return nil, err
+		}
+		if err = SaveRSAKey(path, privateKey); err != nil {
+			return nil, err
+		}
+		return privateKey, ioutil.WriteFile(path+".pub", ConvertPublicKeyToBytes(publicKey), 0644)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in " + path)
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+func SaveRSAKey(path string, privateKey *rsa.PrivateKey) error {
+	b := pem.EncodeToMemory(
+		&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+		},
+	)
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// Reads a PEM encoded public key (as produced by ConvertPublicKeyToBytes).
+// An empty path returns nil, meaning the key is not pinned.
+func ReadPublicKeyFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if ConvertBytesToPublicKey(data) == nil {
+		return nil, errors.New("invalid public key in " + path)
+	}
+	return data, nil
+}
+
+// Signs digest, a SHA-256 hash, with privateKey
+func SignRSA(privateKey *rsa.PrivateKey, digest []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest)
+}
+
+// Checks a signature by SignRSA against a PEM encoded public key
+func VerifyRSA(publicKey []byte, digest []byte, signature []byte) bool {
+	key := ConvertBytesToPublicKey(publicKey)
+	return key != nil && rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, signature) == nil
+}
@@ -0,0 +1,72 @@
+package util
+
+import (
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type EchoService struct{}
+
+func (e *EchoService) Echo(msg string, reply *string) error {
+	*reply = msg
+	return nil
+}
+
+func TestUtil_TLSPinnedKey(t *testing.T) {
+	serverKey, serverPuk, _ := GenerateRSAKeyPair()
+	serverCert, err := NewTLSCertificate(serverKey)
+	if err != nil {
+		t.Fatalf("NewTLSCertificate returned an error %s", err)
+	}
+	clientKey, _, _ := GenerateRSAKeyPair()
+	clientCert, _ := NewTLSCertificate(clientKey)
+
+	listener, err := ListenTLS("127.0.0.1:0", serverCert)
+	if err != nil {
+		t.Fatalf("ListenTLS returned an error %s", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.Register(&EchoService{})
+	go server.Accept(listener)
+
+	client, err := DialRPC(listener.Addr().String(), clientCert, ConvertPublicKeyToBytes(serverPuk))
+	if err != nil {
+		t.Fatalf("DialRPC with the server's key returned an error %s", err)
+	}
+	var reply string
+	if err = client.Call("EchoService.Echo", "onion", &reply); err != nil || reply != "onion" {
+		t.Fatalf("Echo over TLS failed: '%s' %v", reply, err)
+	}
+	client.Close()
+
+	_, otherPuk, _ := GenerateRSAKeyPair()
+	if _, err = DialRPC(listener.Addr().String(), clientCert, ConvertPublicKeyToBytes(otherPuk)); err == nil {
+		t.Fatalf("DialRPC accepted a peer with the wrong public key")
+	}
+}
+
+func TestUtil_AcceptLoopStopsWhenClosed(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen returned an error %s", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		AcceptLoop(listener, func(conn net.Conn) { conn.Close() })
+		close(done)
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial returned an error %s", err)
+	}
+	conn.Close()
+	listener.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("AcceptLoop kept running after its listener was closed")
+	}
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"bytes"
+	"net"
+	"net/rpc"
+	"path/filepath"
+	"testing"
+)
+
+type echoService struct{}
+
+func (echoService) Echo(request string, response *string) error {
+	*response = request
+	return nil
+}
+
+func TestUtil_ScrambleTransport(t *testing.T) {
+	privateKey, publicKey, _ := GenerateRSAKeyPair()
+	cert, _ := NewTLSCertificate(privateKey)
+	bridgeKey := ConvertPublicKeyToBytes(publicKey)
+	secretFile := filepath.Join(t.TempDir(), "transport_secret")
+	secret, err := LoadOrCreateTransportSecret(secretFile)
+	if err != nil {
+		t.Fatalf("LoadOrCreateTransportSecret returned an error %s", err)
+	}
+	if again, _ := LoadOrCreateTransportSecret(secretFile); !bytes.Equal(again, secret) {
+		t.Fatalf("transport secret changed when it was loaded again")
+	}
+	transport, err := NewTransport(TransportScramble, secret)
+	if err != nil {
+		t.Fatalf("NewTransport returned an error %s", err)
+	}
+
+	listener, err := ListenTLSOver("127.0.0.1:0", cert, transport)
+	if err != nil {
+		t.Fatalf("ListenTLSOver returned an error %s", err)
+	}
+	defer listener.Close()
+	server := rpc.NewServer()
+	server.RegisterName("Echo", echoService{})
+	go server.Accept(listener)
+
+	clientKey, _, _ := GenerateRSAKeyPair()
+	clientCert, _ := NewTLSCertificate(clientKey)
+	client, err := DialRPCOver(listener.Addr().String(), clientCert, bridgeKey, transport)
+	if err != nil {
+		t.Fatalf("DialRPCOver returned an error %s", err)
+	}
+	var reply string
+	if err = client.Call("Echo.Echo", "hello", &reply); err != nil || reply != "hello" {
+		t.Fatalf("call over the transport returned %q, %v", reply, err)
+	}
+	client.Close()
+
+	// Knowing the bridge's public identity key is not enough to get through
+	wrongTransport, _ := NewTransport(TransportScramble, bridgeKey)
+	if _, err = DialRPCOver(listener.Addr().String(), clientCert, bridgeKey, wrongTransport); err == nil {
+		t.Fatalf("handshake succeeded with the wrong transport secret")
+	}
+
+	if _, err = NewTransport(TransportScramble, nil); err == nil {
+		t.Fatalf("scramble transport was created without a secret")
+	}
+	if _, err = NewTransport("unknown", secret); err == nil {
+		t.Fatalf("unknown transport was accepted")
+	}
+}
+
+// What a client sends first on a link, as a censor would see it
+func firstBytes(t *testing.T, transport Transport) []byte {
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %s", err)
+	}
+	defer raw.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := raw.Accept()
+		if err != nil {
+			received <- nil
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 64)
+		n, _ := conn.Read(buf)
+		received <- buf[:n]
+	}()
+	clientKey, _, _ := GenerateRSAKeyPair()
+	clientCert, _ := NewTLSCertificate(clientKey)
+	go DialRPCOver(raw.Addr().String(), clientCert, nil, transport)
+	return <-received
+}
+
+func TestUtil_ScrambleHidesTLSHandshake(t *testing.T) {
+	// A plain link opens with a TLS handshake record
+	if first := firstBytes(t, nil); len(first) < 2 || first[0] != 0x16 || first[1] != 0x03 {
+		t.Fatalf("expected a TLS handshake record, got % x", first)
+	}
+	transport, _ := NewTransport(TransportScramble, bytes.Repeat([]byte("bridge secret"), 2))
+	a, b := firstBytes(t, transport), firstBytes(t, transport)
+	if len(a) < 2 || (a[0] == 0x16 && a[1] == 0x03) {
+		t.Fatalf("scrambled link starts like TLS: % x", a)
+	}
+	if bytes.Equal(a[:scrambleNonceLen], b[:scrambleNonceLen]) {
+		t.Fatalf("two links started with the same bytes")
+	}
+}